@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// compressedExts are formats that deflate cannot shrink; they are stored
+// as-is to save CPU on large photo and video archives.
+var compressedExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".heif": true,
+	".mp4": true, ".mov": true, ".mkv": true, ".webm": true, ".3gp": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true,
+	".zip": true, ".gz": true, ".tgz": true, ".xz": true, ".bz2": true, ".zst": true, ".7z": true, ".rar": true,
+	".apk": true, ".jar": true, ".docx": true, ".xlsx": true, ".pptx": true, ".odt": true,
+}
+
+// archiveEntry is one file to add, with its name inside the zip.
+type archiveEntry struct {
+	path string
+	name string
+	info os.FileInfo
+}
+
+// collectArchiveEntries resolves the requested files and folder inside
+// shareDir. Folder contents keep the folder name as their prefix; symlinks
+// inside a folder are skipped.
+func collectArchiveEntries(payload archivePayload) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	seen := map[string]bool{}
+	add := func(p, name string, info os.FileInfo) error {
+		if seen[p] {
+			return nil
+		}
+		if len(entries) >= maxArchiveEntries {
+			return fmt.Errorf("more than %d files requested", maxArchiveEntries)
+		}
+		seen[p] = true
+		entries = append(entries, archiveEntry{path: p, name: name, info: info})
+		return nil
+	}
+
+	for _, rel := range payload.Files {
+		p, err := resolveSharePath(rel)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a file", rel)
+		}
+		if err := add(p, path.Clean(strings.Trim(filepath.ToSlash(rel), "/")), info); err != nil {
+			return nil, err
+		}
+	}
+
+	if strings.Trim(payload.Path, "/") != "" {
+		root, err := resolveSharePath(payload.Path)
+		if err != nil {
+			return nil, err
+		}
+		parent := filepath.Dir(root)
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if syncPrivatePath(p) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			name, _ := filepath.Rel(parent, p)
+			return add(p, filepath.ToSlash(name), info)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// handleDownloadArchive serves POST /download/archive: the selected share
+// files as a zip streamed straight to the response, with nothing staged on
+// disk. Already-compressed media is stored rather than deflated. Everything
+// is validated before the first byte is sent, since errors after that can
+// only abort the stream.
+func handleDownloadArchive(w http.ResponseWriter, r *http.Request) {
+	var payload archivePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if len(payload.Files) == 0 && strings.Trim(payload.Path, "/") == "" {
+		errorJSON(w, http.StatusBadRequest, "files or path is required")
+		return
+	}
+
+	entries, err := collectArchiveEntries(payload)
+	switch {
+	case os.IsNotExist(err):
+		errorJSON(w, http.StatusNotFound, "file not found")
+		return
+	case err != nil:
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	case len(entries) == 0:
+		errorJSON(w, http.StatusNotFound, "no files to archive")
+		return
+	}
+
+	name := filepath.Base(payload.Name)
+	if name == "." || name == "/" || payload.Name == "" {
+		name = "share.zip"
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".zip") {
+		name += ".zip"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	start := time.Now()
+	written, err := writeZipArchive(r, w, entries)
+	if err != nil {
+		// Headers are gone; all we can do is cut the stream short so the
+		// client sees a truncated archive rather than a valid-looking one.
+		if r.Context().Err() != nil {
+			slog.Info("Archive download cancelled by client", "name", name, "bytes", written)
+		} else {
+			slog.Error("Archive download failed", "name", name, "err", err)
+		}
+		panic(http.ErrAbortHandler)
+	}
+	slog.Info("Served archive to phone", "name", name, "files", len(entries), "bytes", written, "duration", time.Since(start).Round(time.Millisecond))
+}
+
+// countingWriter tracks bytes sent so cancelled downloads can be logged.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeZipArchive(r *http.Request, w io.Writer, entries []archiveEntry) (int64, error) {
+	cw := &countingWriter{w: w}
+	zw := zip.NewWriter(cw)
+	for _, e := range entries {
+		if err := r.Context().Err(); err != nil {
+			return cw.n, err
+		}
+		if err := addZipEntry(zw, e); err != nil {
+			return cw.n, err
+		}
+	}
+	err := zw.Close()
+	return cw.n, err
+}
+
+func addZipEntry(zw *zip.Writer, e archiveEntry) error {
+	header, err := zip.FileInfoHeader(e.info)
+	if err != nil {
+		return err
+	}
+	header.Name = e.name
+	if compressedExts[strings.ToLower(filepath.Ext(e.name))] {
+		return addStoredZipEntry(zw, header, e.path)
+	}
+	header.Method = zip.Deflate
+
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// addStoredZipEntry writes an uncompressed entry with its CRC and size in
+// the local header. CreateHeader would defer them to a data descriptor,
+// which Java's ZipInputStream (and so the Android app) only accepts on
+// deflated entries. The file is read twice; if it changes in between the
+// archive is aborted rather than sent with a wrong checksum.
+func addStoredZipEntry(zw *zip.Writer, header *zip.FileHeader, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := crc32.NewIEEE()
+	size, err := io.Copy(sum, f)
+	if err != nil {
+		return err
+	}
+	header.Method = zip.Store
+	header.CRC32 = sum.Sum32()
+	header.CompressedSize64 = uint64(size)
+	header.UncompressedSize64 = uint64(size)
+
+	dst, err := zw.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sum.Reset()
+	if _, err := io.CopyN(io.MultiWriter(dst, sum), f, size); err != nil {
+		return err
+	}
+	if sum.Sum32() != header.CRC32 {
+		return fmt.Errorf("%s changed while being archived", header.Name)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// audioState is the default output's volume, in percent, and mute state.
+type audioState struct {
+	Volume  int    `json:"volume"`
+	Muted   bool   `json:"muted"`
+	Backend string `json:"backend"`
+}
+
+// audioController reads and changes the default audio output.
+type audioController interface {
+	Get(ctx context.Context) (audioState, error)
+	SetVolume(ctx context.Context, percent int) error
+	SetMute(ctx context.Context, muted bool) error
+}
+
+// runAudioCmd runs wpctl or pactl and returns its output. It is a variable
+// so tests can replay canned output.
+var runAudioCmd = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// wpctlAudio controls PipeWire through WirePlumber's wpctl.
+type wpctlAudio struct{}
+
+const wpctlSink = "@DEFAULT_AUDIO_SINK@"
+
+func (wpctlAudio) Get(ctx context.Context) (audioState, error) {
+	out, err := runAudioCmd(ctx, "wpctl", "get-volume", wpctlSink)
+	if err != nil {
+		return audioState{}, err
+	}
+	// "Volume: 0.40" or "Volume: 0.40 [MUTED]"
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 || fields[0] != "Volume:" {
+		return audioState{}, fmt.Errorf("unexpected wpctl output %q", strings.TrimSpace(string(out)))
+	}
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return audioState{}, fmt.Errorf("unexpected wpctl volume %q", fields[1])
+	}
+	return audioState{
+		Volume:  int(v*100 + 0.5),
+		Muted:   strings.Contains(string(out), "[MUTED]"),
+		Backend: "wpctl",
+	}, nil
+}
+
+func (wpctlAudio) SetVolume(ctx context.Context, percent int) error {
+	_, err := runAudioCmd(ctx, "wpctl", "set-volume", wpctlSink, strconv.Itoa(percent)+"%")
+	return err
+}
+
+func (wpctlAudio) SetMute(ctx context.Context, muted bool) error {
+	_, err := runAudioCmd(ctx, "wpctl", "set-mute", wpctlSink, boolFlag(muted))
+	return err
+}
+
+// pactlAudio controls PulseAudio, or PipeWire's Pulse server, with pactl.
+type pactlAudio struct{}
+
+const pactlSink = "@DEFAULT_SINK@"
+
+var pactlPercent = regexp.MustCompile(`(\d+)%`)
+
+func (pactlAudio) Get(ctx context.Context) (audioState, error) {
+	// "Volume: front-left: 26214 /  40% / -23.88 dB,   front-right: ..."
+	out, err := runAudioCmd(ctx, "pactl", "get-sink-volume", pactlSink)
+	if err != nil {
+		return audioState{}, err
+	}
+	m := pactlPercent.FindStringSubmatch(string(out))
+	if m == nil {
+		return audioState{}, fmt.Errorf("unexpected pactl output %q", strings.TrimSpace(string(out)))
+	}
+	volume, _ := strconv.Atoi(m[1])
+
+	out, err = runAudioCmd(ctx, "pactl", "get-sink-mute", pactlSink)
+	if err != nil {
+		return audioState{}, err
+	}
+	return audioState{
+		Volume:  volume,
+		Muted:   strings.TrimSpace(string(out)) == "Mute: yes",
+		Backend: "pactl",
+	}, nil
+}
+
+func (pactlAudio) SetVolume(ctx context.Context, percent int) error {
+	_, err := runAudioCmd(ctx, "pactl", "set-sink-volume", pactlSink, strconv.Itoa(percent)+"%")
+	return err
+}
+
+func (pactlAudio) SetMute(ctx context.Context, muted bool) error {
+	_, err := runAudioCmd(ctx, "pactl", "set-sink-mute", pactlSink, boolFlag(muted))
+	return err
+}
+
+func boolFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// newAudioController prefers wpctl, which talks to PipeWire directly, and
+// falls back to pactl. It returns nil if neither is installed.
+func newAudioController() audioController {
+	if _, err := exec.LookPath("wpctl"); err == nil {
+		return wpctlAudio{}
+	}
+	if _, err := exec.LookPath("pactl"); err == nil {
+		return pactlAudio{}
+	}
+	return nil
+}
+
+// audio controls the default output; nil when no backend is available.
+var audio audioController
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// handleGetAudio serves GET /audio: the default output's volume (percent)
+// and mute state.
+func handleGetAudio(w http.ResponseWriter, r *http.Request) {
+	if audio == nil {
+		errorJSON(w, http.StatusServiceUnavailable, "no audio backend available (install wpctl or pactl)")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), mediaCommandTimeout)
+	defer cancel()
+	state, err := audio.Get(ctx)
+	if err != nil {
+		slog.Error("Failed to read audio state", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to read volume")
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// handleSetAudio serves POST /audio with {"volume"} (clamped to
+// 0–maxAudioVolume), {"muted"} or both, and replies with the new state.
+func handleSetAudio(w http.ResponseWriter, r *http.Request) {
+	if audio == nil {
+		errorJSON(w, http.StatusServiceUnavailable, "no audio backend available (install wpctl or pactl)")
+		return
+	}
+	var payload audioPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	if payload.Volume == nil && payload.Muted == nil {
+		errorJSON(w, http.StatusBadRequest, "Missing volume or muted")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), mediaCommandTimeout)
+	defer cancel()
+	if payload.Volume != nil {
+		volume := max(0, min(maxAudioVolume, *payload.Volume))
+		if err := audio.SetVolume(ctx, volume); err != nil {
+			slog.Error("Failed to set volume", "volume", volume, "err", err)
+			errorJSON(w, http.StatusInternalServerError, "failed to set volume")
+			return
+		}
+	}
+	if payload.Muted != nil {
+		if err := audio.SetMute(ctx, *payload.Muted); err != nil {
+			slog.Error("Failed to set mute", "muted", *payload.Muted, "err", err)
+			errorJSON(w, http.StatusInternalServerError, "failed to set mute")
+			return
+		}
+	}
+	audioProbe.invalidate()
+	state, err := audio.Get(ctx)
+	if err != nil {
+		slog.Error("Failed to read audio state", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to read volume")
+		return
+	}
+	slog.Info("Audio changed from phone", "volume", state.Volume, "muted", state.Muted)
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handleBackupManifest serves POST /backup/manifest. The phone sends the
+// (path, size, mtime, sha256) of every camera-roll item it wants backed up
+// and gets back the entries whose content is not on the laptop yet. Items
+// sharing a hash are reported once, since one upload covers them all.
+func handleBackupManifest(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBackupManifestBytes)
+	var payload backupManifestPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if len(payload.Files) > maxBackupManifestEntries {
+		errorJSON(w, http.StatusRequestEntityTooLarge, "too many manifest entries; send them in batches")
+		return
+	}
+
+	seen := make(map[string]bool, len(payload.Files))
+	sums := make([]string, 0, len(payload.Files))
+	bySum := make(map[string]backupManifestEntry, len(payload.Files))
+	for i, entry := range payload.Files {
+		sum, err := parseSHA256(entry.SHA256)
+		if err != nil || sum == "" {
+			errorJSON(w, http.StatusBadRequest, "files["+strconv.Itoa(i)+"]: a valid sha256 is required")
+			return
+		}
+		if seen[sum] {
+			continue
+		}
+		seen[sum] = true
+		entry.SHA256 = sum
+		sums = append(sums, sum)
+		bySum[sum] = entry
+	}
+
+	missingSums, err := backups.missing(sums)
+	if err != nil {
+		slog.Error("Failed to read backup index", "dir", backups.dir, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "backup index unavailable")
+		return
+	}
+	missing := make([]backupManifestEntry, 0, len(missingSums))
+	for _, sum := range missingSums {
+		missing = append(missing, bySum[sum])
+	}
+
+	slog.Info("Backup manifest checked", "entries", len(payload.Files), "missing", len(missing))
+	writeJSON(w, http.StatusOK, map[string]any{
+		"missing": missing,
+		"present": len(sums) - len(missing),
+	})
+}
+
+// handleBackupUpload serves PUT /backup/files/{sha256}: the raw file body,
+// addressed by its content hash, with ?name= and an optional ?mtime= (epoch
+// millis) used when the file carries no EXIF date. Content that is already
+// stored is acknowledged without reading the body.
+func handleBackupUpload(w http.ResponseWriter, r *http.Request) {
+	sum, err := parseSHA256(r.PathValue("sha256"))
+	if err != nil || sum == "" {
+		errorJSON(w, http.StatusBadRequest, "invalid sha256")
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if _, err := safePath(backups.dir, name); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid name")
+		return
+	}
+	var mtime time.Time
+	if raw := r.URL.Query().Get("mtime"); raw != "" {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			errorJSON(w, http.StatusBadRequest, "mtime must be epoch millis")
+			return
+		}
+		mtime = time.UnixMilli(ms)
+	}
+
+	if rel, ok, err := backups.lookup(sum); err != nil {
+		slog.Error("Failed to read backup index", "dir", backups.dir, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "backup index unavailable")
+		return
+	} else if ok {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "exists", "stored_as": rel, "sha256": sum})
+		return
+	}
+
+	if r.ContentLength < 0 {
+		errorJSON(w, http.StatusLengthRequired, "Content-Length required")
+		return
+	}
+	client := uploadQuotaKey(r)
+	qerr := checkUploadFileSize(r.ContentLength)
+	if qerr == nil {
+		qerr = checkUploadQuota(backups.dir, client, r.ContentLength)
+	}
+	if qerr != nil {
+		slog.Warn("Backup rejected by quota", "client", client, "name", name, "code", qerr.Code)
+		writeQuotaError(w, qerr)
+		return
+	}
+
+	if err := ensureDir(backups.stagingDir()); err != nil {
+		slog.Error("Failed to create backup staging directory", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to write file")
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxRawUploadBytes)
+	stored, err := storeFile(backups.stagingDir(), sum, body, conflictRename, sum)
+
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		errorJSON(w, http.StatusRequestEntityTooLarge, "file exceeds maximum upload size")
+		return
+	case errors.Is(err, errChecksumMismatch):
+		slog.Warn("Backup checksum mismatch", "name", name, "want", sum, "got", stored.SHA256)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+			"status":  "error",
+			"message": err.Error(),
+			"sha256":  stored.SHA256,
+		})
+		return
+	case err != nil:
+		slog.Error("Failed to write backup file", "name", name, "err", err)
+		errorJSON(w, http.StatusBadRequest, "upload incomplete or failed to write file")
+		return
+	}
+	dailyUploads.record(client, stored.Size)
+
+	rel, duplicate, err := backups.add(stored.Path, sum, name, backupFolderTime(stored.Path, mtime))
+	if err != nil {
+		slog.Error("Failed to file backup", "name", name, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to store file")
+		return
+	}
+	if duplicate {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "exists", "stored_as": rel, "sha256": sum})
+		return
+	}
+
+	slog.Info("Backed up file from phone", "name", name, "stored_as", rel, "bytes", stored.Size)
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"status":    "success",
+		"stored_as": rel,
+		"size":      stored.Size,
+		"sha256":    sum,
+	})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupIndexFile maps content hashes to files below backupDir. It lives in
+// backupDir itself so the index travels with the photos.
+const backupIndexFile = ".backup_index.json"
+
+// backupIndex is the content-addressed view of backupDir: every stored file
+// is recorded under its SHA-256, so a photo that is already backed up is
+// never transferred or stored twice, whatever its name on the phone.
+type backupIndex struct {
+	mu      sync.Mutex
+	dir     string
+	loaded  bool
+	dirty   bool              // objects changed since the last save
+	objects map[string]string // sha256 -> path relative to dir
+}
+
+func newBackupIndex(dir string) *backupIndex {
+	return &backupIndex{dir: dir}
+}
+
+var backups = newBackupIndex(backupDir)
+
+// load reads the index on first use. A missing index is rebuilt by hashing
+// whatever is already in the directory. Callers hold b.mu.
+func (b *backupIndex) load() error {
+	if b.loaded {
+		return nil
+	}
+	if err := ensureDir(b.dir); err != nil {
+		return err
+	}
+	b.objects = map[string]string{}
+
+	data, err := os.ReadFile(filepath.Join(b.dir, backupIndexFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &b.objects); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		if err := b.rebuild(); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	b.loaded = true
+	return nil
+}
+
+// rebuild hashes every file below the backup directory. Callers hold b.mu.
+func (b *backupIndex) rebuild() error {
+	err := filepath.WalkDir(b.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != b.dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(path, info)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(b.dir, path)
+		b.objects[sum] = filepath.ToSlash(rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(b.objects) > 0 {
+		slog.Info("Rebuilt backup index", "dir", b.dir, "files", len(b.objects))
+	}
+	return b.save()
+}
+
+// save writes the index atomically. Callers hold b.mu.
+func (b *backupIndex) save() error {
+	data, err := json.Marshal(b.objects)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(b.dir, backupIndexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(b.dir, backupIndexFile)); err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+// flush saves the index if lookups forgot stale entries. A failed save is
+// only logged: the entries are forgotten again on the next lookup. Callers
+// hold b.mu.
+func (b *backupIndex) flush() {
+	if !b.dirty {
+		return
+	}
+	if err := b.save(); err != nil {
+		slog.Warn("Failed to save backup index", "dir", b.dir, "err", err)
+	}
+}
+
+// lookup returns where the content with hash sum is stored. Entries whose
+// file has since been deleted are forgotten so the phone uploads them again.
+func (b *backupIndex) lookup(sum string) (string, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return "", false, err
+	}
+	rel := b.lookupLocked(sum)
+	b.flush()
+	return rel, rel != "", nil
+}
+
+// lookupLocked forgets sum if its file is gone, leaving the index dirty for
+// the caller to flush once per batch. Callers hold b.mu.
+func (b *backupIndex) lookupLocked(sum string) string {
+	rel, ok := b.objects[sum]
+	if !ok {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(b.dir, filepath.FromSlash(rel))); err != nil {
+		delete(b.objects, sum)
+		b.dirty = true
+		return ""
+	}
+	return rel
+}
+
+// missing returns the subset of sums that are not stored yet, preserving
+// order.
+func (b *backupIndex) missing(sums []string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, sum := range sums {
+		if b.lookupLocked(sum) == "" {
+			out = append(out, sum)
+		}
+	}
+	b.flush()
+	return out, nil
+}
+
+// stagingDir is where uploads are written before being filed; it must be
+// inside dir so filing them is a rename.
+func (b *backupIndex) stagingDir() string {
+	return filepath.Join(b.dir, ".incoming")
+}
+
+// add files the verified upload at staged (inside b.dir) under its date
+// folder and records it. If the same content was stored concurrently, the
+// duplicate is discarded and the existing path returned.
+func (b *backupIndex) add(staged, sum, name string, taken time.Time) (rel string, duplicate bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return "", false, err
+	}
+	if existing := b.lookupLocked(sum); existing != "" {
+		b.flush()
+		return existing, true, os.Remove(staged)
+	}
+
+	dir := filepath.Join(b.dir, taken.Format("2006"), taken.Format("01"))
+	if err := ensureDir(dir); err != nil {
+		return "", false, err
+	}
+	dest, err := safePath(dir, name)
+	if err != nil {
+		return "", false, err
+	}
+	tmp := filepath.Join(dir, ".partial-"+sum)
+	if err := os.Rename(staged, tmp); err != nil {
+		return "", false, err
+	}
+	path, _, err := placeFile(tmp, dest, conflictRename)
+	if err != nil {
+		os.Remove(tmp)
+		return "", false, err
+	}
+
+	rel, _ = filepath.Rel(b.dir, path)
+	rel = filepath.ToSlash(rel)
+	b.objects[sum] = rel
+	return rel, false, b.save()
+}
+
+// backupFolderTime picks the date a backed-up file is filed under: the EXIF
+// capture date if the file has one, else the phone's mtime, else now.
+func backupFolderTime(path string, mtime time.Time) time.Time {
+	if taken, ok := exifDate(path); ok {
+		return taken
+	}
+	if !mtime.IsZero() {
+		return mtime
+	}
+	return time.Now()
+}
+
+// exifDate reads DateTimeOriginal (falling back to DateTime) from a JPEG's
+// EXIF block. Only the first 256KB are read; EXIF sits at the start.
+func exifDate(path string) (time.Time, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+	head := make([]byte, 256<<10)
+	n, _ := io.ReadFull(f, head)
+	tiff := jpegExifBlock(head[:n])
+	if tiff == nil {
+		return time.Time{}, false
+	}
+	return parseExifDate(tiff)
+}
+
+// jpegExifBlock returns the TIFF structure inside a JPEG's APP1 Exif
+// segment, or nil.
+func jpegExifBlock(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan / end of image
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + size
+		if size < 2 || end > len(data) {
+			return nil
+		}
+		if segment := data[i+4 : end]; marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+const (
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+)
+
+var errBadExif = errors.New("malformed exif")
+
+func parseExifDate(tiff []byte) (time.Time, bool) {
+	if len(tiff) < 8 {
+		return time.Time{}, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}, false
+	}
+
+	ifd0, err := readExifIFD(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return time.Time{}, false
+	}
+	if off, ok := ifd0[exifTagExifIFD]; ok {
+		if sub, err := readExifIFD(tiff, order, order.Uint32(off)); err == nil {
+			if t, ok := exifTime(tiff, order, sub[exifTagDateTimeOriginal]); ok {
+				return t, true
+			}
+		}
+	}
+	return exifTime(tiff, order, ifd0[exifTagDateTime])
+}
+
+// readExifIFD returns the raw 12-byte entries of the IFD at offset, keyed
+// by tag, with the tag/type/count prefix stripped to the 4-byte value field.
+func readExifIFD(tiff []byte, order binary.ByteOrder, offset uint32) (map[uint16][]byte, error) {
+	if int(offset)+2 > len(tiff) {
+		return nil, errBadExif
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	entries := make(map[uint16][]byte, count)
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			return nil, errBadExif
+		}
+		entries[order.Uint16(tiff[start:])] = tiff[start+8 : start+12]
+	}
+	return entries, nil
+}
+
+// exifTime decodes an ASCII "2006:01:02 15:04:05" value whose offset is
+// stored in value.
+func exifTime(tiff []byte, order binary.ByteOrder, value []byte) (time.Time, bool) {
+	if len(value) != 4 {
+		return time.Time{}, false
+	}
+	off := int(order.Uint32(value))
+	if off+19 > len(tiff) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", string(tiff[off:off+19]), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
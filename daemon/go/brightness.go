@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// brightnessState is a backlight's current and maximum raw level.
+type brightnessState struct {
+	Device        string `json:"device"`
+	Brightness    int    `json:"brightness"`
+	MaxBrightness int    `json:"max_brightness"`
+	Percent       int    `json:"percent"`
+}
+
+var errNoBacklight = errors.New("no backlight device found")
+
+// backlightTypeRank orders devices the way desktops pick one: firmware
+// (ACPI) interfaces first, raw GPU registers last.
+var backlightTypeRank = map[string]int{"firmware": 0, "platform": 1, "raw": 2}
+
+// findBacklight returns the preferred device directory under backlightDir.
+func findBacklight() (string, error) {
+	entries, err := os.ReadDir(backlightDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var devices []string
+	for _, e := range entries {
+		devices = append(devices, filepath.Join(backlightDir, e.Name()))
+	}
+	if len(devices) == 0 {
+		return "", errNoBacklight
+	}
+	rank := func(dir string) int {
+		kind, _ := os.ReadFile(filepath.Join(dir, "type"))
+		if r, ok := backlightTypeRank[strings.TrimSpace(string(kind))]; ok {
+			return r
+		}
+		return len(backlightTypeRank)
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		if ri, rj := rank(devices[i]), rank(devices[j]); ri != rj {
+			return ri < rj
+		}
+		return devices[i] < devices[j]
+	})
+	return devices[0], nil
+}
+
+func readSysfsInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// readBrightness reports the preferred backlight's level.
+func readBrightness() (brightnessState, error) {
+	dir, err := findBacklight()
+	if err != nil {
+		return brightnessState{}, err
+	}
+	maxLevel, err := readSysfsInt(filepath.Join(dir, "max_brightness"))
+	if err != nil {
+		return brightnessState{}, err
+	}
+	if maxLevel <= 0 {
+		return brightnessState{}, fmt.Errorf("%s reports max_brightness %d", filepath.Base(dir), maxLevel)
+	}
+	cur, err := readSysfsInt(filepath.Join(dir, "brightness"))
+	if err != nil {
+		return brightnessState{}, err
+	}
+	return brightnessState{
+		Device:        filepath.Base(dir),
+		Brightness:    cur,
+		MaxBrightness: maxLevel,
+		Percent:       (cur*100 + maxLevel/2) / maxLevel,
+	}, nil
+}
+
+// setBrightness sets the preferred backlight to percent of its maximum,
+// clamped to [minBrightnessPercent, 100] so the screen never goes fully
+// dark. Writing needs the video group or a udev rule; a permission error is
+// returned as is so callers can report it.
+func setBrightness(percent int) (brightnessState, error) {
+	state, err := readBrightness()
+	if err != nil {
+		return brightnessState{}, err
+	}
+	percent = max(minBrightnessPercent, min(100, percent))
+	level := max(1, (percent*state.MaxBrightness+50)/100)
+	path := filepath.Join(backlightDir, state.Device, "brightness")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(level)), 0o644); err != nil {
+		return brightnessState{}, err
+	}
+	return readBrightness()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// writeBrightnessError maps a backlight error to a response.
+func writeBrightnessError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoBacklight):
+		errorJSON(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, os.ErrPermission):
+		errorJSON(w, http.StatusForbidden,
+			"no permission to change brightness (add the daemon's user to the video group)")
+	default:
+		slog.Error("Backlight access failed", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to access backlight")
+	}
+}
+
+// handleGetBrightness serves GET /display/brightness.
+func handleGetBrightness(w http.ResponseWriter, r *http.Request) {
+	state, err := readBrightness()
+	if err != nil {
+		writeBrightnessError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// handleSetBrightness serves POST /display/brightness with {"percent"},
+// clamped to [minBrightnessPercent, 100].
+func handleSetBrightness(w http.ResponseWriter, r *http.Request) {
+	var payload brightnessPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	if payload.Percent == nil {
+		errorJSON(w, http.StatusBadRequest, "Missing percent")
+		return
+	}
+	state, err := setBrightness(*payload.Percent)
+	if err != nil {
+		writeBrightnessError(w, err)
+		return
+	}
+	slog.Info("Brightness changed from phone", "device", state.Device, "percent", state.Percent)
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checksumHeader carries the client's expected SHA-256 (hex) for /upload.
+// The multipart form field "sha256" is accepted as an alternative.
+const checksumHeader = "X-Content-SHA256"
+
+// expectedSHA256 returns the normalised expected digest from the request, or
+// "" if the client did not send one.
+func expectedSHA256(r *http.Request) (string, error) {
+	want := r.Header.Get(checksumHeader)
+	if want == "" {
+		want = r.FormValue("sha256")
+	}
+	return parseSHA256(want)
+}
+
+// parseSHA256 validates and lower-cases a hex digest; "" passes through.
+func parseSHA256(want string) (string, error) {
+	want = strings.ToLower(strings.TrimSpace(want))
+	if want == "" {
+		return "", nil
+	}
+	if len(want) != sha256.Size*2 {
+		return "", fmt.Errorf("sha256 must be %d hex characters", sha256.Size*2)
+	}
+	if _, err := hex.DecodeString(want); err != nil {
+		return "", fmt.Errorf("sha256 must be hex encoded")
+	}
+	return want, nil
+}
+
+// hashCacheEntry remembers a file's digest alongside the size and mtime it
+// was computed for, so unchanged files are not re-read.
+type hashCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// hashLRU holds the digests of recently hashed files, dropping the least
+// recently used once it holds limit entries. Paths of deleted or renamed
+// files simply age out.
+type hashLRU struct {
+	mu      sync.Mutex
+	limit   int
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+func newHashLRU(limit int) *hashLRU {
+	return &hashLRU{limit: limit, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+var hashCache = newHashLRU(maxHashCacheEntries)
+
+func (c *hashLRU) get(path string) (hashCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[path]
+	if !ok {
+		return hashCacheEntry{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(hashCacheEntry), true
+}
+
+func (c *hashLRU) put(e hashCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.path]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[e.path] = c.order.PushFront(e)
+	for c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(hashCacheEntry).path)
+	}
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path, cached by path,
+// size and modification time.
+func fileSHA256(path string, info os.FileInfo) (string, error) {
+	if cached, ok := hashCache.get(path); ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	hashCache.put(hashCacheEntry{path: path, size: info.Size(), modTime: info.ModTime(), sum: sum})
+	return sum, nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clipboardProvider reads and writes the laptop's clipboard. Types lists
+// the targets currently offered, in the provider's own naming (X11 offers
+// UTF8_STRING alongside MIME types).
+type clipboardProvider interface {
+	Name() string
+	Types(ctx context.Context) ([]string, error)
+	Read(ctx context.Context, target string) ([]byte, error)
+	Write(ctx context.Context, mime string, data []byte) error
+}
+
+var errClipboardTooLarge = errors.New("clipboard content exceeds the size limit")
+
+// runClipboardCmd runs a clipboard tool and returns at most maxClipboardBytes
+// of its output. It is a variable so tests can fake the tools.
+var runClipboardCmd = func(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != nil {
+		// wl-copy and xclip -i fork to keep serving the selection; leaving
+		// stdout unset stops the child holding our pipe open.
+		cmd.Stdin = bytes.NewReader(stdin)
+		return nil, cmd.Run()
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	data, readErr := io.ReadAll(io.LimitReader(stdout, maxClipboardBytes+1))
+	if int64(len(data)) > maxClipboardBytes {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, errClipboardTooLarge
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return data, readErr
+}
+
+// wlClipboard uses wl-clipboard on Wayland sessions.
+type wlClipboard struct{}
+
+func (wlClipboard) Name() string { return "wl-clipboard" }
+
+func (wlClipboard) Types(ctx context.Context) ([]string, error) {
+	out, err := runClipboardCmd(ctx, nil, "wl-paste", "--list-types")
+	if err != nil {
+		// wl-paste exits non-zero when the clipboard is empty.
+		return nil, nil
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (wlClipboard) Read(ctx context.Context, target string) ([]byte, error) {
+	return runClipboardCmd(ctx, nil, "wl-paste", "--no-newline", "--type", target)
+}
+
+func (wlClipboard) Write(ctx context.Context, mime string, data []byte) error {
+	_, err := runClipboardCmd(ctx, data, "wl-copy", "--type", mime)
+	return err
+}
+
+// xclipClipboard uses xclip on X11 sessions.
+type xclipClipboard struct{}
+
+func (xclipClipboard) Name() string { return "xclip" }
+
+func (xclipClipboard) Types(ctx context.Context) ([]string, error) {
+	out, err := runClipboardCmd(ctx, nil, "xclip", "-selection", "clipboard", "-o", "-t", "TARGETS")
+	if err != nil {
+		return nil, nil // no owner
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (xclipClipboard) Read(ctx context.Context, target string) ([]byte, error) {
+	return runClipboardCmd(ctx, nil, "xclip", "-selection", "clipboard", "-o", "-t", target)
+}
+
+func (xclipClipboard) Write(ctx context.Context, mime string, data []byte) error {
+	_, err := runClipboardCmd(ctx, data, "xclip", "-selection", "clipboard", "-i", "-t", mime)
+	return err
+}
+
+// memoryClipboard is a process-local clipboard for headless machines and
+// tests.
+type memoryClipboard struct {
+	mu   sync.Mutex
+	mime string
+	data []byte
+}
+
+func (*memoryClipboard) Name() string { return "memory" }
+
+func (c *memoryClipboard) Types(context.Context) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mime == "" {
+		return nil, nil
+	}
+	return []string{c.mime}, nil
+}
+
+func (c *memoryClipboard) Read(_ context.Context, target string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if target != c.mime {
+		return nil, fmt.Errorf("clipboard does not offer %s", target)
+	}
+	return bytes.Clone(c.data), nil
+}
+
+func (c *memoryClipboard) Write(_ context.Context, mime string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mime, c.data = mime, bytes.Clone(data)
+	return nil
+}
+
+// newClipboardProvider picks a provider by name, or for "" the one matching
+// the session: wl-clipboard on Wayland, xclip on X11. It returns nil when
+// none is usable.
+func newClipboardProvider(name string) clipboardProvider {
+	has := func(tool string) bool {
+		_, err := exec.LookPath(tool)
+		return err == nil
+	}
+	switch name {
+	case "wl-clipboard":
+		return wlClipboard{}
+	case "xclip":
+		return xclipClipboard{}
+	case "memory":
+		return &memoryClipboard{}
+	case "":
+		if os.Getenv("WAYLAND_DISPLAY") != "" && has("wl-paste") && has("wl-copy") {
+			return wlClipboard{}
+		}
+		if os.Getenv("DISPLAY") != "" && has("xclip") {
+			return xclipClipboard{}
+		}
+	}
+	return nil
+}
+
+// clipboardTextTargets are the targets read as text, most specific first.
+var clipboardTextTargets = []string{"text/plain;charset=utf-8", "UTF8_STRING", "text/plain", "STRING", "TEXT"}
+
+// clipboardImageTypes are the image formats synced, in order of preference.
+var clipboardImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// pickClipboardTarget chooses what to read from the offered targets and
+// the MIME type it is reported as. Images win over text because image
+// copies usually offer a text fallback (a file name) as well.
+func pickClipboardTarget(targets []string) (target, mime string, ok bool) {
+	offered := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		offered[t] = true
+	}
+	for _, t := range clipboardImageTypes {
+		if offered[t] {
+			return t, t, true
+		}
+	}
+	for _, t := range clipboardTextTargets {
+		if offered[t] {
+			return t, "text/plain", true
+		}
+	}
+	return "", "", false
+}
+
+// clipboardContent is what the clipboard holds. Text is set for text
+// content; images are only described, and fetched with GET /clipboard.
+type clipboardContent struct {
+	ID     uint64    `json:"id,omitempty"`
+	MIME   string    `json:"mime"`
+	Text   string    `json:"text,omitempty"`
+	Size   int       `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Source string    `json:"source"` // laptop or phone
+	Time   time.Time `json:"time"`
+
+	data []byte
+}
+
+func newClipboardContent(mime string, data []byte, source string) clipboardContent {
+	sum := sha256.Sum256(data)
+	c := clipboardContent{MIME: mime, Size: len(data), SHA256: hex.EncodeToString(sum[:]),
+		Source: source, Time: time.Now(), data: data}
+	if mime == "text/plain" {
+		c.Text = string(data)
+	}
+	return c
+}
+
+// readClipboard returns the clipboard's current content, or ok=false if it
+// is empty or holds nothing syncable.
+func readClipboard(ctx context.Context, p clipboardProvider) (content clipboardContent, ok bool, err error) {
+	targets, err := p.Types(ctx)
+	if err != nil {
+		return clipboardContent{}, false, err
+	}
+	target, mime, ok := pickClipboardTarget(targets)
+	if !ok {
+		return clipboardContent{}, false, nil
+	}
+	data, err := p.Read(ctx, target)
+	if err != nil {
+		return clipboardContent{}, false, err
+	}
+	if mime != "text/plain" && http.DetectContentType(data) != mime {
+		return clipboardContent{}, false, fmt.Errorf("clipboard %s data is not a valid image", mime)
+	}
+	return newClipboardContent(mime, data, "laptop"), true, nil
+}
+
+// clipboardSync holds the opt-in toggle and the latest clipboard change.
+// Streams wait on changed, which is closed and replaced on every change.
+type clipboardSync struct {
+	mu       sync.Mutex
+	enabled  bool
+	provider clipboardProvider
+	nextID   uint64
+	latest   clipboardContent // zero until the first change
+	changed  chan struct{}
+}
+
+func newClipboardSync() *clipboardSync {
+	return &clipboardSync{
+		nextID:  uint64(time.Now().UnixMilli()),
+		changed: make(chan struct{}),
+	}
+}
+
+var clipboard = newClipboardSync()
+
+func (s *clipboardSync) state() (enabled bool, provider clipboardProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enabled, s.provider
+}
+
+// setEnabled turns sync on or off, waking streams so they close when it is
+// turned off.
+func (s *clipboardSync) setEnabled(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enabled = enabled
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *clipboardSync) setProvider(p clipboardProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.provider = p
+}
+
+// observe records c as the clipboard's content and, if it differs from the
+// last recorded content, wakes streams. It reports whether c was new.
+func (s *clipboardSync) observe(c clipboardContent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.SHA256 == s.latest.SHA256 && c.MIME == s.latest.MIME {
+		return false
+	}
+	s.nextID++
+	c.ID = s.nextID
+	s.latest = c
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return true
+}
+
+// current returns the latest change and a channel closed on the next one.
+func (s *clipboardSync) current() (clipboardContent, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latest, s.changed
+}
+
+// readClipboardSyncState restores the toggle persisted by a previous run.
+// Clipboard sync is off until the user turns it on.
+func readClipboardSyncState() error {
+	data, err := os.ReadFile(clipboardSyncFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	clipboard.setEnabled(string(data) == "enabled")
+	return nil
+}
+
+func writeClipboardSyncState(enabled bool) error {
+	content := "disabled"
+	if enabled {
+		content = "enabled"
+	}
+	return os.WriteFile(clipboardSyncFile, []byte(content), 0o644)
+}
+
+// runClipboardWatcher polls the laptop clipboard while sync is enabled and
+// publishes changes until ctx is cancelled. The tools offer no portable
+// change notification, so polling it is.
+func runClipboardWatcher(ctx context.Context) {
+	ticker := time.NewTicker(clipboardPollInterval)
+	defer ticker.Stop()
+	var lastErr string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		enabled, provider := clipboard.state()
+		if !enabled || provider == nil {
+			continue
+		}
+		readCtx, cancel := context.WithTimeout(ctx, clipboardReadTimeout)
+		content, ok, err := readClipboard(readCtx, provider)
+		cancel()
+		if err != nil {
+			// Log each distinct failure once rather than every poll.
+			if err.Error() != lastErr {
+				slog.Warn("Failed to read laptop clipboard", "provider", provider.Name(), "err", err)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		lastErr = ""
+		if ok && clipboard.observe(content) {
+			slog.Debug("Laptop clipboard changed", "mime", content.MIME, "bytes", content.Size)
+		}
+	}
+}
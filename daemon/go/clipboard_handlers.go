@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// clipboardProviderFor returns the provider if clipboard sync is enabled,
+// writing the error response itself otherwise.
+func clipboardProviderFor(w http.ResponseWriter) (clipboardProvider, bool) {
+	enabled, provider := clipboard.state()
+	switch {
+	case !enabled:
+		errorJSON(w, http.StatusForbidden, "clipboard sync is disabled")
+		return nil, false
+	case provider == nil:
+		errorJSON(w, http.StatusServiceUnavailable, "no clipboard tool available (install wl-clipboard or xclip)")
+		return nil, false
+	}
+	return provider, true
+}
+
+// handleGetClipboard serves GET /clipboard: the laptop clipboard as JSON,
+// with images base64-encoded in data. An empty clipboard is 204.
+func handleGetClipboard(w http.ResponseWriter, r *http.Request) {
+	provider, ok := clipboardProviderFor(w)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), clipboardReadTimeout)
+	defer cancel()
+	content, ok, err := readClipboard(ctx, provider)
+	switch {
+	case errors.Is(err, errClipboardTooLarge):
+		errorJSON(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	case err != nil:
+		slog.Error("Failed to read clipboard", "provider", provider.Name(), "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to read clipboard")
+		return
+	case !ok:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	clipboard.observe(content)
+	latest, _ := clipboard.current()
+	content.ID = latest.ID
+
+	resp := struct {
+		clipboardContent
+		Data string `json:"data,omitempty"`
+	}{clipboardContent: content}
+	if content.Text == "" {
+		resp.Data = base64.StdEncoding.EncodeToString(content.data)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleSetClipboard serves POST /clipboard with {"text"} or, for images,
+// {"mime", "data"} (base64).
+func handleSetClipboard(w http.ResponseWriter, r *http.Request) {
+	provider, ok := clipboardProviderFor(w)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxClipboardBodyBytes)
+	var payload clipboardPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			errorJSON(w, http.StatusRequestEntityTooLarge, errClipboardTooLarge.Error())
+			return
+		}
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+
+	var mime string
+	var data []byte
+	switch {
+	case payload.Data != "":
+		if !slices.Contains(clipboardImageTypes, payload.MIME) {
+			errorJSON(w, http.StatusBadRequest, "mime must be image/png, image/jpeg, image/gif or image/webp")
+			return
+		}
+		var err error
+		data, err = decodeAttachment("data", payload.Data, maxClipboardBytes)
+		if errors.Is(err, errAttachmentTooLarge) {
+			errorJSON(w, http.StatusRequestEntityTooLarge, errClipboardTooLarge.Error())
+			return
+		}
+		if err != nil {
+			errorJSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Store the sniffed type, never the declared one, so a mislabelled
+		// payload can't reach the clipboard as something else.
+		mime = http.DetectContentType(data)
+		if !slices.Contains(clipboardImageTypes, mime) {
+			errorJSON(w, http.StatusBadRequest, "data is not a PNG, JPEG, GIF or WebP image")
+			return
+		}
+	case payload.Text != "":
+		if len(payload.Text) > maxClipboardBytes {
+			errorJSON(w, http.StatusRequestEntityTooLarge, errClipboardTooLarge.Error())
+			return
+		}
+		if !utf8.ValidString(payload.Text) {
+			errorJSON(w, http.StatusBadRequest, "text must be UTF-8")
+			return
+		}
+		mime, data = "text/plain", []byte(payload.Text)
+	default:
+		errorJSON(w, http.StatusBadRequest, "Missing text or data")
+		return
+	}
+
+	target := mime
+	if mime == "text/plain" {
+		target = "text/plain;charset=utf-8"
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), clipboardReadTimeout)
+	defer cancel()
+	if err := provider.Write(ctx, target, data); err != nil {
+		slog.Error("Failed to set clipboard", "provider", provider.Name(), "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to set clipboard")
+		return
+	}
+	// Recorded so the watcher doesn't report our own write as a laptop copy.
+	content := newClipboardContent(mime, data, "phone")
+	clipboard.observe(content)
+
+	slog.Info("Clipboard set from phone", "mime", mime, "bytes", len(data))
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": "success",
+		"mime":   mime,
+		"size":   len(data),
+		"sha256": content.SHA256,
+	})
+}
+
+// handleClipboardStream serves GET /clipboard/stream as Server-Sent Events:
+// a "clipboard" event for every change, starting with the current content
+// if the client hasn't seen it. Image events carry no data; fetch it with
+// GET /clipboard.
+func handleClipboardStream(w http.ResponseWriter, r *http.Request) {
+	if _, ok := clipboardProviderFor(w); !ok {
+		return
+	}
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+
+	after := lastEventID(r)
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	slog.Info("Clipboard stream opened", "client", r.RemoteAddr, "after", after)
+	for {
+		latest, changed := clipboard.current()
+		if latest.ID > after {
+			if err := writeSSE(w, strconv.FormatUint(latest.ID, 10), "clipboard", latest); err != nil {
+				return
+			}
+			after = latest.ID
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			slog.Info("Clipboard stream closed", "client", r.RemoteAddr)
+			return
+		case <-changed:
+			if enabled, _ := clipboard.state(); !enabled {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleClipboardSettings serves GET and POST /clipboard/settings. Sync is
+// opt-in: nothing is read from or written to the clipboard until it is
+// enabled.
+func handleClipboardSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var payload clipboardSettingsPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+			return
+		}
+		clipboard.setEnabled(payload.Enabled)
+		if err := writeClipboardSyncState(payload.Enabled); err != nil {
+			slog.Error("Failed to persist clipboard sync state", "err", err)
+		}
+		slog.Info("Clipboard sync set", "enabled", payload.Enabled)
+	}
+
+	enabled, provider := clipboard.state()
+	name := ""
+	if provider != nil {
+		name = provider.Name()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"enabled":   enabled,
+		"provider":  name,
+		"max_bytes": maxClipboardBytes,
+	})
+}
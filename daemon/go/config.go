@@ -3,14 +3,209 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"time"
 )
 
 const (
 	port = "8081"
+
+	// Limits for POST /phone-notification. Attachments are checked after
+	// base64 decoding; the body limit covers the whole request.
+	maxNotificationBodyBytes  = 8 << 20
+	maxNotificationIconBytes  = 256 << 10
+	maxNotificationImageBytes = 2 << 20
+	notificationMediaTTL      = time.Hour
+
+	// maxNotificationHistory bounds the in-memory phone notification history.
+	maxNotificationHistory = 500
+
+	// Replies typed on the laptop expire if the phone doesn't collect them.
+	phoneReplyTTL     = 10 * time.Minute
+	maxPendingReplies = 100
+	maxReplyLength    = 2000
+
+	// maxLaptopNotificationQueue bounds how many unacknowledged laptop
+	// notifications are kept for the phone.
+	maxLaptopNotificationQueue = 200
+
+	// sseKeepaliveInterval is how often idle event streams send a comment
+	// line so proxies and the phone's HTTP client don't time them out.
+	sseKeepaliveInterval = 25 * time.Second
+
+	// Resumable (tus) uploads: the largest accepted Upload-Length, and how
+	// long an untouched staged upload survives before garbage collection.
+	maxResumableUploadBytes = 16 << 30
+	uploadStagingTTL        = 24 * time.Hour
+	uploadStagingGCInterval = time.Hour
+
+	// maxRenameAttempts bounds the " (n)" suffixes tried by the rename
+	// conflict policy.
+	maxRenameAttempts = 1000
+
+	// maxRelPathDepth bounds the subdirectories in an upload's relative path.
+	maxRelPathDepth = 16
+
+	// maxHashCacheEntries bounds how many file digests are remembered.
+	maxHashCacheEntries = 4096
+
+	// maxListFilesPage is the largest page GET /list-files returns.
+	maxListFilesPage = 500
+
+	// maxArchiveEntries bounds the files in one POST /download/archive.
+	maxArchiveEntries = 10000
+
+	// Thumbnails: requested sizes are clamped to [min, max]; images over
+	// maxThumbnailSourcePixels are not decoded, and at most
+	// maxThumbnailRenders are decoded at once.
+	maxThumbnailRenders      = 2
+	defaultThumbnailSize     = 256
+	minThumbnailSize         = 32
+	maxThumbnailSize         = 1024
+	maxThumbnailSourcePixels = 50_000_000
+	maxThumbnailCacheBytes   = 64 << 20
+
+	// Text previews show at most this much of a file.
+	maxTextPreviewBytes = 4096
+	maxTextPreviewLines = 40
+
+	// maxShareEvents is how many share directory changes are kept for
+	// GET /files/events clients resuming with Last-Event-ID.
+	maxShareEvents = 500
+
+	// shareWatchSettleDelay is how long the share watcher waits for a new
+	// file to be written to before reporting it as created anyway, for
+	// files that never produce IN_CLOSE_WRITE; see shareWatcher.settle.
+	shareWatchSettleDelay = 500 * time.Millisecond
+
+	// Share links: lifetime when the client doesn't choose one, the longest
+	// it may choose, how many links may be active at once, and how long
+	// the first client may resume a single-use download with Range requests.
+	defaultShareLinkTTL   = 24 * time.Hour
+	maxShareLinkTTL       = 7 * 24 * time.Hour
+	maxShareLinks         = 200
+	shareLinkResumeWindow = 15 * time.Minute
+
+	// maxBackupManifestEntries bounds one POST /backup/manifest request;
+	// larger camera rolls are sent in several batches.
+	maxBackupManifestEntries = 10000
+	maxBackupManifestBytes   = 4 << 20
+
+	// Post-upload hooks run on a small worker pool; each execution is
+	// bounded by hookTimeout and the latest maxHookResults are kept.
+	hookWorkers    = 2
+	hookQueueSize  = 64
+	hookTimeout    = 2 * time.Minute
+	maxHookResults = 200
+
+	// Clipboard sync: the largest text or image synced either way, and how
+	// long one read of the laptop clipboard may take.
+	maxClipboardBytes     = 8 << 20
+	maxClipboardBodyBytes = maxClipboardBytes*4/3 + 4096 // base64 images
+	clipboardReadTimeout  = 3 * time.Second
+
+	// Text sent from the phone: the largest snippet accepted, the largest
+	// that may be typed into the focused window, and how many received
+	// snippets and URLs GET /text/history keeps.
+	maxTextSnippetBytes = 64 << 10
+	maxTypedTextBytes   = 4 << 10
+	maxOpenURLLength    = 8192
+	maxTextHistory      = 200
+	textActionTimeout   = 30 * time.Second
+
+	// Media control: how long one playerctl call may take, and how many
+	// track and status changes GET /media/stream can replay.
+	mediaCommandTimeout = 5 * time.Second
+	maxMediaEvents      = 100
+
+	// Volume and brightness: POST values are clamped to these ranges, and
+	// reading both for /stats may take at most statsProbeTimeout.
+	maxAudioVolume       = 100
+	minBrightnessPercent = 1
+	statsProbeTimeout    = time.Second
+
+	// Session state: how long the loginctl calls behind GET /session and
+	// the lock endpoints may take. /stats reuses the audio and session
+	// state it read for statsProbeCacheTTL.
+	sessionCommandTimeout = 5 * time.Second
+	statsProbeCacheTTL    = 5 * time.Second
 )
 
 var (
 	uploadDir      = filepath.Join(os.Getenv("HOME"), "Downloads", "phone_transfers")
 	shareDir       = filepath.Join(os.Getenv("HOME"), "Downloads", "phone_share")
 	lidInhibitFile = "lid_inhibit.state"
+
+	// clipboardSyncFile persists the clipboard sync opt-in, and
+	// clipboardProviderName forces a provider ("wl-clipboard", "xclip" or
+	// "memory"); empty picks one for the session.
+	clipboardSyncFile     = "clipboard_sync.state"
+	clipboardProviderName = ""
+
+	// clipboardPollInterval is how often the laptop clipboard is checked
+	// for changes while sync is enabled.
+	clipboardPollInterval = time.Second
+
+	// backupDir receives camera-roll backups, filed into YYYY/MM folders.
+	backupDir = filepath.Join(os.Getenv("HOME"), "Pictures", "phone_backup")
+
+	// trashDir is the freedesktop.org trash that deletions go to unless
+	// the client asks for a permanent delete.
+	trashDir      = xdgTrashDir()
+	deleteToTrash = true
+
+	// backlightDir holds the kernel's backlight devices.
+	backlightDir = "/sys/class/backlight"
+
+	// allowSessionUnlock lets POST /session/unlock unlock the desktop. Off by
+	// default: anyone holding the phone could then use the laptop.
+	allowSessionUnlock = false
+
+	// textNotesFile collects snippets sent from the phone with the "notes"
+	// action.
+	textNotesFile = filepath.Join(os.Getenv("HOME"), "Documents", "phone_notes.md")
+
+	// uploadHooksFile configures post-upload hooks; see uploadHook.
+	uploadHooksFile = "upload_hooks.json"
+
+	// maxHookExtractBytes caps what an extract hook may unpack from one
+	// archive.
+	maxHookExtractBytes int64 = 4 << 30
+
+	// uploadStagingDir holds in-progress resumable uploads. It is kept
+	// outside uploadDir so partial files never show up there.
+	uploadStagingDir = filepath.Join(os.Getenv("HOME"), ".cache", "laptop_dashboard", "uploads")
+
+	// thumbnailCacheDir holds rendered thumbnails for shared files.
+	thumbnailCacheDir = filepath.Join(os.Getenv("HOME"), ".cache", "laptop_dashboard", "thumbnails")
+
+	// notificationMediaDir holds icons and images decoded from phone
+	// notifications so notify-send can reference them by path.
+	notificationMediaDir = filepath.Join(os.TempDir(), "phone_sync_media")
+
+	// maxRawUploadBytes caps PUT /files/upload/{name} bodies.
+	maxRawUploadBytes int64 = 16 << 30
+
+	// Upload guardrails, checked before any bytes reach uploadDir. The
+	// daily volume is per client IP. Zero disables a limit.
+	maxUploadFileBytes           int64 = 8 << 30
+	maxUploadDirBytes            int64 = 0
+	minFreeDiskBytes             int64 = 1 << 30
+	maxDailyUploadBytesPerClient int64 = 20 << 30
+
+	// defaultConflictPolicy applies when an upload doesn't choose one.
+	defaultConflictPolicy = conflictRename
+
+	// relayIgnoredApps are desktop notification app names that are never
+	// relayed to the phone. "Phone Sync" is our own popup for phone
+	// notifications and would otherwise loop back.
+	relayIgnoredApps = []string{"Phone Sync"}
 )
+
+// xdgTrashDir returns $XDG_DATA_HOME/Trash, defaulting to
+// ~/.local/share/Trash.
+func xdgTrashDir() string {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, "Trash")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".local", "share", "Trash")
+}
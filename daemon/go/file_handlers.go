@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// fileRoot maps a client-facing root name to its directory. Empty means
+// shareDir.
+func fileRoot(name string) (string, error) {
+	switch name {
+	case "", "share":
+		return shareDir, nil
+	case "upload":
+		return uploadDir, nil
+	}
+	return "", fmt.Errorf("root must be share or upload")
+}
+
+// resolveManagedFile resolves rel inside root for a mutating operation,
+// writing the error response itself. root itself is never a valid target.
+func resolveManagedFile(w http.ResponseWriter, root, rel string) (string, bool) {
+	path, err := resolveInDir(root, rel)
+	if err == nil && root == shareDir && syncPrivatePath(path) {
+		err = fs.ErrNotExist
+	}
+	switch {
+	case os.IsNotExist(err):
+		errorJSON(w, http.StatusNotFound, "file not found")
+		return "", false
+	case err != nil || path == root:
+		errorJSON(w, http.StatusBadRequest, "invalid filename")
+		return "", false
+	}
+	return path, true
+}
+
+func relTo(root, path string) string {
+	rel, _ := filepath.Rel(root, path)
+	return filepath.ToSlash(rel)
+}
+
+// handleDeleteFile serves DELETE /files/{name}. name is relative to
+// shareDir (or uploadDir with ?root=upload); subfolder paths are sent
+// URL-encoded. Items go to the desktop trash unless ?trash=false, and
+// directories are only deleted permanently with ?recursive=true.
+func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	root, err := fileRoot(q.Get("root"))
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	path, ok := resolveManagedFile(w, root, r.PathValue("name"))
+	if !ok {
+		return
+	}
+	trash := deleteToTrash
+	if raw := q.Get("trash"); raw != "" {
+		if trash, err = strconv.ParseBool(raw); err != nil {
+			errorJSON(w, http.StatusBadRequest, "trash must be true or false")
+			return
+		}
+	}
+	rel := relTo(root, path)
+
+	if trash {
+		name, err := moveToTrash(path)
+		if err != nil {
+			slog.Error("Failed to move file to trash", "path", path, "err", err)
+			errorJSON(w, http.StatusInternalServerError, "could not move to trash")
+			return
+		}
+		slog.Info("Moved file to trash", "path", path, "trash_name", name)
+		writeJSON(w, http.StatusOK, map[string]any{"status": "success", "path": rel, "trashed": true})
+		return
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		errorJSON(w, http.StatusNotFound, "file not found")
+		return
+	}
+	if info.IsDir() && q.Get("recursive") == "true" {
+		err = os.RemoveAll(path)
+	} else {
+		err = os.Remove(path)
+	}
+	if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+		errorJSON(w, http.StatusConflict, "directory not empty; pass recursive=true")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to delete file", "path", path, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "could not delete file")
+		return
+	}
+	slog.Info("Deleted file", "path", path)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "success", "path": rel, "trashed": false})
+}
+
+// handleRenameFile serves POST /files/{name}/rename with {"new_name"} and an
+// optional "conflict" policy (default fail). The item stays in its folder.
+func handleRenameFile(w http.ResponseWriter, r *http.Request) {
+	root, err := fileRoot(r.URL.Query().Get("root"))
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var payload renamePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	policy := conflictFail
+	if payload.Conflict != "" {
+		if policy, err = parseConflictPolicy(payload.Conflict); err != nil {
+			errorJSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	path, ok := resolveManagedFile(w, root, r.PathValue("name"))
+	if !ok {
+		return
+	}
+	if payload.NewName != filepath.Base(payload.NewName) {
+		errorJSON(w, http.StatusBadRequest, "new_name must not contain a path")
+		return
+	}
+	dest, err := safePath(filepath.Dir(path), payload.NewName)
+	if err != nil || (root == shareDir && syncPrivatePath(dest)) {
+		errorJSON(w, http.StatusBadRequest, "invalid new_name")
+		return
+	}
+	if dest == path {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "success", "path": relTo(root, path)})
+		return
+	}
+
+	// placeFile's skip discards its source, so skip is resolved here and
+	// otherwise treated as fail.
+	if policy == conflictSkip {
+		if _, err := os.Lstat(dest); err == nil {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "skipped", "path": relTo(root, path)})
+			return
+		}
+		policy = conflictFail
+	}
+	newPath, _, err := placeFile(path, dest, policy)
+	if errors.Is(err, errFileExists) {
+		errorJSON(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to rename file", "path", path, "new_name", payload.NewName, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "could not rename file")
+		return
+	}
+	slog.Info("Renamed file", "from", path, "to", newPath)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "success", "path": relTo(root, newPath)})
+}
+
+// handleMoveFile serves POST /files/move: a file from one of uploadDir and
+// shareDir into the other (or a subfolder of it), renaming on conflict by
+// default.
+func handleMoveFile(w http.ResponseWriter, r *http.Request) {
+	var payload movePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	fromRoot, err := fileRoot(payload.From)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, "from: "+err.Error())
+		return
+	}
+	toRoot, err := fileRoot(payload.To)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, "to: "+err.Error())
+		return
+	}
+	policy, err := parseConflictPolicy(payload.Conflict)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	src, ok := resolveManagedFile(w, fromRoot, payload.Name)
+	if !ok {
+		return
+	}
+	if info, err := os.Lstat(src); err != nil || !info.Mode().IsRegular() {
+		errorJSON(w, http.StatusBadRequest, "only files can be moved")
+		return
+	}
+	destDir := toRoot
+	if payload.Dest != "" {
+		if destDir, err = safeRelPath(toRoot, payload.Dest); err == nil && toRoot == shareDir && syncPrivatePath(filepath.Join(destDir, filepath.Base(src))) {
+			err = fs.ErrPermission
+		}
+		if err == nil {
+			err = ensureSubdir(toRoot, destDir)
+		}
+		if err != nil {
+			errorJSON(w, http.StatusBadRequest, "invalid dest")
+			return
+		}
+	}
+
+	newPath, skipped, err := moveIntoDir(src, destDir, filepath.Base(src), policy)
+	if errors.Is(err, errFileExists) {
+		errorJSON(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to move file", "from", src, "to", destDir, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "could not move file")
+		return
+	}
+	status := "success"
+	if skipped {
+		status = "skipped"
+	}
+	slog.Info("Moved file", "from", src, "to", newPath, "status", status)
+	writeJSON(w, http.StatusOK, map[string]string{"status": status, "path": relTo(toRoot, newPath)})
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -19,6 +27,66 @@ func errorJSON(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, map[string]string{"status": "error", "message": msg})
 }
 
+// startSSE writes the Server-Sent Events response headers. It replies with
+// 500 and returns ok=false if the ResponseWriter cannot stream.
+func startSSE(w http.ResponseWriter) (flusher http.Flusher, ok bool) {
+	flusher, ok = w.(http.Flusher)
+	if !ok {
+		errorJSON(w, http.StatusInternalServerError, "streaming unsupported")
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher, true
+}
+
+// writeSSE writes a single event with a JSON-encoded data field. id may be
+// empty for events that cannot be resumed.
+func writeSSE(w http.ResponseWriter, id, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// notModified sets ETag and Last-Modified on w and, if the request's
+// validators match, answers 304 and reports true. If-None-Match takes
+// precedence over If-Modified-Since, as RFC 9110 requires.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modTime.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
 func truncate(s string, max int) string {
 	runes := []rune(s)
 	if len(runes) > max {
@@ -42,3 +110,204 @@ func safePath(dir, filename string) (string, error) {
 	}
 	return dest, nil
 }
+
+// safeRelPath resolves a client-supplied relative path, which unlike
+// safePath may include subdirectories, inside dir. Absolute paths and ".."
+// components are rejected rather than stripped.
+func safeRelPath(dir, rel string) (string, error) {
+	rel = strings.ReplaceAll(strings.TrimSpace(rel), "\\", "/")
+	if rel == "" || strings.HasPrefix(rel, "/") {
+		return "", fmt.Errorf("invalid path")
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("path escapes directory")
+		}
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(rel))
+	if cleaned == "." || strings.Count(cleaned, string(filepath.Separator)) >= maxRelPathDepth {
+		return "", fmt.Errorf("invalid path")
+	}
+	dest := filepath.Join(dir, cleaned)
+	if !strings.HasPrefix(dest, filepath.Clean(dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes directory")
+	}
+	return dest, nil
+}
+
+// ensureSubdir creates sub (which must be inside dir) after verifying that
+// no symlink along the way points outside dir. Only the deepest existing
+// ancestor needs resolving, since the components below it are created
+// here; the result is checked again once they exist.
+func ensureSubdir(dir, sub string) error {
+	if err := ensureDir(dir); err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	inside := func(path string) error {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return fmt.Errorf("path escapes directory")
+		}
+		return nil
+	}
+
+	existing := sub
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	if err := inside(existing); err != nil {
+		return err
+	}
+	if err := ensureDir(sub); err != nil {
+		return err
+	}
+	return inside(sub)
+}
+
+// randomID returns 16 random bytes hex-encoded.
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// clientIP returns the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// moveFile renames src to dst, falling back to copy-then-rename through a
+// temporary file in dst's directory when they are on different filesystems,
+// so dst never appears partially written.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".partial-*")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Chmod(0o644)
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+// moveDir renames the directory src to dst. Across filesystems it copies
+// the tree into a temporary directory next to dst, renames that into
+// place and only then removes src.
+func moveDir(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".partial-*")
+	if err != nil {
+		return err
+	}
+	if err := copyTree(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies the directories, regular files and symlinks below src
+// into the existing directory dst, keeping modes and modification times.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, 0o700); err != nil {
+				return err
+			}
+			// Owner access is kept so the walk can fill the directory.
+			return os.Chmod(target, info.Mode().Perm()|0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil // sockets, devices and pipes are left behind
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// handleListHooks serves GET /hooks: the configured post-upload hooks in
+// match order.
+func handleListHooks(w http.ResponseWriter, r *http.Request) {
+	uploadHooksMu.RLock()
+	hooks := append([]uploadHook{}, uploadHooks...)
+	uploadHooksMu.RUnlock()
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// handleHookResults serves GET /hooks/results: recent hook executions,
+// newest first. ?limit= caps the count (default and maximum maxHookResults).
+func handleHookResults(w http.ResponseWriter, r *http.Request) {
+	limit := maxHookResults
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			errorJSON(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxHookResults)
+	}
+	writeJSON(w, http.StatusOK, uploadHookRunner.recent(limit))
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadHook runs an action on files that land in uploadDir. Hooks are
+// loaded from uploadHooksFile, e.g.:
+//
+//	[
+//	  {"name": "pdfs", "mime": "application/pdf", "action": "move", "target": "~/Documents"},
+//	  {"name": "links", "glob": "*.url", "action": "open"},
+//	  {"name": "photos", "mime": "image/*", "action": "run", "command": ["~/bin/import.sh"]},
+//	  {"name": "zips", "glob": "*.zip", "action": "extract"}
+//	]
+//
+// The first hook whose mime and/or glob both match wins.
+type uploadHook struct {
+	Name    string   `json:"name"`
+	MIME    string   `json:"mime,omitempty"` // exact, or "type/*"
+	Glob    string   `json:"glob,omitempty"` // matched against the base name
+	Action  string   `json:"action"`         // move, open, run or extract
+	Target  string   `json:"target,omitempty"`
+	Command []string `json:"command,omitempty"`
+}
+
+const (
+	hookActionMove    = "move"
+	hookActionOpen    = "open"
+	hookActionRun     = "run"
+	hookActionExtract = "extract"
+)
+
+// hookResult records one hook execution for GET /hooks/results.
+type hookResult struct {
+	ID         uint64    `json:"id"`
+	Hook       string    `json:"hook"`
+	Action     string    `json:"action"`
+	File       string    `json:"file"`
+	Status     string    `json:"status"` // success, error, timeout or dropped
+	Output     string    `json:"output,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+var (
+	uploadHooksMu sync.RWMutex
+	uploadHooks   []uploadHook
+)
+
+// loadUploadHooks reads and validates the hook configuration. A missing
+// file means no hooks.
+func loadUploadHooks(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var hooks []uploadHook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, h := range hooks {
+		if err := validateUploadHook(h); err != nil {
+			return fmt.Errorf("hook %d (%s): %w", i, h.Name, err)
+		}
+	}
+
+	uploadHooksMu.Lock()
+	uploadHooks = hooks
+	uploadHooksMu.Unlock()
+	slog.Info("Loaded upload hooks", "file", path, "count", len(hooks))
+	return nil
+}
+
+func validateUploadHook(h uploadHook) error {
+	if h.MIME == "" && h.Glob == "" {
+		return errors.New("needs a mime or glob matcher")
+	}
+	if h.Glob != "" {
+		if _, err := filepath.Match(h.Glob, ""); err != nil {
+			return fmt.Errorf("invalid glob: %w", err)
+		}
+	}
+	switch h.Action {
+	case hookActionMove:
+		if h.Target == "" {
+			return errors.New("move needs a target")
+		}
+	case hookActionRun:
+		if len(h.Command) == 0 {
+			return errors.New("run needs a command")
+		}
+	case hookActionOpen, hookActionExtract:
+	default:
+		return fmt.Errorf("unknown action %q", h.Action)
+	}
+	return nil
+}
+
+// detectMIME guesses a file's type from its extension, falling back to
+// content sniffing.
+func detectMIME(path string) string {
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		mediaType, _, _ := mime.ParseMediaType(t)
+		return mediaType
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	return mediaType
+}
+
+func (h uploadHook) matches(name, mimeType string) bool {
+	if h.Glob != "" {
+		if ok, _ := filepath.Match(h.Glob, name); !ok {
+			return false
+		}
+	}
+	if h.MIME != "" {
+		if prefix, ok := strings.CutSuffix(h.MIME, "/*"); ok {
+			return strings.HasPrefix(mimeType, prefix+"/")
+		}
+		return h.MIME == mimeType
+	}
+	return true
+}
+
+func matchUploadHook(path string) (uploadHook, bool) {
+	uploadHooksMu.RLock()
+	defer uploadHooksMu.RUnlock()
+	if len(uploadHooks) == 0 {
+		return uploadHook{}, false
+	}
+	name, mimeType := filepath.Base(path), detectMIME(path)
+	for _, h := range uploadHooks {
+		if h.matches(name, mimeType) {
+			return h, true
+		}
+	}
+	return uploadHook{}, false
+}
+
+// runHookCommand executes an external program for a hook. It is a variable
+// so tests can observe commands without running them.
+var runHookCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// expandHome replaces a leading "~/" with $HOME.
+func expandHome(p string) string {
+	if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		return filepath.Join(os.Getenv("HOME"), rest)
+	}
+	return p
+}
+
+// execute performs the hook's action on path and returns any output worth
+// recording.
+func (h uploadHook) execute(ctx context.Context, path string) (string, error) {
+	switch h.Action {
+	case hookActionMove:
+		dest, _, err := moveIntoDir(path, expandHome(h.Target), filepath.Base(path), conflictRename)
+		if err != nil {
+			return "", err
+		}
+		return "moved to " + dest, nil
+	case hookActionOpen:
+		target := path
+		if link := extractURL(path); link != "" {
+			target = link
+		}
+		out, err := runHookCommand(ctx, "xdg-open", target)
+		return "opened " + target + "\n" + string(out), err
+	case hookActionRun:
+		args := append(append([]string{}, h.Command[1:]...), path)
+		out, err := runHookCommand(ctx, expandHome(h.Command[0]), args...)
+		return string(out), err
+	case hookActionExtract:
+		dest, n, err := extractZip(ctx, path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("extracted %d files to %s", n, dest), nil
+	}
+	return "", fmt.Errorf("unknown action %q", h.Action)
+}
+
+var (
+	urlFileLine = regexp.MustCompile(`(?m)^URL=(\S+)`)
+	weblocURL   = regexp.MustCompile(`<string>(https?://[^<]+)</string>`)
+)
+
+// extractURL returns the http(s) URL carried by a .url/.webloc shortcut,
+// a text/uri-list, or a small text file holding just a URL; "" otherwise.
+func extractURL(path string) string {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > 64<<10 {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	var candidate string
+	if m := urlFileLine.FindSubmatch(data); m != nil {
+		candidate = string(m[1])
+	} else if m := weblocURL.FindSubmatch(data); m != nil {
+		candidate = string(m[1])
+	} else {
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			candidate = line
+			break
+		}
+	}
+
+	u, err := url.Parse(strings.TrimSpace(candidate))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// extractZip unpacks a zip next to itself into a directory named after it,
+// refusing entries that would escape that directory and stopping at
+// maxHookExtractBytes.
+func extractZip(ctx context.Context, path string) (string, int, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer zr.Close()
+
+	dest := strings.TrimSuffix(path, filepath.Ext(path))
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = fmt.Sprintf("%s (%d)", strings.TrimSuffix(path, filepath.Ext(path)), i)
+	}
+	if err := ensureDir(dest); err != nil {
+		return "", 0, err
+	}
+
+	var total int64
+	count := 0
+	for _, entry := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return dest, count, err
+		}
+		target, err := safeRelPath(dest, entry.Name)
+		if err != nil {
+			return dest, count, fmt.Errorf("unsafe entry %q in archive", entry.Name)
+		}
+		if entry.FileInfo().IsDir() {
+			if err := ensureDir(target); err != nil {
+				return dest, count, err
+			}
+			continue
+		}
+		if !entry.Mode().IsRegular() {
+			continue // skip symlinks and devices
+		}
+		if err := ensureDir(filepath.Dir(target)); err != nil {
+			return dest, count, err
+		}
+
+		n, err := extractZipEntry(entry, target, maxHookExtractBytes-total)
+		total += n
+		if err != nil {
+			return dest, count, err
+		}
+		count++
+	}
+	return dest, count, nil
+}
+
+func extractZipEntry(entry *zip.File, target string, budget int64) (int64, error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, io.LimitReader(rc, budget+1))
+	if err != nil {
+		return n, err
+	}
+	if n > budget {
+		return n, fmt.Errorf("archive expands beyond %d bytes", maxHookExtractBytes)
+	}
+	return n, nil
+}
+
+// hookRunner executes hooks on a bounded pool of workers and keeps the most
+// recent results.
+type hookRunner struct {
+	jobs    chan hookJob
+	mu      sync.Mutex
+	nextID  uint64
+	results []hookResult
+	max     int
+	timeout time.Duration
+}
+
+type hookJob struct {
+	hook uploadHook
+	path string
+}
+
+func newHookRunner(workers, queue, maxResults int) *hookRunner {
+	hr := &hookRunner{jobs: make(chan hookJob, queue), max: maxResults, timeout: hookTimeout}
+	for i := 0; i < workers; i++ {
+		go hr.work()
+	}
+	return hr
+}
+
+var uploadHookRunner = newHookRunner(hookWorkers, hookQueueSize, maxHookResults)
+
+// enqueue schedules the first matching hook for path, if any. It never
+// blocks an upload response: a full queue records a "dropped" result.
+func (hr *hookRunner) enqueue(path string) {
+	hook, ok := matchUploadHook(path)
+	if !ok {
+		return
+	}
+	select {
+	case hr.jobs <- hookJob{hook: hook, path: path}:
+	default:
+		slog.Warn("Upload hook queue full; dropping", "hook", hook.Name, "file", path)
+		hr.record(hookResult{Hook: hook.Name, Action: hook.Action, File: path, Status: "dropped", StartedAt: time.Now()})
+	}
+}
+
+func (hr *hookRunner) work() {
+	for job := range hr.jobs {
+		hr.run(job)
+	}
+}
+
+func (hr *hookRunner) run(job hookJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), hr.timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := job.hook.execute(ctx, job.path)
+	res := hookResult{
+		Hook:       job.hook.Name,
+		Action:     job.hook.Action,
+		File:       job.path,
+		Status:     "success",
+		Output:     truncate(strings.TrimSpace(output), 2000),
+		StartedAt:  start,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.Status, res.Error = "timeout", fmt.Sprintf("timed out after %s", hr.timeout)
+	case err != nil:
+		res.Status, res.Error = "error", err.Error()
+	}
+	hr.record(res)
+
+	if res.Status == "success" {
+		slog.Info("Upload hook finished", "hook", res.Hook, "action", res.Action, "file", res.File, "duration_ms", res.DurationMS)
+	} else {
+		slog.Warn("Upload hook failed", "hook", res.Hook, "action", res.Action, "file", res.File, "status", res.Status, "err", res.Error)
+	}
+}
+
+func (hr *hookRunner) record(res hookResult) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.nextID++
+	res.ID = hr.nextID
+	hr.results = append(hr.results, res)
+	if len(hr.results) > hr.max {
+		hr.results = hr.results[1:]
+	}
+}
+
+// recent returns up to limit results, newest first.
+func (hr *hookRunner) recent(limit int) []hookResult {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	out := []hookResult{}
+	for i := len(hr.results) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, hr.results[i])
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// lastEventID returns the id the client has already seen, taken from the SSE
+// Last-Event-ID header (sent automatically on reconnect) or ?after=.
+func lastEventID(r *http.Request) uint64 {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("after")
+	}
+	id, _ := strconv.ParseUint(raw, 10, 64)
+	return id
+}
+
+// handleListLaptopNotifications serves GET /laptop-notifications: the
+// unacknowledged queue as a JSON array, for clients that poll.
+func handleListLaptopNotifications(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, laptopNotifications.after(lastEventID(r)))
+}
+
+// handleLaptopNotificationStream serves GET /laptop-notifications/stream as
+// Server-Sent Events. Every unacknowledged notification newer than the
+// client's last event id is replayed, then new ones are pushed as they
+// arrive. Delivery is not removal: entries stay queued until acked.
+func handleLaptopNotificationStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+
+	after := lastEventID(r)
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	slog.Info("Laptop notification stream opened", "client", r.RemoteAddr, "after", after)
+	for {
+		changed := laptopNotifications.wait()
+		for _, n := range laptopNotifications.after(after) {
+			if err := writeSSE(w, strconv.FormatUint(n.ID, 10), "notification", n); err != nil {
+				return
+			}
+			after = n.ID
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			slog.Info("Laptop notification stream closed", "client", r.RemoteAddr)
+			return
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleAckLaptopNotifications serves POST /laptop-notifications/ack. The ack
+// is cumulative: every notification up to and including id is removed.
+func handleAckLaptopNotifications(w http.ResponseWriter, r *http.Request) {
+	var payload laptopNotificationAckPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	if payload.ID == 0 {
+		errorJSON(w, http.StatusBadRequest, "Missing id")
+		return
+	}
+
+	removed := laptopNotifications.ack(payload.ID)
+	slog.Info("Laptop notifications acknowledged", "id", payload.ID, "removed", removed)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":  "success",
+		"removed": removed,
+	})
+}
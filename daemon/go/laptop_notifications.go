@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// laptopNotification is a desktop notification captured on the laptop's
+// session bus and queued for delivery to the phone.
+type laptopNotification struct {
+	ID         uint64    `json:"id"`
+	AppName    string    `json:"app_name"`
+	AppIcon    string    `json:"app_icon"`
+	Summary    string    `json:"summary"`
+	Body       string    `json:"body"`
+	Urgency    int       `json:"urgency"` // 0 low, 1 normal, 2 critical
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// laptopNotificationQueue holds notifications until the phone acknowledges
+// them, so nothing is lost while the phone is disconnected.
+type laptopNotificationQueue struct {
+	mu      sync.Mutex
+	max     int
+	nextID  uint64
+	items   []laptopNotification
+	changed chan struct{} // closed and replaced on every push
+}
+
+func newLaptopNotificationQueue(max int) *laptopNotificationQueue {
+	return &laptopNotificationQueue{
+		max: max,
+		// Seed ids from the clock so they keep increasing across daemon
+		// restarts and a phone resuming with an old Last-Event-ID still
+		// receives everything new.
+		nextID:  uint64(time.Now().UnixMilli()),
+		changed: make(chan struct{}),
+	}
+}
+
+// push assigns n an id, appends it and wakes any waiting streams. The oldest
+// unacknowledged entry is dropped when the queue is full.
+func (q *laptopNotificationQueue) push(n laptopNotification) laptopNotification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nextID++
+	n.ID = q.nextID
+	q.items = append(q.items, n)
+	if len(q.items) > q.max {
+		slog.Warn("Laptop notification queue full; dropping oldest", "id", q.items[0].ID)
+		q.items = q.items[1:]
+	}
+
+	close(q.changed)
+	q.changed = make(chan struct{})
+	return n
+}
+
+// after returns the queued notifications with an id greater than id.
+func (q *laptopNotificationQueue) after(id uint64) []laptopNotification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := []laptopNotification{}
+	for _, n := range q.items {
+		if n.ID > id {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// ack removes every notification up to and including id and returns how
+// many were removed.
+func (q *laptopNotificationQueue) ack(id uint64) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := 0
+	for i < len(q.items) && q.items[i].ID <= id {
+		i++
+	}
+	q.items = q.items[i:]
+	return i
+}
+
+// wait returns a channel that is closed on the next push. Callers must take
+// it before reading with after() so no push can slip in between.
+func (q *laptopNotificationQueue) wait() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.changed
+}
+
+var laptopNotifications = newLaptopNotificationQueue(maxLaptopNotificationQueue)
+
+// notificationMonitorCmd builds the process that reports Notify calls on the
+// session bus. It is a variable so tests can substitute canned output.
+var notificationMonitorCmd = func(ctx context.Context) *exec.Cmd {
+	return exec.CommandContext(ctx, "dbus-monitor", "--session",
+		"type='method_call',interface='org.freedesktop.Notifications',member='Notify'")
+}
+
+// runLaptopNotificationMonitor relays desktop notifications into
+// laptopNotifications until ctx is cancelled, restarting dbus-monitor with
+// backoff if it exits.
+func runLaptopNotificationMonitor(ctx context.Context) {
+	if _, err := exec.LookPath("dbus-monitor"); err != nil {
+		slog.Warn("dbus-monitor not found; laptop notification relay disabled")
+		return
+	}
+
+	backoff := time.Second
+	for {
+		err := monitorNotificationsOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Notification monitor exited; restarting", "err", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func monitorNotificationsOnce(ctx context.Context) error {
+	cmd := notificationMonitorCmd(ctx)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	parseNotifyCalls(stdout, relayLaptopNotification)
+	return cmd.Wait()
+}
+
+// relayLaptopNotification queues n unless it came from an ignored app, which
+// includes our own "Phone Sync" popups so forwarded phone notifications do
+// not bounce back to the phone.
+func relayLaptopNotification(n laptopNotification) {
+	for _, app := range relayIgnoredApps {
+		if strings.EqualFold(n.AppName, app) {
+			return
+		}
+	}
+	n.Summary = truncate(n.Summary, 200)
+	n.Body = truncate(n.Body, 1000)
+	n.ReceivedAt = time.Now()
+	n = laptopNotifications.push(n)
+	slog.Info("Queued laptop notification", "id", n.ID, "app", n.AppName, "summary", n.Summary)
+}
+
+// dbusMonitorLine matches the lines dbus-monitor itself prints: message
+// headers at column 0 and indented values. dbus-monitor escapes neither
+// quotes nor newlines inside strings, so while a string is open any other
+// line belongs to it.
+var dbusMonitorLine = regexp.MustCompile(`^(?:(?:method call|method return|signal|error) |\s+(?:string "|object path "|signature "|(?:byte|boolean|int16|uint16|int32|uint32|int64|uint64|double|variant|unix fd) |array \[|\]$|dict entry\($|\)$|struct \{$|\}$))`)
+
+// parseNotifyCalls reads dbus-monitor text output and calls emit for every
+// org.freedesktop.Notifications.Notify method call. Notify's arguments are
+// (app_name, replaces_id, app_icon, summary, body, actions, hints,
+// expire_timeout); top-level arguments are indented by exactly three spaces.
+// A string is only complete once the next dbus-monitor line starts, so a
+// body line ending in a quote can't cut it short.
+func parseNotifyCalls(r io.Reader, emit func(laptopNotification)) {
+	var (
+		inCall      bool
+		args        []string // top-level argument values, in order
+		pending     *strings.Builder
+		pendingTop  bool
+		urgency     = 1
+		nextUrgency bool
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if pending != nil {
+			if !dbusMonitorLine.MatchString(line) {
+				pending.WriteString("\n")
+				pending.WriteString(line)
+				continue
+			}
+			value := strings.TrimSuffix(pending.String(), `"`)
+			switch {
+			case pendingTop:
+				args = append(args, value)
+			case value == "urgency":
+				nextUrgency = true
+			}
+			pending = nil
+		}
+
+		if !strings.HasPrefix(line, " ") {
+			inCall = strings.HasPrefix(line, "method call") && strings.Contains(line, "member=Notify")
+			args, urgency, nextUrgency = nil, 1, false
+			continue
+		}
+		if !inCall {
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if nextUrgency {
+			nextUrgency = false
+			if fields := strings.Fields(trimmed); len(fields) > 0 {
+				if v, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+					urgency = v
+				}
+			}
+			continue
+		}
+
+		topLevel := !strings.HasPrefix(line, "    ")
+		value := strings.TrimLeft(strings.TrimPrefix(trimmed, "variant"), " ")
+		switch {
+		case strings.HasPrefix(value, `string "`):
+			pending = &strings.Builder{}
+			pending.WriteString(strings.TrimPrefix(value, `string "`))
+			pendingTop = topLevel
+		case !topLevel:
+			// nested inside actions/hints
+		case strings.HasPrefix(trimmed, "int32 ") && len(args) >= 5:
+			// expire_timeout is the final argument.
+			emit(laptopNotification{
+				AppName: args[0],
+				AppIcon: args[2],
+				Summary: args[3],
+				Body:    args[4],
+				Urgency: urgency,
+			})
+			inCall = false
+		case strings.HasPrefix(trimmed, "uint32 "):
+			args = append(args, strings.TrimPrefix(trimmed, "uint32 "))
+		}
+	}
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"context"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -26,18 +27,53 @@ func main() {
 		slog.Error("Failed to create share directory", "dir", shareDir, "err", err)
 		os.Exit(1)
 	}
+	if err := ensureDir(uploadStagingDir); err != nil {
+		slog.Error("Failed to create upload staging directory", "dir", uploadStagingDir, "err", err)
+		os.Exit(1)
+	}
 
 	// Restore lid-inhibit state persisted from the previous run.
 	if err := readLidInhibitState(); err != nil {
 		slog.Warn("Failed to restore lid inhibit state", "err", err)
 	}
 
+	if err := readClipboardSyncState(); err != nil {
+		slog.Warn("Failed to restore clipboard sync state", "err", err)
+	}
+	if p := newClipboardProvider(clipboardProviderName); p != nil {
+		clipboard.setProvider(p)
+		slog.Info("Clipboard provider selected", "provider", p.Name())
+	} else {
+		slog.Warn("No clipboard tool found; clipboard sync unavailable")
+	}
+
+	audio = newAudioController()
+	if audio == nil {
+		slog.Warn("Neither wpctl nor pactl found; volume control unavailable")
+	}
+
+	if err := loadUploadHooks(uploadHooksFile); err != nil {
+		slog.Warn("Failed to load upload hooks", "file", uploadHooksFile, "err", err)
+	}
+
 	// Warm up the CPU counter so the first /stats response is meaningful.
 	_, _ = cpu.Percent(0, false)
 
+	// ctx is cancelled on shutdown so background monitors and long-lived
+	// event streams end instead of holding srv.Shutdown open.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	go runLaptopNotificationMonitor(ctx)
+	go runStagedUploadGC(ctx)
+	go runShareWatcher(ctx)
+	go runClipboardWatcher(ctx)
+	go runMediaMonitor(ctx)
+
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: corsMiddleware(newMux()),
+		Addr:        ":" + port,
+		Handler:     corsMiddleware(newMux()),
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
 	// Graceful shutdown on SIGINT / SIGTERM.
@@ -54,9 +90,10 @@ func main() {
 
 	<-quit
 	slog.Info("Stopping stats daemon...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		slog.Error("Shutdown error", "err", err)
 	}
 	slog.Info("Server closed.")
@@ -10,19 +10,38 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 // ---------------------------------------------------------------------------
@@ -383,6 +402,328 @@ func TestPhoneNotification_LongText_Returns200(t *testing.T) {
 	}
 }
 
+// ---------------------------------------------------------------------------
+// POST /phone-notification — rich payload
+// ---------------------------------------------------------------------------
+
+// tinyPNG returns the encoded bytes of a 1x1 PNG.
+func tinyPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestPhoneNotification_RichPayload_Returns200(t *testing.T) {
+	orig := notificationMediaDir
+	notificationMediaDir = t.TempDir()
+	t.Cleanup(func() { notificationMediaDir = orig })
+
+	base := startServer(t)
+	icon := base64.StdEncoding.EncodeToString(tinyPNG(t))
+	status, body := post(t, base, "/phone-notification", jsonBody(map[string]any{
+		"key":          "0|com.whatsapp|1|null|10001",
+		"package_name": "com.whatsapp",
+		"app_label":    "WhatsApp",
+		"title":        "Alice",
+		"text":         "See you soon",
+		"big_text":     "See you soon, running a bit late",
+		"category":     "msg",
+		"conversation": "Family",
+		"sender":       "Alice",
+		"icon":         icon,
+		"image":        "data:image/png;base64," + icon,
+		"progress":     40,
+		"posted_at":    "2024-05-01T10:00:00Z",
+	}))
+	if status != 200 {
+		t.Errorf("want 200, got %d (%v)", status, body)
+	}
+}
+
+func TestPhoneNotification_InvalidPostedAt_Returns400(t *testing.T) {
+	base := startServer(t)
+	status, body := post(t, base, "/phone-notification",
+		jsonBody(map[string]any{"title": "Hi", "posted_at": "yesterday"}))
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+	if body["status"] != "error" {
+		t.Errorf("want status=error, got %v", body["status"])
+	}
+}
+
+func TestPhoneNotification_ProgressOutOfRange_Returns400(t *testing.T) {
+	base := startServer(t)
+	status, _ := post(t, base, "/phone-notification",
+		jsonBody(map[string]any{"title": "Downloading", "progress": 150}))
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+func TestPhoneNotification_InvalidIconBase64_Returns400(t *testing.T) {
+	base := startServer(t)
+	status, _ := post(t, base, "/phone-notification",
+		jsonBody(map[string]any{"title": "Hi", "icon": "%%%not-base64%%%"}))
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+func TestPhoneNotification_NonImageIcon_Returns400(t *testing.T) {
+	base := startServer(t)
+	status, _ := post(t, base, "/phone-notification", jsonBody(map[string]any{
+		"title": "Hi",
+		"icon":  base64.StdEncoding.EncodeToString([]byte("plain text, not an image")),
+	}))
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+func TestPhoneNotification_OversizedIcon_Returns413(t *testing.T) {
+	base := startServer(t)
+	big := append(tinyPNG(t), make([]byte, maxNotificationIconBytes)...)
+	status, _ := post(t, base, "/phone-notification", jsonBody(map[string]any{
+		"title": "Hi",
+		"icon":  base64.StdEncoding.EncodeToString(big),
+	}))
+	if status != 413 {
+		t.Errorf("want 413, got %d", status)
+	}
+}
+
+func TestPhoneNotification_MultipartWithIcon_Returns200(t *testing.T) {
+	orig := notificationMediaDir
+	notificationMediaDir = t.TempDir()
+	t.Cleanup(func() { notificationMediaDir = orig })
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	_ = mw.WriteField("title", "Build finished")
+	_ = mw.WriteField("posted_at", "1714557600000")
+	fw, _ := mw.CreateFormFile("icon", "icon.png")
+	_, _ = fw.Write(tinyPNG(t))
+	mw.Close()
+
+	base := startServer(t)
+	resp, err := http.Post(base+"/phone-notification", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatalf("POST /phone-notification: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("want 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestNotificationTime_AcceptsMillisAndRFC3339(t *testing.T) {
+	want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, raw := range []string{`1714557600000`, `"1714557600000"`, `"2024-05-01T10:00:00Z"`} {
+		var ts notificationTime
+		if err := json.Unmarshal([]byte(raw), &ts); err != nil {
+			t.Errorf("%s: unexpected error: %v", raw, err)
+			continue
+		}
+		if !ts.Equal(want) {
+			t.Errorf("%s: want %v, got %v", raw, want, ts.Time)
+		}
+	}
+	for _, raw := range []string{`"yesterday"`, `true`} {
+		var ts notificationTime
+		if err := json.Unmarshal([]byte(raw), &ts); !errors.Is(err, errInvalidPostedAt) {
+			t.Errorf("%s: want errInvalidPostedAt, got %v", raw, err)
+		}
+	}
+}
+
+func TestNotifySendHelpHasPopupIDs(t *testing.T) {
+	old := `Application Options:
+  -u, --urgency=LEVEL               Specifies the urgency level (low, normal, critical).
+  -t, --expire-time=TIME            Specifies the timeout in milliseconds at which to expire the notification.
+  -a, --app-name=APP_NAME           Specifies the app name for the icon
+  -i, --icon=ICON[,ICON...]         Specifies an icon filename or stock icon to display.
+  -c, --category=TYPE[,TYPE...]     Specifies the notification category.
+  -h, --hint=TYPE:NAME:VALUE        Specifies basic extra data to pass. Valid types are int, double, string and byte.`
+	current := old + `
+  -p, --print-id                    Print the notification ID.
+  -r, --replace-id=REPLACE_ID       The ID of the notification to replace.
+  -w, --wait                        Wait for the notification to be closed before exiting.
+  -A, --action=[NAME=]Text...       Specifies the actions to display to the user.`
+	if notifySendHelpHasPopupIDs(old) {
+		t.Error("libnotify 0.7.9 help should not report popup ids")
+	}
+	if !notifySendHelpHasPopupIDs(current) {
+		t.Error("libnotify 0.8 help should report popup ids")
+	}
+}
+
+func TestNotifySendArgs_IncludesIconImageAndCategory(t *testing.T) {
+	progress := 25
+	args := notifySendArgs(&notificationPayload{
+		Title:    "Alice",
+		Text:     "hi",
+		Sender:   "Bob",
+		Category: "msg",
+		Progress: &progress,
+	}, "/tmp/icon.png", "/tmp/image.png")
+
+	joined := strings.Join(args, " ")
+	for _, want := range []string{
+		"--icon=/tmp/icon.png",
+		"--hint=string:image-path:/tmp/image.png",
+		"--category=im.received",
+		"--hint=int:value:25",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("args missing %q: %v", want, args)
+		}
+	}
+	if got := args[len(args)-1]; got != "Bob: hi" {
+		t.Errorf("want body %q, got %q", "Bob: hi", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Notification dismissal sync
+// ---------------------------------------------------------------------------
+
+// stubDesktopNotifications replaces the notify-send/gdbus calls with fakes that
+// hand out sequential popup ids, and returns a pointer to the closed ids.
+func stubDesktopNotifications(t *testing.T) *[]uint32 {
+	t.Helper()
+	origShow, origClose, origHistory := showDesktopNotification, closeDesktopNotification, notificationHistory
+	var mu sync.Mutex
+	var next uint32
+	closed := &[]uint32{}
+	showDesktopNotification = func(args []string, replaceID uint32, onReply func()) (uint32, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if replaceID != 0 {
+			return replaceID, nil
+		}
+		next++
+		return next, nil
+	}
+	closeDesktopNotification = func(id uint32) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*closed = append(*closed, id)
+		return nil
+	}
+	notificationHistory = newNotificationStore(maxNotificationHistory)
+	t.Cleanup(func() {
+		showDesktopNotification, closeDesktopNotification, notificationHistory = origShow, origClose, origHistory
+	})
+	return closed
+}
+
+func TestDismissNotification_ClosesPopupAndMarksDismissed(t *testing.T) {
+	closed := stubDesktopNotifications(t)
+	base := startServer(t)
+
+	key := "0|com.whatsapp|1|null|10001"
+	post(t, base, "/phone-notification", jsonBody(map[string]any{"key": key, "title": "Hi"}))
+
+	status, body := post(t, base, "/phone-notification/"+url.PathEscape(key)+"/dismiss", nil)
+	if status != 200 {
+		t.Fatalf("want 200, got %d (%v)", status, body)
+	}
+	if len(*closed) != 1 || (*closed)[0] != 1 {
+		t.Errorf("want popup 1 closed, got %v", *closed)
+	}
+	entry, ok := notificationHistory.get(key)
+	if !ok || !entry.Dismissed || entry.DismissedAt == nil {
+		t.Errorf("want entry marked dismissed, got %+v (found=%v)", entry, ok)
+	}
+}
+
+func TestDismissNotification_RemovedEvent(t *testing.T) {
+	closed := stubDesktopNotifications(t)
+	base := startServer(t)
+
+	post(t, base, "/phone-notification", jsonBody(map[string]any{"key": "k1", "title": "Hi"}))
+	status, _ := post(t, base, "/phone-notification",
+		jsonBody(map[string]any{"event": "removed", "key": "k1"}))
+	if status != 200 {
+		t.Errorf("want 200, got %d", status)
+	}
+	if len(*closed) != 1 {
+		t.Errorf("want 1 popup closed, got %v", *closed)
+	}
+}
+
+func TestDismissNotification_WhilePopupIsShowing(t *testing.T) {
+	closed := stubDesktopNotifications(t)
+	stubbedShow := showDesktopNotification
+	showDesktopNotification = func(args []string, replaceID uint32, onReply func()) (uint32, error) {
+		notificationHistory.dismiss("k1") // the phone's dismiss wins the race
+		return stubbedShow(args, replaceID, onReply)
+	}
+	base := startServer(t)
+
+	post(t, base, "/phone-notification", jsonBody(map[string]any{"key": "k1", "title": "Hi"}))
+	if len(*closed) != 1 || (*closed)[0] != 1 {
+		t.Errorf("want popup 1 closed once its id is known, got %v", *closed)
+	}
+	if entry, _ := notificationHistory.get("k1"); !entry.Dismissed {
+		t.Errorf("entry should stay dismissed, got %+v", entry)
+	}
+}
+
+func TestDismissNotification_UnknownKey_Returns404(t *testing.T) {
+	stubDesktopNotifications(t)
+	base := startServer(t)
+
+	status, body := post(t, base, "/phone-notification/nope/dismiss", nil)
+	if status != 404 {
+		t.Errorf("want 404, got %d", status)
+	}
+	if body["status"] != "error" {
+		t.Errorf("want status=error, got %v", body["status"])
+	}
+}
+
+func TestDismissNotification_RemovedEventWithoutKey_Returns400(t *testing.T) {
+	stubDesktopNotifications(t)
+	base := startServer(t)
+
+	status, _ := post(t, base, "/phone-notification", jsonBody(map[string]any{"event": "removed"}))
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+func TestPhoneNotification_RepostReplacesPopup(t *testing.T) {
+	closed := stubDesktopNotifications(t)
+	base := startServer(t)
+
+	post(t, base, "/phone-notification", jsonBody(map[string]any{"key": "k", "title": "1 message"}))
+	post(t, base, "/phone-notification", jsonBody(map[string]any{"key": "k", "title": "2 messages"}))
+	post(t, base, "/phone-notification/k/dismiss", nil)
+
+	// Both posts share popup 1, so only that id is closed.
+	if len(*closed) != 1 || (*closed)[0] != 1 {
+		t.Errorf("want popup 1 closed once, got %v", *closed)
+	}
+}
+
+func TestNotificationStore_EvictsOldest(t *testing.T) {
+	s := newNotificationStore(2)
+	s.put(notificationEntry{Key: "a"})
+	s.put(notificationEntry{Key: "b"})
+	s.put(notificationEntry{Key: "c"})
+	if _, ok := s.get("a"); ok {
+		t.Error("oldest entry should have been evicted")
+	}
+	if _, ok := s.get("c"); !ok {
+		t.Error("newest entry missing")
+	}
+}
+
 // Unit test: truncate() helper
 func TestTruncate_ShortString_Unchanged(t *testing.T) {
 	s := "hello"
@@ -699,3 +1040,3684 @@ func TestDownload_TraversalAttempt_Returns400(t *testing.T) {
 		t.Errorf("want 400 or 404, got %d", resp.StatusCode)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// Laptop → phone notification relay
+// ---------------------------------------------------------------------------
+
+const dbusMonitorFixture = `signal time=1700000000.000001 sender=org.freedesktop.DBus -> destination=:1.99 serial=2 path=/org/freedesktop/DBus; interface=org.freedesktop.DBus; member=NameAcquired
+   string ":1.99"
+method call time=1700000001.000001 sender=:1.50 -> destination=org.freedesktop.Notifications serial=7 path=/org/freedesktop/Notifications; interface=org.freedesktop.Notifications; member=Notify
+   string "make"
+   uint32 0
+   string "dialog-information"
+   string "Build finished"
+   string "All targets
+built in 42s"
+   array [
+      string "default"
+      string "Open"
+   ]
+   array [
+      dict entry(
+         string "urgency"
+         variant             byte 2
+      )
+   ]
+   int32 -1
+method call time=1700000002.000001 sender=:1.51 -> destination=org.freedesktop.Notifications serial=8 path=/org/freedesktop/Notifications; interface=org.freedesktop.Notifications; member=Notify
+   string "Calendar"
+   uint32 0
+   string ""
+   string "Standup in 5 minutes"
+   string ""
+   array [
+   ]
+   array [
+   ]
+   int32 5000
+`
+
+func TestParseNotifyCalls_ParsesDbusMonitorOutput(t *testing.T) {
+	var got []laptopNotification
+	parseNotifyCalls(strings.NewReader(dbusMonitorFixture), func(n laptopNotification) {
+		got = append(got, n)
+	})
+
+	if len(got) != 2 {
+		t.Fatalf("want 2 notifications, got %d: %+v", len(got), got)
+	}
+	if got[0].AppName != "make" || got[0].Summary != "Build finished" || got[0].AppIcon != "dialog-information" {
+		t.Errorf("unexpected first notification: %+v", got[0])
+	}
+	if got[0].Body != "All targets\nbuilt in 42s" {
+		t.Errorf("multi-line body not joined: %q", got[0].Body)
+	}
+	if got[0].Urgency != 2 {
+		t.Errorf("want urgency 2, got %d", got[0].Urgency)
+	}
+	if got[1].AppName != "Calendar" || got[1].Summary != "Standup in 5 minutes" || got[1].Urgency != 1 {
+		t.Errorf("unexpected second notification: %+v", got[1])
+	}
+}
+
+func TestParseNotifyCalls_QuotesInsideMultiLineStrings(t *testing.T) {
+	out := `method call time=1700000003.000001 sender=:1.52 -> destination=org.freedesktop.Notifications serial=9 path=/org/freedesktop/Notifications; interface=org.freedesktop.Notifications; member=Notify
+   string "Chat"
+   uint32 0
+   string ""
+   string "Alex"
+   string "He said "ok"
+see you "later"
+"
+   array [
+   ]
+   array [
+      dict entry(
+         string "x-note"
+         variant             string "a "quoted"
+hint"
+      )
+      dict entry(
+         string "urgency"
+         variant             byte 0
+      )
+   ]
+   int32 -1
+` + dbusMonitorFixture
+	var got []laptopNotification
+	parseNotifyCalls(strings.NewReader(out), func(n laptopNotification) {
+		got = append(got, n)
+	})
+
+	if len(got) != 3 {
+		t.Fatalf("want 3 notifications, got %d: %+v", len(got), got)
+	}
+	if got[0].Summary != "Alex" || got[0].Body != "He said \"ok\"\nsee you \"later\"\n" || got[0].Urgency != 0 {
+		t.Errorf("unexpected notification: %+v", got[0])
+	}
+	if got[1].AppName != "make" || got[2].AppName != "Calendar" {
+		t.Errorf("later notifications lost: %+v", got[1:])
+	}
+}
+
+// resetLaptopNotifications gives the test an empty relay queue.
+func resetLaptopNotifications(t *testing.T) {
+	t.Helper()
+	orig := laptopNotifications
+	laptopNotifications = newLaptopNotificationQueue(maxLaptopNotificationQueue)
+	t.Cleanup(func() { laptopNotifications = orig })
+}
+
+func TestRelayLaptopNotification_IgnoresOwnPopups(t *testing.T) {
+	resetLaptopNotifications(t)
+	relayLaptopNotification(laptopNotification{AppName: "Phone Sync", Summary: "Phone: hi"})
+	relayLaptopNotification(laptopNotification{AppName: "make", Summary: "done"})
+
+	got := laptopNotifications.after(0)
+	if len(got) != 1 || got[0].AppName != "make" {
+		t.Errorf("want only the make notification queued, got %+v", got)
+	}
+}
+
+func TestLaptopNotificationQueue_AckIsCumulative(t *testing.T) {
+	q := newLaptopNotificationQueue(10)
+	a := q.push(laptopNotification{Summary: "a"})
+	b := q.push(laptopNotification{Summary: "b"})
+	c := q.push(laptopNotification{Summary: "c"})
+
+	if b.ID <= a.ID || c.ID <= b.ID {
+		t.Fatalf("ids must increase: %d %d %d", a.ID, b.ID, c.ID)
+	}
+	if removed := q.ack(b.ID); removed != 2 {
+		t.Errorf("want 2 removed, got %d", removed)
+	}
+	if got := q.after(0); len(got) != 1 || got[0].ID != c.ID {
+		t.Errorf("want only c left, got %+v", got)
+	}
+}
+
+func TestLaptopNotificationQueue_DropsOldestWhenFull(t *testing.T) {
+	q := newLaptopNotificationQueue(2)
+	q.push(laptopNotification{Summary: "a"})
+	q.push(laptopNotification{Summary: "b"})
+	q.push(laptopNotification{Summary: "c"})
+
+	got := q.after(0)
+	if len(got) != 2 || got[0].Summary != "b" {
+		t.Errorf("want [b c], got %+v", got)
+	}
+}
+
+func TestLaptopNotificationStream_ReplaysAndPushes(t *testing.T) {
+	resetLaptopNotifications(t)
+	first := laptopNotifications.push(laptopNotification{AppName: "make", Summary: "queued while offline"})
+
+	base := startServer(t)
+	resp, err := http.Get(base + "/laptop-notifications/stream")
+	if err != nil {
+		t.Fatalf("GET /laptop-notifications/stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("want text/event-stream, got %q", ct)
+	}
+
+	events := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+				events <- strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+
+	readEvent := func() laptopNotification {
+		t.Helper()
+		select {
+		case data := <-events:
+			var n laptopNotification
+			if err := json.Unmarshal([]byte(data), &n); err != nil {
+				t.Fatalf("decode event: %v", err)
+			}
+			return n
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return laptopNotification{}
+	}
+
+	if n := readEvent(); n.ID != first.ID {
+		t.Errorf("want replay of %d, got %+v", first.ID, n)
+	}
+	second := laptopNotifications.push(laptopNotification{AppName: "Calendar", Summary: "live"})
+	if n := readEvent(); n.ID != second.ID {
+		t.Errorf("want live event %d, got %+v", second.ID, n)
+	}
+}
+
+func TestLaptopNotificationAck_RemovesFromQueue(t *testing.T) {
+	resetLaptopNotifications(t)
+	n := laptopNotifications.push(laptopNotification{Summary: "x"})
+
+	base := startServer(t)
+	status, body := post(t, base, "/laptop-notifications/ack", jsonBody(map[string]any{"id": n.ID}))
+	if status != 200 {
+		t.Fatalf("want 200, got %d", status)
+	}
+	if body["removed"] != float64(1) {
+		t.Errorf("want removed=1, got %v", body["removed"])
+	}
+
+	resp, err := http.Get(base + "/laptop-notifications")
+	if err != nil {
+		t.Fatalf("GET /laptop-notifications: %v", err)
+	}
+	defer resp.Body.Close()
+	var pending []laptopNotification
+	_ = json.NewDecoder(resp.Body).Decode(&pending)
+	if len(pending) != 0 {
+		t.Errorf("want empty queue after ack, got %+v", pending)
+	}
+}
+
+func TestLaptopNotificationAck_MissingID_Returns400(t *testing.T) {
+	base := startServer(t)
+	status, _ := post(t, base, "/laptop-notifications/ack", jsonBody(map[string]any{}))
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Quick reply queue
+// ---------------------------------------------------------------------------
+
+func TestPhoneReplyQueue_PendingAndAck(t *testing.T) {
+	q := newPhoneReplyQueue(time.Minute, 10)
+	a := q.add("k1", "on my way")
+	b := q.add("k2", "ok")
+
+	if got := q.pending(); len(got) != 2 || got[0].ID != a.ID || got[1].ID != b.ID {
+		t.Fatalf("want [a b] pending, got %+v", got)
+	}
+	// Reading does not consume; only ack does.
+	if got := q.pending(); len(got) != 2 {
+		t.Errorf("pending should be idempotent, got %d", len(got))
+	}
+	if removed := q.ack([]uint64{a.ID, 999}); removed != 1 {
+		t.Errorf("want 1 removed, got %d", removed)
+	}
+	if got := q.pending(); len(got) != 1 || got[0].ID != b.ID {
+		t.Errorf("want only b pending, got %+v", got)
+	}
+}
+
+func TestPhoneReplyQueue_Expiry(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	q := newPhoneReplyQueue(10*time.Minute, 10)
+	q.now = func() time.Time { return now }
+
+	reply := q.add("k", "hi")
+	if !reply.ExpiresAt.Equal(now.Add(10 * time.Minute)) {
+		t.Errorf("unexpected expiry %v", reply.ExpiresAt)
+	}
+
+	now = now.Add(9 * time.Minute)
+	if len(q.pending()) != 1 {
+		t.Error("reply should still be pending before its expiry")
+	}
+	now = now.Add(time.Minute)
+	if got := q.pending(); len(got) != 0 {
+		t.Errorf("reply should have expired, got %+v", got)
+	}
+}
+
+func TestPhoneReplyQueue_DropsOldestWhenFull(t *testing.T) {
+	q := newPhoneReplyQueue(time.Minute, 2)
+	q.add("k", "1")
+	q.add("k", "2")
+	q.add("k", "3")
+	if got := q.pending(); len(got) != 2 || got[0].Text != "2" {
+		t.Errorf("want [2 3], got %+v", got)
+	}
+}
+
+// resetPhoneReplies gives the test an empty reply queue.
+func resetPhoneReplies(t *testing.T) {
+	t.Helper()
+	orig := phoneReplies
+	phoneReplies = newPhoneReplyQueue(phoneReplyTTL, maxPendingReplies)
+	t.Cleanup(func() { phoneReplies = orig })
+}
+
+func TestPhoneReply_EndToEnd(t *testing.T) {
+	stubDesktopNotifications(t)
+	resetPhoneReplies(t)
+	base := startServer(t)
+
+	post(t, base, "/phone-notification", jsonBody(map[string]any{
+		"key": "wa|1", "title": "Alice", "text": "lunch?", "can_reply": true,
+	}))
+	status, body := post(t, base, "/phone-notification/"+url.PathEscape("wa|1")+"/reply",
+		jsonBody(map[string]string{"text": "sure, 12:30"}))
+	if status != 200 {
+		t.Fatalf("want 200, got %d (%v)", status, body)
+	}
+
+	resp, err := http.Get(base + "/phone-notification/replies")
+	if err != nil {
+		t.Fatalf("GET /phone-notification/replies: %v", err)
+	}
+	var replies []phoneReply
+	_ = json.NewDecoder(resp.Body).Decode(&replies)
+	resp.Body.Close()
+	if len(replies) != 1 || replies[0].Key != "wa|1" || replies[0].Text != "sure, 12:30" {
+		t.Fatalf("unexpected replies: %+v", replies)
+	}
+
+	status, body = post(t, base, "/phone-notification/replies/ack",
+		jsonBody(map[string]any{"ids": []uint64{replies[0].ID}}))
+	if status != 200 || body["removed"] != float64(1) {
+		t.Errorf("want 200 removed=1, got %d %v", status, body)
+	}
+	if len(phoneReplies.pending()) != 0 {
+		t.Error("reply should be gone after ack")
+	}
+}
+
+func TestPhoneReply_UnknownKey_Returns404(t *testing.T) {
+	stubDesktopNotifications(t)
+	resetPhoneReplies(t)
+	base := startServer(t)
+
+	status, _ := post(t, base, "/phone-notification/missing/reply", jsonBody(map[string]string{"text": "hi"}))
+	if status != 404 {
+		t.Errorf("want 404, got %d", status)
+	}
+}
+
+func TestPhoneReply_NotReplyable_Returns409(t *testing.T) {
+	stubDesktopNotifications(t)
+	resetPhoneReplies(t)
+	base := startServer(t)
+
+	post(t, base, "/phone-notification", jsonBody(map[string]any{"key": "bank|1", "title": "Payment"}))
+	status, _ := post(t, base, "/phone-notification/bank|1/reply", jsonBody(map[string]string{"text": "hi"}))
+	if status != 409 {
+		t.Errorf("want 409, got %d", status)
+	}
+}
+
+func TestPhoneReply_EmptyText_Returns400(t *testing.T) {
+	stubDesktopNotifications(t)
+	resetPhoneReplies(t)
+	base := startServer(t)
+
+	post(t, base, "/phone-notification", jsonBody(map[string]any{"key": "k", "title": "Hi", "can_reply": true}))
+	status, _ := post(t, base, "/phone-notification/k/reply", jsonBody(map[string]string{"text": "  "}))
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+func TestPhoneReply_DesktopActionQueuesReply(t *testing.T) {
+	stubDesktopNotifications(t)
+	resetPhoneReplies(t)
+
+	var onReply func()
+	showDesktopNotification = func(args []string, replaceID uint32, reply func()) (uint32, error) {
+		onReply = reply
+		return 1, nil
+	}
+	origPrompt := promptReplyText
+	promptReplyText = func(prompt string) (string, error) { return "typed on laptop", nil }
+	t.Cleanup(func() { promptReplyText = origPrompt })
+
+	base := startServer(t)
+	post(t, base, "/phone-notification", jsonBody(map[string]any{"key": "k", "title": "Bob", "can_reply": true}))
+	if onReply == nil {
+		t.Fatal("replyable notification should offer a Reply action")
+	}
+	onReply()
+
+	if got := phoneReplies.pending(); len(got) != 1 || got[0].Key != "k" || got[0].Text != "typed on laptop" {
+		t.Errorf("unexpected replies: %+v", got)
+	}
+}
+
+func TestPopupWaiters_StopKillsReplacedWaiter(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not available")
+	}
+	waiters := &popupWaiters{procs: map[uint32]*os.Process{}}
+	old := exec.Command(sleep, "30")
+	if err := old.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	waiters.add(7, old.Process)
+
+	newer := exec.Command(sleep, "30")
+	if err := newer.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { _ = newer.Process.Kill(); _ = newer.Wait() })
+
+	waiters.stop(7)
+	waiters.add(7, newer.Process)
+	if err := old.Wait(); err == nil {
+		t.Error("replaced waiter should have been killed")
+	}
+	// The old waiter exiting must not forget its replacement.
+	waiters.done(7, old.Process)
+	if waiters.procs[7] != newer.Process {
+		t.Error("replacement waiter was dropped")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Resumable (tus) uploads
+// ---------------------------------------------------------------------------
+
+// useTempUploadDirs points uploadDir and uploadStagingDir at fresh temp dirs.
+func useTempUploadDirs(t *testing.T) {
+	t.Helper()
+	origUpload, origStaging := uploadDir, uploadStagingDir
+	uploadDir, uploadStagingDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { uploadDir, uploadStagingDir = origUpload, origStaging })
+}
+
+// tusRequest sends a tus request with Tus-Resumable set and returns the
+// response with its body already drained.
+func tusRequest(t *testing.T, method, url string, headers map[string]string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func createTus(t *testing.T, base, filename string, length int) string {
+	t.Helper()
+	resp := tusRequest(t, http.MethodPost, base+"/uploads", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	}, nil)
+	if resp.StatusCode != 201 {
+		t.Fatalf("create: want 201, got %d", resp.StatusCode)
+	}
+	loc := resp.Header.Get("Location")
+	if !strings.HasPrefix(loc, "/uploads/") {
+		t.Fatalf("unexpected Location %q", loc)
+	}
+	return base + loc
+}
+
+func patchTus(t *testing.T, url string, offset int, chunk []byte) *http.Response {
+	t.Helper()
+	return tusRequest(t, http.MethodPatch, url, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, chunk)
+}
+
+func TestTusUpload_ResumeAcrossChunks(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	content := []byte("0123456789abcdefghij")
+	url := createTus(t, base, "video.mp4", len(content))
+
+	if resp := patchTus(t, url, 0, content[:8]); resp.StatusCode != 204 || resp.Header.Get("Upload-Offset") != "8" {
+		t.Fatalf("first chunk: got %d offset=%q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+
+	head := tusRequest(t, http.MethodHead, url, nil, nil)
+	if head.StatusCode != 200 || head.Header.Get("Upload-Offset") != "8" || head.Header.Get("Upload-Length") != "20" {
+		t.Fatalf("HEAD: got %d offset=%q length=%q", head.StatusCode,
+			head.Header.Get("Upload-Offset"), head.Header.Get("Upload-Length"))
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "video.mp4")); !os.IsNotExist(err) {
+		t.Error("partial upload must not appear in uploadDir")
+	}
+
+	if resp := patchTus(t, url, 8, content[8:]); resp.StatusCode != 204 || resp.Header.Get("Upload-Offset") != "20" {
+		t.Fatalf("second chunk: got %d offset=%q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+
+	got, err := os.ReadFile(filepath.Join(uploadDir, "video.mp4"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("stored file mismatch: %q (%v)", got, err)
+	}
+	if head := tusRequest(t, http.MethodHead, url, nil, nil); head.Header.Get("Upload-Offset") != "20" {
+		t.Errorf("HEAD after completion: want offset 20, got %q", head.Header.Get("Upload-Offset"))
+	}
+}
+
+func TestTusUpload_OffsetMismatch_Returns409(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	url := createTus(t, base, "a.bin", 10)
+	if resp := patchTus(t, url, 5, []byte("xxxxx")); resp.StatusCode != 409 {
+		t.Errorf("want 409, got %d", resp.StatusCode)
+	}
+}
+
+func TestTusUpload_ChunkBeyondLength_Returns413(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	url := createTus(t, base, "a.bin", 4)
+	if resp := patchTus(t, url, 0, []byte("too long")); resp.StatusCode != 413 {
+		t.Errorf("want 413, got %d", resp.StatusCode)
+	}
+}
+
+func TestTusUpload_WrongContentType_Returns415(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	url := createTus(t, base, "a.bin", 4)
+	resp := tusRequest(t, http.MethodPatch, url, map[string]string{"Upload-Offset": "0"}, []byte("abcd"))
+	if resp.StatusCode != 415 {
+		t.Errorf("want 415, got %d", resp.StatusCode)
+	}
+}
+
+func TestTusUpload_MissingTusResumable_Returns412(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	req, _ := http.NewRequest(http.MethodPost, base+"/uploads", nil)
+	req.Header.Set("Upload-Length", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /uploads: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 412 {
+		t.Errorf("want 412, got %d", resp.StatusCode)
+	}
+}
+
+func TestTusUpload_MissingFilename_Returns400(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	resp := tusRequest(t, http.MethodPost, base+"/uploads", map[string]string{"Upload-Length": "3"}, nil)
+	if resp.StatusCode != 400 {
+		t.Errorf("want 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestTusUpload_Terminate(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	url := createTus(t, base, "a.bin", 10)
+	patchTus(t, url, 0, []byte("abc"))
+	if resp := tusRequest(t, http.MethodDelete, url, nil, nil); resp.StatusCode != 204 {
+		t.Fatalf("DELETE: want 204, got %d", resp.StatusCode)
+	}
+	if resp := tusRequest(t, http.MethodHead, url, nil, nil); resp.StatusCode != 404 {
+		t.Errorf("HEAD after DELETE: want 404, got %d", resp.StatusCode)
+	}
+	entries, _ := os.ReadDir(uploadStagingDir)
+	if len(entries) != 0 {
+		t.Errorf("staging dir should be empty, has %d entries", len(entries))
+	}
+}
+
+func TestTusUpload_UnknownID_Returns404(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	for _, id := range []string{"0123456789abcdef0123456789abcdef", "..%2F..%2Fetc"} {
+		if resp := tusRequest(t, http.MethodHead, base+"/uploads/"+id, nil, nil); resp.StatusCode != 404 {
+			t.Errorf("%s: want 404, got %d", id, resp.StatusCode)
+		}
+	}
+}
+
+func TestTusUpload_OptionsAdvertisesExtensions(t *testing.T) {
+	base := startServer(t)
+	req, _ := http.NewRequest(http.MethodOptions, base+"/uploads", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("OPTIONS /uploads: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Tus-Version") != tusVersion {
+		t.Errorf("want Tus-Version %s, got %q", tusVersion, resp.Header.Get("Tus-Version"))
+	}
+	if !strings.Contains(resp.Header.Get("Tus-Extension"), "termination") {
+		t.Errorf("Tus-Extension missing termination: %q", resp.Header.Get("Tus-Extension"))
+	}
+}
+
+func TestGCStagedUploads_RemovesAbandoned(t *testing.T) {
+	useTempUploadDirs(t)
+
+	stale, err := createTusUpload("old.bin", 10, nil)
+	if err != nil {
+		t.Fatalf("createTusUpload: %v", err)
+	}
+	fresh, err := createTusUpload("new.bin", 10, nil)
+	if err != nil {
+		t.Fatalf("createTusUpload: %v", err)
+	}
+	old := time.Now().Add(-2 * uploadStagingTTL)
+	_ = os.Chtimes(tusDataPath(stale.ID), old, old)
+
+	if removed := gcStagedUploads(time.Now()); removed != 1 {
+		t.Errorf("want 1 removed, got %d", removed)
+	}
+	if _, _, err := loadTusUpload(stale.ID); !errors.Is(err, errUploadNotFound) {
+		t.Errorf("stale upload should be gone, got %v", err)
+	}
+	if _, _, err := loadTusUpload(fresh.ID); err != nil {
+		t.Errorf("fresh upload should survive: %v", err)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	meta, err := parseTusMetadata("filename " + base64.StdEncoding.EncodeToString([]byte("a b.txt")) + ",is_confidential")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if meta["filename"] != "a b.txt" {
+		t.Errorf("want filename %q, got %q", "a b.txt", meta["filename"])
+	}
+	if _, ok := meta["is_confidential"]; !ok {
+		t.Error("key without value should be present")
+	}
+	if _, err := parseTusMetadata("filename !!!"); err == nil {
+		t.Error("want error for invalid base64")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Upload checksums
+// ---------------------------------------------------------------------------
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// postUploadWithHeader sends a single-file multipart upload with extra
+// request headers and optional extra form fields.
+func postUploadWithHeader(t *testing.T, base, filename string, content []byte, headers, fields map[string]string) (int, map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		_ = mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("file", filename)
+	_, _ = fw.Write(content)
+	mw.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, base+"/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /upload: %v", err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, decodeBody(t, resp.Body)
+}
+
+func TestUpload_ResponseHasSHA256(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	content := []byte("hello world")
+	_, body := postMultipart(t, base, "/upload", "hello.txt", content)
+	if body["sha256"] != sha256Hex(content) {
+		t.Errorf("want sha256 %s, got %v", sha256Hex(content), body["sha256"])
+	}
+}
+
+func TestUpload_MatchingChecksumHeader_Returns200(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	content := []byte("verified")
+	status, _ := postUploadWithHeader(t, base, "v.txt", content,
+		map[string]string{checksumHeader: strings.ToUpper(sha256Hex(content))}, nil)
+	if status != 200 {
+		t.Errorf("want 200, got %d", status)
+	}
+}
+
+func TestUpload_ChecksumMismatch_RejectsAndDeletes(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	status, body := postUploadWithHeader(t, base, "bad.txt", []byte("corrupted"), nil,
+		map[string]string{"sha256": sha256Hex([]byte("original"))})
+	if status != 422 {
+		t.Errorf("want 422, got %d", status)
+	}
+	if body["sha256"] != sha256Hex([]byte("corrupted")) {
+		t.Errorf("error body should report computed hash, got %v", body["sha256"])
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "bad.txt")); !os.IsNotExist(err) {
+		t.Error("mismatched upload should have been deleted")
+	}
+}
+
+func TestUpload_MalformedChecksum_Returns400(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	status, _ := postUploadWithHeader(t, base, "x.txt", []byte("x"),
+		map[string]string{checksumHeader: "not-a-hash"}, nil)
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+func TestListFiles_WithHash(t *testing.T) {
+	orig := shareDir
+	shareDir = t.TempDir()
+	t.Cleanup(func() { shareDir = orig })
+	_ = os.WriteFile(filepath.Join(shareDir, "a.txt"), []byte("aaa"), 0o644)
+
+	base := startServer(t)
+	for _, tc := range []struct {
+		query string
+		want  any
+	}{
+		{"", nil},
+		{"?hash=sha256", sha256Hex([]byte("aaa"))},
+	} {
+		resp, err := http.Get(base + "/list-files" + tc.query)
+		if err != nil {
+			t.Fatalf("GET /list-files%s: %v", tc.query, err)
+		}
+		var files []map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&files)
+		resp.Body.Close()
+		if len(files) != 1 || files[0]["sha256"] != tc.want {
+			t.Errorf("%q: want sha256=%v, got %+v", tc.query, tc.want, files)
+		}
+	}
+}
+
+func TestHashLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newHashLRU(2)
+	c.put(hashCacheEntry{path: "a", sum: "1"})
+	c.put(hashCacheEntry{path: "b", sum: "2"})
+	c.get("a")
+	c.put(hashCacheEntry{path: "c", sum: "3"})
+
+	if _, ok := c.get("b"); ok {
+		t.Error("b was least recently used and should be evicted")
+	}
+	for _, path := range []string{"a", "c"} {
+		if _, ok := c.get(path); !ok {
+			t.Errorf("%s should still be cached", path)
+		}
+	}
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Errorf("cache holds %d/%d entries, want 2", len(c.entries), c.order.Len())
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Upload conflict policies
+// ---------------------------------------------------------------------------
+
+func TestUpload_ConflictPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy     string
+		wantStatus int
+		wantBody   string // response "status"
+		wantStored string
+		wantOnDisk string // content of IMG_0001.jpg afterwards
+	}{
+		{"", 200, "success", "IMG_0001 (1).jpg", "old"},
+		{"rename", 200, "success", "IMG_0001 (1).jpg", "old"},
+		{"overwrite", 200, "success", "IMG_0001.jpg", "new"},
+		{"skip", 200, "skipped", "IMG_0001.jpg", "old"},
+		{"fail", 409, "error", "", "old"},
+	} {
+		t.Run("policy="+tc.policy, func(t *testing.T) {
+			useTempUploadDirs(t)
+			_ = os.WriteFile(filepath.Join(uploadDir, "IMG_0001.jpg"), []byte("old"), 0o644)
+			base := startServer(t)
+
+			status, body := postUploadWithHeader(t, base, "IMG_0001.jpg", []byte("new"), nil,
+				map[string]string{"conflict": tc.policy})
+			if status != tc.wantStatus {
+				t.Errorf("want %d, got %d (%v)", tc.wantStatus, status, body)
+			}
+			if body["status"] != tc.wantBody {
+				t.Errorf("want status=%s, got %v", tc.wantBody, body["status"])
+			}
+			if tc.wantStored != "" && body["stored_as"] != tc.wantStored {
+				t.Errorf("want stored_as=%q, got %v", tc.wantStored, body["stored_as"])
+			}
+			got, _ := os.ReadFile(filepath.Join(uploadDir, "IMG_0001.jpg"))
+			if string(got) != tc.wantOnDisk {
+				t.Errorf("original file: want %q, got %q", tc.wantOnDisk, got)
+			}
+		})
+	}
+}
+
+func TestUpload_RenamePicksNextFreeSuffix(t *testing.T) {
+	useTempUploadDirs(t)
+	_ = os.WriteFile(filepath.Join(uploadDir, "a.txt"), nil, 0o644)
+	_ = os.WriteFile(filepath.Join(uploadDir, "a (1).txt"), nil, 0o644)
+	base := startServer(t)
+
+	_, body := postMultipart(t, base, "/upload", "a.txt", []byte("third"))
+	if body["stored_as"] != "a (2).txt" {
+		t.Errorf("want stored_as=a (2).txt, got %v", body["stored_as"])
+	}
+}
+
+func TestUpload_InvalidConflictPolicy_Returns400(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	status, _ := postUploadWithHeader(t, base, "a.txt", []byte("x"), nil, map[string]string{"conflict": "merge"})
+	if status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+func TestUpload_LeavesNoPartialFiles(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	postUploadWithHeader(t, base, "bad.txt", []byte("data"), nil,
+		map[string]string{"sha256": sha256Hex([]byte("other"))})
+	postMultipart(t, base, "/upload", "good.txt", []byte("data"))
+
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 1 || entries[0].Name() != "good.txt" {
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("want only good.txt in uploadDir, got %v", names)
+	}
+}
+
+func TestTusUpload_AppliesConflictPolicy(t *testing.T) {
+	useTempUploadDirs(t)
+	_ = os.WriteFile(filepath.Join(uploadDir, "clip.mp4"), []byte("old"), 0o644)
+	base := startServer(t)
+
+	url := createTus(t, base, "clip.mp4", 3)
+	patchTus(t, url, 0, []byte("new"))
+
+	got, _ := os.ReadFile(filepath.Join(uploadDir, "clip (1).mp4"))
+	if string(got) != "new" {
+		t.Errorf("want renamed copy with new content, got %q", got)
+	}
+}
+
+func TestTusUpload_FailedCompletionKeepsData(t *testing.T) {
+	useTempUploadDirs(t)
+	// A non-empty directory in the way makes the overwrite rename fail.
+	_ = os.MkdirAll(filepath.Join(uploadDir, "clip.mp4", "x"), 0o755)
+	base := startServer(t)
+
+	resp := tusRequest(t, http.MethodPost, base+"/uploads", map[string]string{
+		"Upload-Length": "3",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("clip.mp4")) +
+			",conflict " + base64.StdEncoding.EncodeToString([]byte("overwrite")),
+	}, nil)
+	url := base + resp.Header.Get("Location")
+	if resp := patchTus(t, url, 0, []byte("new")); resp.StatusCode != 500 {
+		t.Fatalf("placing over a directory: want 500, got %d", resp.StatusCode)
+	}
+	head := tusRequest(t, http.MethodHead, url, nil, nil)
+	if head.StatusCode != 200 || head.Header.Get("Upload-Offset") != "3" {
+		t.Fatalf("data should stay staged: HEAD got %d offset=%q", head.StatusCode, head.Header.Get("Upload-Offset"))
+	}
+
+	// Retrying the final PATCH with another policy completes the upload.
+	if resp := patchTus(t, url+"?conflict=rename", 3, nil); resp.StatusCode != 204 {
+		t.Fatalf("retry: want 204, got %d", resp.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(uploadDir, "clip (1).mp4")); string(got) != "new" {
+		t.Errorf("want renamed copy with the staged data, got %q", got)
+	}
+}
+
+func TestTusUpload_ConflictFailKeepsData(t *testing.T) {
+	useTempUploadDirs(t)
+	_ = os.WriteFile(filepath.Join(uploadDir, "clip.mp4"), []byte("old"), 0o644)
+	base := startServer(t)
+
+	resp := tusRequest(t, http.MethodPost, base+"/uploads", map[string]string{
+		"Upload-Length": "3",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("clip.mp4")) +
+			",conflict " + base64.StdEncoding.EncodeToString([]byte("fail")),
+	}, nil)
+	url := base + resp.Header.Get("Location")
+	if resp := patchTus(t, url, 0, []byte("new")); resp.StatusCode != 409 {
+		t.Fatalf("name taken: want 409, got %d", resp.StatusCode)
+	}
+	if resp := patchTus(t, url+"?conflict=overwrite", 3, nil); resp.StatusCode != 204 {
+		t.Fatalf("retry with overwrite: want 204, got %d", resp.StatusCode)
+	}
+	if got, _ := os.ReadFile(filepath.Join(uploadDir, "clip.mp4")); string(got) != "new" {
+		t.Errorf("want the staged data to replace the file, got %q", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Multi-file and folder uploads
+// ---------------------------------------------------------------------------
+
+type uploadPart struct {
+	filename string
+	path     string
+	content  string
+}
+
+// postBatchUpload sends several "file" parts with matching "path" fields.
+func postBatchUpload(t *testing.T, base string, parts []uploadPart) (int, map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		fw, _ := mw.CreateFormFile("file", p.filename)
+		_, _ = fw.Write([]byte(p.content))
+	}
+	for _, p := range parts {
+		_ = mw.WriteField("path", p.path)
+	}
+	mw.Close()
+
+	resp, err := http.Post(base+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatalf("POST /upload: %v", err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, decodeBody(t, resp.Body)
+}
+
+func TestUpload_BatchWithRelativePaths(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	status, body := postBatchUpload(t, base, []uploadPart{
+		{"IMG_1.jpg", "Album/IMG_1.jpg", "one"},
+		{"IMG_2.jpg", "Album/2024/IMG_2.jpg", "two"},
+		{"notes.txt", "", "three"},
+	})
+	if status != 200 || body["status"] != "success" {
+		t.Fatalf("want 200 success, got %d %v", status, body)
+	}
+	files, _ := body["files"].([]any)
+	if len(files) != 3 {
+		t.Fatalf("want 3 results, got %v", body["files"])
+	}
+	for path, want := range map[string]string{
+		"Album/IMG_1.jpg":      "one",
+		"Album/2024/IMG_2.jpg": "two",
+		"notes.txt":            "three",
+	} {
+		got, err := os.ReadFile(filepath.Join(uploadDir, filepath.FromSlash(path)))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: want %q, got %q (%v)", path, want, got, err)
+		}
+	}
+	if second := files[1].(map[string]any); second["stored_as"] != filepath.FromSlash("Album/2024/IMG_2.jpg") {
+		t.Errorf("unexpected stored_as %v", second["stored_as"])
+	}
+}
+
+func TestUpload_BatchReportsPerFileErrors(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	status, body := postBatchUpload(t, base, []uploadPart{
+		{"ok.txt", "docs/ok.txt", "fine"},
+		{"evil.txt", "../../evil.txt", "nope"},
+		{"abs.txt", "/etc/abs.txt", "nope"},
+	})
+	if status != 200 || body["status"] != "partial" {
+		t.Fatalf("want 200 partial, got %d %v", status, body)
+	}
+	files := body["files"].([]any)
+	for i, want := range []string{"success", "error", "error"} {
+		if got := files[i].(map[string]any)["status"]; got != want {
+			t.Errorf("file %d: want %s, got %v", i, want, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(uploadDir), "evil.txt")); !os.IsNotExist(err) {
+		t.Error("traversal path must not write outside uploadDir")
+	}
+}
+
+func TestUpload_BatchRejectsSymlinkEscape(t *testing.T) {
+	useTempUploadDirs(t)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(uploadDir, "link")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+	base := startServer(t)
+
+	_, body := postBatchUpload(t, base, []uploadPart{
+		{"a.txt", "link/a.txt", "x"},
+		{"c.txt", "link/sub/c.txt", "z"},
+		{"b.txt", "b.txt", "y"},
+	})
+	files := body["files"].([]any)
+	for i := range 2 {
+		if files[i].(map[string]any)["status"] != "error" {
+			t.Errorf("symlinked directory escape should fail, got %v", files[i])
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "a.txt")); !os.IsNotExist(err) {
+		t.Error("file written through symlink outside uploadDir")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "sub")); !os.IsNotExist(err) {
+		t.Error("directory created through symlink outside uploadDir")
+	}
+}
+
+func TestUpload_BatchRequiresPathPerFile(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		fw, _ := mw.CreateFormFile("file", name)
+		_, _ = fw.Write([]byte(name))
+	}
+	_ = mw.WriteField("path", "Album/b.txt")
+	mw.Close()
+
+	resp, err := http.Post(base+"/upload", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatalf("POST /upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("want 400 when only some files have a path, got %d", resp.StatusCode)
+	}
+	if entries, _ := os.ReadDir(uploadDir); len(entries) != 0 {
+		t.Errorf("nothing should be stored, found %d entries", len(entries))
+	}
+}
+
+func TestUpload_BatchSendsOneNotification(t *testing.T) {
+	useTempUploadDirs(t)
+	notified := make(chan [2]string, 10)
+	orig := notifyFileReceived
+	notifyFileReceived = func(title, body string) { notified <- [2]string{title, body} }
+	t.Cleanup(func() { notifyFileReceived = orig })
+	base := startServer(t)
+
+	postBatchUpload(t, base, []uploadPart{
+		{"1.jpg", "1.jpg", "1"}, {"2.jpg", "2.jpg", "2"}, {"3.jpg", "3.jpg", "3"},
+		{"4.jpg", "4.jpg", "4"}, {"5.jpg", "5.jpg", "5"},
+	})
+	select {
+	case got := <-notified:
+		if got[0] != "5 files received" || got[1] != "1.jpg, 2.jpg, 3.jpg and 2 more" {
+			t.Errorf("unexpected notification %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no notification sent")
+	}
+	select {
+	case got := <-notified:
+		t.Errorf("want one notification per batch, got another: %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSafeRelPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		rel string
+		ok  bool
+	}{
+		{"a.txt", true},
+		{"Album/2024/a.jpg", true},
+		{`Album\a.jpg`, true},
+		{"../a.txt", false},
+		{"Album/../../a.txt", false},
+		{"/etc/passwd", false},
+		{"", false},
+		{".", false},
+	} {
+		got, err := safeRelPath(dir, tc.rel)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: want ok=%v, got %q, %v", tc.rel, tc.ok, got, err)
+		}
+		if err == nil && !strings.HasPrefix(got, dir+string(filepath.Separator)) {
+			t.Errorf("%q: result %q escapes %q", tc.rel, got, dir)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// PUT /files/upload/{name} — raw streaming upload
+// ---------------------------------------------------------------------------
+
+func putRaw(t *testing.T, url string, body io.Reader, headers map[string]string) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, decodeBody(t, resp.Body)
+}
+
+func TestRawUpload_StreamsToUploadDir(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	content := bytes.Repeat([]byte("video"), 1000)
+	status, body := putRaw(t, base+"/files/upload/clip.mp4", bytes.NewReader(content),
+		map[string]string{checksumHeader: sha256Hex(content)})
+	if status != 201 {
+		t.Fatalf("want 201, got %d (%v)", status, body)
+	}
+	if body["size"] != float64(len(content)) || body["stored_as"] != "clip.mp4" {
+		t.Errorf("unexpected body %v", body)
+	}
+	got, _ := os.ReadFile(filepath.Join(uploadDir, "clip.mp4"))
+	if !bytes.Equal(got, content) {
+		t.Error("stored content mismatch")
+	}
+}
+
+func TestRawUpload_WithoutContentLength_Returns411(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	// io.MultiReader hides the length, forcing chunked transfer encoding.
+	status, _ := putRaw(t, base+"/files/upload/a.bin", io.MultiReader(strings.NewReader("abc")), nil)
+	if status != 411 {
+		t.Errorf("want 411, got %d", status)
+	}
+}
+
+func TestRawUpload_TooLarge_Returns413(t *testing.T) {
+	useTempUploadDirs(t)
+	orig := maxRawUploadBytes
+	maxRawUploadBytes = 4
+	t.Cleanup(func() { maxRawUploadBytes = orig })
+	base := startServer(t)
+
+	status, _ := putRaw(t, base+"/files/upload/a.bin", strings.NewReader("too large"), nil)
+	if status != 413 {
+		t.Errorf("want 413, got %d", status)
+	}
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 0 {
+		t.Errorf("nothing should be written, found %d entries", len(entries))
+	}
+}
+
+func TestRawUpload_TruncatedBody_LeavesNoFile(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	fmt.Fprintf(conn, "PUT /files/upload/cut.bin HTTP/1.1\r\nHost: x\r\nContent-Length: 100\r\n\r\nonly-part")
+	conn.(*net.TCPConn).CloseWrite()
+	_, _ = io.ReadAll(conn)
+	conn.Close()
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "cut.bin")); !os.IsNotExist(err) {
+		t.Error("truncated upload must not be stored")
+	}
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 0 {
+		t.Errorf("temp file left behind: %d entries", len(entries))
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Upload quotas
+// ---------------------------------------------------------------------------
+
+// setQuotas overrides the upload guardrails for one test and gives it fresh
+// daily counters and a disk that always has plenty of space.
+func setQuotas(t *testing.T, fileMax, dirMax, minFree, dailyMax int64) {
+	t.Helper()
+	origFile, origDir, origFree, origDaily := maxUploadFileBytes, maxUploadDirBytes, minFreeDiskBytes, maxDailyUploadBytesPerClient
+	origDisk, origVolume := freeDiskBytes, dailyUploads
+	maxUploadFileBytes, maxUploadDirBytes, minFreeDiskBytes, maxDailyUploadBytesPerClient = fileMax, dirMax, minFree, dailyMax
+	freeDiskBytes = func(string) (int64, error) { return 1 << 40, nil }
+	dailyUploads = &uploadVolume{bytes: map[string]int64{}, now: time.Now}
+	t.Cleanup(func() {
+		maxUploadFileBytes, maxUploadDirBytes, minFreeDiskBytes, maxDailyUploadBytesPerClient = origFile, origDir, origFree, origDaily
+		freeDiskBytes, dailyUploads = origDisk, origVolume
+	})
+}
+
+func TestUploadQuota_FileTooLarge_Returns413(t *testing.T) {
+	useTempUploadDirs(t)
+	setQuotas(t, 10, 0, 0, 0)
+	base := startServer(t)
+
+	status, body := postMultipart(t, base, "/upload", "big.bin", bytes.Repeat([]byte("x"), 11))
+	if status != 413 || body["code"] != "file_too_large" {
+		t.Errorf("want 413 file_too_large, got %d %v", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "big.bin")); !os.IsNotExist(err) {
+		t.Error("rejected file must not be written")
+	}
+}
+
+func TestUploadQuota_DirFull_Returns507(t *testing.T) {
+	useTempUploadDirs(t)
+	setQuotas(t, 0, 1000, 0, 0)
+	_ = os.WriteFile(filepath.Join(uploadDir, "existing.bin"), bytes.Repeat([]byte("x"), 990), 0o644)
+	base := startServer(t)
+
+	status, body := postMultipart(t, base, "/upload", "more.bin", bytes.Repeat([]byte("y"), 50))
+	if status != 507 || body["code"] != "upload_dir_full" {
+		t.Errorf("want 507 upload_dir_full, got %d %v", status, body)
+	}
+	if body["limit"] != float64(1000) {
+		t.Errorf("want limit=1000, got %v", body["limit"])
+	}
+}
+
+func TestUploadQuota_LowDiskSpace_Returns507(t *testing.T) {
+	useTempUploadDirs(t)
+	setQuotas(t, 0, 0, 1<<20, 0)
+	freeDiskBytes = func(string) (int64, error) { return 1 << 20, nil }
+	base := startServer(t)
+
+	status, body := putRaw(t, base+"/files/upload/a.bin", strings.NewReader("abc"), nil)
+	if status != 507 || body["code"] != "insufficient_disk_space" {
+		t.Errorf("want 507 insufficient_disk_space, got %d %v", status, body)
+	}
+}
+
+func TestUploadQuota_MultipartWithoutContentLength_Returns411(t *testing.T) {
+	useTempUploadDirs(t)
+	base := startServer(t)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "a.bin")
+	_, _ = fw.Write([]byte("abc"))
+	mw.Close()
+
+	// io.MultiReader hides the length, forcing chunked transfer encoding.
+	resp, err := http.Post(base+"/upload", mw.FormDataContentType(), io.MultiReader(&buf))
+	if err != nil {
+		t.Fatalf("POST /upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 411 {
+		t.Errorf("want 411, got %d", resp.StatusCode)
+	}
+}
+
+func TestUploadQuota_BatchChecksFileLimitPerPart(t *testing.T) {
+	useTempUploadDirs(t)
+	setQuotas(t, 100, 0, 0, 0)
+	base := startServer(t)
+
+	status, body := postBatchUpload(t, base, []uploadPart{
+		{"a.bin", "a.bin", strings.Repeat("a", 60)},
+		{"b.bin", "b.bin", strings.Repeat("b", 60)},
+	})
+	if status != 200 || body["status"] != "success" {
+		t.Errorf("two files under the limit: want 200 success, got %d %v", status, body)
+	}
+
+	status, body = postBatchUpload(t, base, []uploadPart{
+		{"c.bin", "c.bin", strings.Repeat("c", 60)},
+		{"d.bin", "d.bin", strings.Repeat("d", 101)},
+	})
+	files, _ := body["files"].([]any)
+	if status != 200 || body["status"] != "partial" || len(files) != 2 {
+		t.Fatalf("want a partial batch, got %d %v", status, body)
+	}
+	if d, _ := files[1].(map[string]any); d["code"] != "file_too_large" {
+		t.Errorf("oversized part: want file_too_large, got %v", d)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "d.bin")); !os.IsNotExist(err) {
+		t.Errorf("oversized part must not be stored: %v", err)
+	}
+}
+
+func TestUploadQuota_ChecksDestinationFilesystem(t *testing.T) {
+	useTempUploadDirs(t)
+	dir := useTempBackupDir(t)
+	setQuotas(t, 0, 0, 1<<20, 0)
+	freeDiskBytes = func(path string) (int64, error) {
+		if path == dir {
+			return 1 << 20, nil
+		}
+		return 1 << 40, nil
+	}
+	base := startServer(t)
+
+	data := []byte("photo")
+	status, body := putRaw(t, base+"/backup/files/"+sha256Hex(data)+"?name=a.jpg", bytes.NewReader(data), nil)
+	if status != 507 || body["code"] != "insufficient_disk_space" {
+		t.Errorf("backup: want 507 insufficient_disk_space, got %d %v", status, body)
+	}
+	if status, _ := putRaw(t, base+"/files/upload/a.jpg", bytes.NewReader(data), nil); status != 201 {
+		t.Errorf("upload to uploadDir: want 201, got %d", status)
+	}
+}
+
+func TestUploadQuota_DailyVolumePerClient(t *testing.T) {
+	useTempUploadDirs(t)
+	setQuotas(t, 0, 0, 0, 10)
+	base := startServer(t)
+
+	phone := map[string]string{deviceIDHeader: "pixel"}
+	if status, _ := putRaw(t, base+"/files/upload/a.bin", strings.NewReader("12345678"), phone); status != 201 {
+		t.Fatalf("first upload: want 201, got %d", status)
+	}
+	status, body := putRaw(t, base+"/files/upload/b.bin", strings.NewReader("12345"), phone)
+	if status != 413 || body["code"] != "daily_quota_exceeded" {
+		t.Errorf("want 413 daily_quota_exceeded, got %d %v", status, body)
+	}
+
+	renamed := map[string]string{deviceIDHeader: "tablet"}
+	if status, _ := putRaw(t, base+"/files/upload/c.bin", strings.NewReader("12345"), renamed); status != 413 {
+		t.Errorf("a new %s must not reset the allowance, got %d", deviceIDHeader, status)
+	}
+	if used := dailyUploads.used("127.0.0.1"); used != 8 {
+		t.Errorf("want 8 bytes charged to the client address, got %d", used)
+	}
+}
+
+func TestUploadQuota_TusCreationChecksLength(t *testing.T) {
+	useTempUploadDirs(t)
+	setQuotas(t, 100, 0, 0, 0)
+	base := startServer(t)
+
+	resp := tusRequest(t, http.MethodPost, base+"/uploads", map[string]string{
+		"Upload-Length":   "101",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("a.bin")),
+	}, nil)
+	if resp.StatusCode != 413 {
+		t.Errorf("want 413, got %d", resp.StatusCode)
+	}
+}
+
+func TestUploadVolume_ResetsDaily(t *testing.T) {
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.Local)
+	v := &uploadVolume{bytes: map[string]int64{}, now: func() time.Time { return now }}
+	v.record("pixel", 100)
+	if v.used("pixel") != 100 {
+		t.Fatalf("want 100 used, got %d", v.used("pixel"))
+	}
+	now = now.Add(2 * time.Hour)
+	if got := v.used("pixel"); got != 0 {
+		t.Errorf("counter should reset on a new day, got %d", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Post-upload hooks
+// ---------------------------------------------------------------------------
+
+type hookCall struct {
+	name string
+	args []string
+}
+
+// useUploadHooks installs hooks with a fresh runner for one test and routes
+// external commands to run instead of executing them. Calls are returned
+// through the channel.
+func useUploadHooks(t *testing.T, hooks []uploadHook, run func(ctx context.Context) ([]byte, error)) <-chan hookCall {
+	t.Helper()
+	origHooks, origRunner, origCmd := uploadHooks, uploadHookRunner, runHookCommand
+	calls := make(chan hookCall, 10)
+	uploadHooks = hooks
+	uploadHookRunner = newHookRunner(1, 4, 10)
+	runHookCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		calls <- hookCall{name, args}
+		if run != nil {
+			return run(ctx)
+		}
+		return nil, nil
+	}
+	t.Cleanup(func() { uploadHooks, uploadHookRunner, runHookCommand = origHooks, origRunner, origCmd })
+	return calls
+}
+
+// waitForHookResult polls until the runner has recorded a result.
+func waitForHookResult(t *testing.T) hookResult {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if res := uploadHookRunner.recent(1); len(res) > 0 {
+			return res[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no hook result recorded")
+	return hookResult{}
+}
+
+func TestUploadHook_MovesMatchingMIME(t *testing.T) {
+	useTempUploadDirs(t)
+	docs := t.TempDir()
+	useUploadHooks(t, []uploadHook{{Name: "pdfs", MIME: "application/pdf", Action: hookActionMove, Target: docs}}, nil)
+	base := startServer(t)
+
+	if status, _ := postMultipart(t, base, "/upload", "report.pdf", []byte("%PDF-1.4")); status != 200 {
+		t.Fatalf("upload: want 200, got %d", status)
+	}
+	res := waitForHookResult(t)
+	if res.Status != "success" || res.Hook != "pdfs" {
+		t.Fatalf("want successful pdfs hook, got %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(docs, "report.pdf")); err != nil {
+		t.Errorf("file should be moved to target: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "report.pdf")); !os.IsNotExist(err) {
+		t.Error("file should no longer be in uploadDir")
+	}
+}
+
+func TestUploadHook_RunAppendsPath(t *testing.T) {
+	useTempUploadDirs(t)
+	calls := useUploadHooks(t, []uploadHook{
+		{Name: "pdfs", MIME: "application/pdf", Action: hookActionMove, Target: t.TempDir()},
+		{Name: "photos", MIME: "image/*", Action: hookActionRun, Command: []string{"/usr/bin/import", "--quiet"}},
+	}, nil)
+	base := startServer(t)
+
+	putRaw(t, base+"/files/upload/cat.png", bytes.NewReader(tinyPNG(t)), nil)
+	select {
+	case c := <-calls:
+		want := []string{"--quiet", filepath.Join(uploadDir, "cat.png")}
+		if c.name != "/usr/bin/import" || strings.Join(c.args, " ") != strings.Join(want, " ") {
+			t.Errorf("want /usr/bin/import %v, got %s %v", want, c.name, c.args)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run hook was not executed")
+	}
+	if res := waitForHookResult(t); res.Hook != "photos" {
+		t.Errorf("want photos hook, got %+v", res)
+	}
+}
+
+func TestUploadHook_OpensURLShortcut(t *testing.T) {
+	useTempUploadDirs(t)
+	calls := useUploadHooks(t, []uploadHook{{Name: "links", Glob: "*.url", Action: hookActionOpen}}, nil)
+	base := startServer(t)
+
+	putRaw(t, base+"/files/upload/site.url", strings.NewReader("[InternetShortcut]\nURL=https://example.com/page\n"), nil)
+	select {
+	case c := <-calls:
+		if c.name != "xdg-open" || len(c.args) != 1 || c.args[0] != "https://example.com/page" {
+			t.Errorf("want xdg-open https://example.com/page, got %s %v", c.name, c.args)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("open hook was not executed")
+	}
+}
+
+func TestUploadHook_TimeoutIsRecorded(t *testing.T) {
+	useTempUploadDirs(t)
+	useUploadHooks(t, []uploadHook{{Name: "slow", Glob: "*.txt", Action: hookActionRun, Command: []string{"sleep"}}},
+		func(ctx context.Context) ([]byte, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	uploadHookRunner.timeout = 50 * time.Millisecond
+	base := startServer(t)
+
+	putRaw(t, base+"/files/upload/a.txt", strings.NewReader("hi"), nil)
+	res := waitForHookResult(t)
+	if res.Status != "timeout" {
+		t.Errorf("want timeout, got %+v", res)
+	}
+
+	var results []hookResult
+	resp, err := http.Get(base + "/hooks/results?limit=5")
+	if err != nil {
+		t.Fatalf("GET /hooks/results: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil || len(results) != 1 || results[0].Status != "timeout" {
+		t.Errorf("GET /hooks/results: want one timeout result, got %v (%v)", results, err)
+	}
+}
+
+func TestUploadHook_NoMatchDoesNothing(t *testing.T) {
+	useTempUploadDirs(t)
+	useUploadHooks(t, []uploadHook{{Name: "zips", Glob: "*.zip", Action: hookActionExtract}}, nil)
+	base := startServer(t)
+
+	putRaw(t, base+"/files/upload/a.txt", strings.NewReader("hi"), nil)
+	time.Sleep(50 * time.Millisecond)
+	if res := uploadHookRunner.recent(10); len(res) != 0 {
+		t.Errorf("want no hook results, got %v", res)
+	}
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zip create: %v", err)
+		}
+		_, _ = w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractZip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photos.zip")
+	_ = os.WriteFile(path, makeZip(t, map[string]string{"a.txt": "A", "sub/b.txt": "B"}), 0o644)
+
+	dest, n, err := extractZip(context.Background(), path)
+	if err != nil || n != 2 || dest != filepath.Join(dir, "photos") {
+		t.Fatalf("want 2 files in photos/, got %d in %s (%v)", n, dest, err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dest, "sub", "b.txt")); string(b) != "B" {
+		t.Errorf("sub/b.txt: want B, got %q", b)
+	}
+}
+
+func TestExtractZip_RejectsPathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "evil.zip")
+	_ = os.WriteFile(path, makeZip(t, map[string]string{"../escaped.txt": "x"}), 0o644)
+
+	if _, _, err := extractZip(context.Background(), path); err == nil {
+		t.Error("want error for ../ entry")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Error("entry must not be written outside the extraction dir")
+	}
+}
+
+func TestExtractURL(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"a.url":    "[InternetShortcut]\nURL=https://example.com/a\n",
+		"b.webloc": `<plist><dict><key>URL</key><string>https://example.com/b</string></dict></plist>`,
+		"c.uri":    "# comment\nhttp://example.com/c\n",
+		"d.txt":    "javascript:alert(1)",
+		"e.txt":    "just some notes",
+	}
+	want := map[string]string{"a.url": "https://example.com/a", "b.webloc": "https://example.com/b", "c.uri": "http://example.com/c"}
+	for name, content := range cases {
+		path := filepath.Join(dir, name)
+		_ = os.WriteFile(path, []byte(content), 0o644)
+		if got := extractURL(path); got != want[name] {
+			t.Errorf("%s: want %q, got %q", name, want[name], got)
+		}
+	}
+}
+
+func TestValidateUploadHook(t *testing.T) {
+	bad := []uploadHook{
+		{Name: "no matcher", Action: hookActionOpen},
+		{Name: "bad glob", Glob: "[", Action: hookActionOpen},
+		{Name: "move no target", Glob: "*", Action: hookActionMove},
+		{Name: "run no command", Glob: "*", Action: hookActionRun},
+		{Name: "unknown", Glob: "*", Action: "delete"},
+	}
+	for _, h := range bad {
+		if err := validateUploadHook(h); err == nil {
+			t.Errorf("%s: want validation error", h.Name)
+		}
+	}
+	if err := validateUploadHook(uploadHook{Glob: "*.zip", Action: hookActionExtract}); err != nil {
+		t.Errorf("valid hook rejected: %v", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Camera-roll backup
+// ---------------------------------------------------------------------------
+
+// useTempBackupDir points the backup index at an empty directory.
+func useTempBackupDir(t *testing.T) string {
+	t.Helper()
+	orig := backups
+	backups = newBackupIndex(t.TempDir())
+	t.Cleanup(func() { backups = orig })
+	return backups.dir
+}
+
+// jpegWithExifDate builds a minimal little-endian JPEG whose Exif sub-IFD
+// carries DateTimeOriginal.
+func jpegWithExifDate(date string) []byte {
+	le := binary.LittleEndian
+	tiff := []byte("II*\x00")
+	tiff = le.AppendUint32(tiff, 8)
+	// IFD0 at 8: one entry pointing at the Exif IFD (at 26).
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = le.AppendUint16(tiff, exifTagExifIFD)
+	tiff = le.AppendUint16(tiff, 4) // LONG
+	tiff = le.AppendUint32(tiff, 1)
+	tiff = le.AppendUint32(tiff, 26)
+	tiff = le.AppendUint32(tiff, 0) // next IFD
+	// Exif IFD at 26: DateTimeOriginal, string at 44.
+	tiff = le.AppendUint16(tiff, 1)
+	tiff = le.AppendUint16(tiff, exifTagDateTimeOriginal)
+	tiff = le.AppendUint16(tiff, 2) // ASCII
+	tiff = le.AppendUint32(tiff, 20)
+	tiff = le.AppendUint32(tiff, 44)
+	tiff = le.AppendUint32(tiff, 0)
+	tiff = append(tiff, date+"\x00"...)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, 0xFF, 0xD9)
+}
+
+func postManifest(t *testing.T, base string, entries []backupManifestEntry) (int, map[string]any) {
+	t.Helper()
+	body, _ := json.Marshal(backupManifestPayload{Files: entries})
+	return post(t, base, "/backup/manifest", body)
+}
+
+func TestBackup_ManifestThenUploadFilesByExifDate(t *testing.T) {
+	useTempUploadDirs(t)
+	dir := useTempBackupDir(t)
+	base := startServer(t)
+
+	photo := jpegWithExifDate("2023:07:14 09:30:00")
+	sum := sha256Hex(photo)
+	status, body := postManifest(t, base, []backupManifestEntry{{Path: "DCIM/IMG_1.jpg", Size: int64(len(photo)), SHA256: sum}})
+	if missing, _ := body["missing"].([]any); status != 200 || len(missing) != 1 {
+		t.Fatalf("want one missing entry, got %d %v", status, body)
+	}
+
+	status, body = putRaw(t, base+"/backup/files/"+sum+"?name=IMG_1.jpg&mtime=0", bytes.NewReader(photo), nil)
+	if status != 201 || body["stored_as"] != "2023/07/IMG_1.jpg" {
+		t.Fatalf("want 201 stored in 2023/07, got %d %v", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2023", "07", "IMG_1.jpg")); err != nil {
+		t.Errorf("backed-up file missing: %v", err)
+	}
+
+	status, body = postManifest(t, base, []backupManifestEntry{{Path: "DCIM/IMG_1.jpg", SHA256: sum}})
+	if missing, _ := body["missing"].([]any); status != 200 || len(missing) != 0 || body["present"] != float64(1) {
+		t.Errorf("after upload nothing should be missing, got %d %v", status, body)
+	}
+}
+
+func TestBackup_DuplicateContentIsNotStoredTwice(t *testing.T) {
+	useTempUploadDirs(t)
+	dir := useTempBackupDir(t)
+	base := startServer(t)
+
+	data := []byte("same bytes")
+	sum := sha256Hex(data)
+	mtime := strconv.FormatInt(time.Date(2022, 3, 5, 12, 0, 0, 0, time.Local).UnixMilli(), 10)
+	if status, body := putRaw(t, base+"/backup/files/"+sum+"?name=a.bin&mtime="+mtime, bytes.NewReader(data), nil); status != 201 || body["stored_as"] != "2022/03/a.bin" {
+		t.Fatalf("want 201 filed by mtime, got %d %v", status, body)
+	}
+	status, body := putRaw(t, base+"/backup/files/"+sum+"?name=copy.bin", bytes.NewReader(data), nil)
+	if status != 200 || body["status"] != "exists" || body["stored_as"] != "2022/03/a.bin" {
+		t.Errorf("want 200 exists, got %d %v", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2022", "03", "copy.bin")); !os.IsNotExist(err) {
+		t.Error("duplicate content must not be stored again")
+	}
+}
+
+func TestBackup_ChecksumMismatch_Returns422(t *testing.T) {
+	useTempUploadDirs(t)
+	dir := useTempBackupDir(t)
+	base := startServer(t)
+
+	status, _ := putRaw(t, base+"/backup/files/"+sha256Hex([]byte("expected"))+"?name=a.bin", strings.NewReader("actual"), nil)
+	if status != 422 {
+		t.Errorf("want 422, got %d", status)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, ".incoming"))
+	if len(entries) != 0 {
+		t.Errorf("rejected upload left files behind: %v", entries)
+	}
+}
+
+func TestBackup_ManifestForgetsDeletedFilesInOneSave(t *testing.T) {
+	dir := useTempBackupDir(t)
+	var sums []string
+	for i := range 3 {
+		name := fmt.Sprintf("%d.jpg", i)
+		_ = os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644)
+		sums = append(sums, sha256Hex([]byte(name)))
+	}
+	if _, err := backups.missing(nil); err != nil { // builds the index
+		t.Fatalf("missing: %v", err)
+	}
+	for i := range 2 {
+		_ = os.Remove(filepath.Join(dir, fmt.Sprintf("%d.jpg", i)))
+	}
+	indexPath := filepath.Join(dir, backupIndexFile)
+	before, _ := os.Stat(indexPath)
+
+	got, err := backups.missing(sums)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("want 2 missing, got %v, %v", got, err)
+	}
+	if backups.dirty {
+		t.Error("index should be saved after the batch")
+	}
+	after, _ := os.Stat(indexPath)
+	if os.SameFile(before, after) {
+		t.Error("index file should have been rewritten")
+	}
+	var saved map[string]string
+	data, _ := os.ReadFile(indexPath)
+	_ = json.Unmarshal(data, &saved)
+	if len(saved) != 1 || saved[sums[2]] != "2.jpg" {
+		t.Errorf("saved index should only hold 2.jpg, got %v", saved)
+	}
+}
+
+func TestBackup_ManifestRejectsMissingHash(t *testing.T) {
+	useTempBackupDir(t)
+	base := startServer(t)
+
+	if status, _ := postManifest(t, base, []backupManifestEntry{{Path: "a.jpg"}}); status != 400 {
+		t.Errorf("want 400, got %d", status)
+	}
+}
+
+func TestBackupIndex_RebuildsFromExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "2021", "01"), 0o755)
+	_ = os.WriteFile(filepath.Join(dir, "2021", "01", "old.jpg"), []byte("old"), 0o644)
+
+	rel, ok, err := newBackupIndex(dir).lookup(sha256Hex([]byte("old")))
+	if err != nil || !ok || rel != "2021/01/old.jpg" {
+		t.Errorf("want 2021/01/old.jpg from rebuilt index, got %q %v %v", rel, ok, err)
+	}
+}
+
+func TestExifDate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	_ = os.WriteFile(path, jpegWithExifDate("2019:12:31 23:59:58"), 0o644)
+	got, ok := exifDate(path)
+	want := time.Date(2019, 12, 31, 23, 59, 58, 0, time.Local)
+	if !ok || !got.Equal(want) {
+		t.Errorf("want %v, got %v (%v)", want, got, ok)
+	}
+
+	_ = os.WriteFile(path, []byte("not a jpeg"), 0o644)
+	if _, ok := exifDate(path); ok {
+		t.Error("non-JPEG should have no EXIF date")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Share listing: subfolders, sorting, pagination
+// ---------------------------------------------------------------------------
+
+func useTempShareDir(t *testing.T) {
+	t.Helper()
+	orig := shareDir
+	shareDir = t.TempDir()
+	t.Cleanup(func() { shareDir = orig })
+}
+
+// listFiles fetches /list-files with query and returns the entries and the
+// next-page cursor.
+func listFiles(t *testing.T, base, query string) (int, []fileInfo, string) {
+	t.Helper()
+	resp, err := http.Get(base + "/list-files" + query)
+	if err != nil {
+		t.Fatalf("GET /list-files%s: %v", query, err)
+	}
+	defer resp.Body.Close()
+	var files []fileInfo
+	if resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+	}
+	return resp.StatusCode, files, resp.Header.Get(nextCursorHeader)
+}
+
+func TestListFiles_DirectoriesAndSubpaths(t *testing.T) {
+	useTempShareDir(t)
+	_ = os.MkdirAll(filepath.Join(shareDir, "Music", "Live"), 0o755)
+	_ = os.WriteFile(filepath.Join(shareDir, "Music", "song.mp3"), []byte("ID3"), 0o644)
+	_ = os.WriteFile(filepath.Join(shareDir, "notes.txt"), []byte("hi"), 0o644)
+	base := startServer(t)
+
+	_, files, _ := listFiles(t, base, "")
+	if len(files) != 2 || files[0].Name != "Music" || files[0].Type != "dir" || files[0].Children == nil || *files[0].Children != 2 {
+		t.Fatalf("want Music dir with 2 children first, got %+v", files)
+	}
+	if files[1].MIME != "text/plain" {
+		t.Errorf("notes.txt: want text/plain, got %q", files[1].MIME)
+	}
+
+	_, files, _ = listFiles(t, base, "?path=Music")
+	if len(files) != 2 || files[1].Path != "Music/song.mp3" || files[1].MIME != "audio/mpeg" {
+		t.Fatalf("want Music/song.mp3 as audio/mpeg, got %+v", files)
+	}
+
+	resp, err := http.Get(base + "/download/Music/song.mp3")
+	if err != nil {
+		t.Fatalf("GET /download/Music/song.mp3: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("download from subfolder: want 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestListFiles_RejectsEscapingPaths(t *testing.T) {
+	useTempShareDir(t)
+	outside := t.TempDir()
+	_ = os.Symlink(outside, filepath.Join(shareDir, "link"))
+	base := startServer(t)
+
+	for _, q := range []string{"?path=../", "?path=a/../..", "?path=link"} {
+		if status, _, _ := listFiles(t, base, q); status != 400 {
+			t.Errorf("%s: want 400, got %d", q, status)
+		}
+	}
+	if status, _, _ := listFiles(t, base, "?path=missing"); status != 404 {
+		t.Errorf("missing dir: want 404, got %d", status)
+	}
+}
+
+func TestListFiles_SortAndPaginate(t *testing.T) {
+	useTempShareDir(t)
+	now := time.Now()
+	for i, name := range []string{"b.bin", "a.bin", "c.bin"} {
+		path := filepath.Join(shareDir, name)
+		_ = os.WriteFile(path, bytes.Repeat([]byte("x"), 10*(i+1)), 0o644)
+		_ = os.Chtimes(path, now, now.Add(time.Duration(i)*time.Minute))
+	}
+	base := startServer(t)
+
+	_, files, _ := listFiles(t, base, "?sort=size&order=desc")
+	if len(files) != 3 || files[0].Name != "c.bin" || files[2].Name != "b.bin" {
+		t.Errorf("size desc: got %+v", files)
+	}
+
+	var names []string
+	query := "?sort=mtime&limit=2"
+	for page := 0; page < 3; page++ {
+		status, files, next := listFiles(t, base, query)
+		if status != 200 {
+			t.Fatalf("page %d: status %d", page, status)
+		}
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		if next == "" {
+			break
+		}
+		query = "?sort=mtime&limit=2&cursor=" + next
+	}
+	if strings.Join(names, ",") != "b.bin,a.bin,c.bin" {
+		t.Errorf("mtime pages: want b.bin,a.bin,c.bin, got %v", names)
+	}
+
+	if status, _, _ := listFiles(t, base, "?sort=colour"); status != 400 {
+		t.Errorf("bad sort: want 400, got %d", status)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// POST /download/archive
+// ---------------------------------------------------------------------------
+
+func postArchive(t *testing.T, base string, payload archivePayload) (*http.Response, []byte) {
+	t.Helper()
+	body, _ := json.Marshal(payload)
+	resp, err := http.Post(base+"/download/archive", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /download/archive: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, data
+}
+
+func TestDownloadArchive_FilesAndFolder(t *testing.T) {
+	useTempShareDir(t)
+	_ = os.MkdirAll(filepath.Join(shareDir, "Photos", "2024"), 0o755)
+	_ = os.WriteFile(filepath.Join(shareDir, "notes.txt"), []byte(strings.Repeat("note ", 100)), 0o644)
+	_ = os.WriteFile(filepath.Join(shareDir, "Photos", "a.jpg"), []byte("jpeg-a"), 0o644)
+	_ = os.WriteFile(filepath.Join(shareDir, "Photos", "2024", "b.jpg"), []byte("jpeg-b"), 0o644)
+	base := startServer(t)
+
+	resp, data := postArchive(t, base, archivePayload{Files: []string{"notes.txt"}, Path: "Photos", Name: "bundle"})
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("want 200 application/zip, got %d %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), data)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, "bundle.zip") {
+		t.Errorf("want bundle.zip in Content-Disposition, got %q", cd)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("response is not a valid zip: %v", err)
+	}
+	methods := map[string]uint16{}
+	for _, f := range zr.File {
+		methods[f.Name] = f.Method
+		// Java's ZipInputStream rejects stored entries with a data descriptor.
+		if f.Method == zip.Store && f.Flags&0x8 != 0 {
+			t.Errorf("%s: stored entry must not use a data descriptor", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+		rc.Close()
+	}
+	want := map[string]uint16{"notes.txt": zip.Deflate, "Photos/a.jpg": zip.Store, "Photos/2024/b.jpg": zip.Store}
+	if len(methods) != len(want) {
+		t.Fatalf("want entries %v, got %v", want, methods)
+	}
+	for name, method := range want {
+		if got, ok := methods[name]; !ok || got != method {
+			t.Errorf("%s: want method %d, got %d (present %v)", name, method, got, ok)
+		}
+	}
+}
+
+func TestDownloadArchive_MissingFile_Returns404(t *testing.T) {
+	useTempShareDir(t)
+	base := startServer(t)
+
+	if resp, _ := postArchive(t, base, archivePayload{Files: []string{"nope.txt"}}); resp.StatusCode != 404 {
+		t.Errorf("want 404, got %d", resp.StatusCode)
+	}
+	if resp, _ := postArchive(t, base, archivePayload{Files: []string{"../etc/passwd"}}); resp.StatusCode != 400 {
+		t.Errorf("traversal: want 400, got %d", resp.StatusCode)
+	}
+	if resp, _ := postArchive(t, base, archivePayload{}); resp.StatusCode != 400 {
+		t.Errorf("empty selection: want 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestDownloadArchive_StopsWhenClientDisconnects(t *testing.T) {
+	useTempShareDir(t)
+	for i := 0; i < 5; i++ {
+		_ = os.WriteFile(filepath.Join(shareDir, fmt.Sprintf("f%d.bin", i)), []byte("data"), 0o644)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/download/archive", nil).WithContext(ctx)
+	entries, err := collectArchiveEntries(archivePayload{Files: []string{"f0.bin", "f1.bin"}})
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if _, err := writeZipArchive(req, io.Discard, entries); !errors.Is(err, context.Canceled) {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Share file management: delete, rename, move
+// ---------------------------------------------------------------------------
+
+func useTempTrash(t *testing.T) string {
+	t.Helper()
+	orig := trashDir
+	trashDir = t.TempDir()
+	t.Cleanup(func() { trashDir = orig })
+	return trashDir
+}
+
+func doRequest(t *testing.T, method, url string, body []byte) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, decodeBody(t, resp.Body)
+}
+
+func TestMoveDir_AcrossFilesystems(t *testing.T) {
+	src, err := os.MkdirTemp("/dev/shm", "movedir-")
+	if err != nil {
+		t.Skip("no /dev/shm:", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(src) })
+	dst := filepath.Join(t.TempDir(), "moved")
+	if s, d := statDev(t, src), statDev(t, filepath.Dir(dst)); s == d {
+		t.Skip("/dev/shm and the temp dir share a filesystem")
+	}
+	_ = os.MkdirAll(filepath.Join(src, "sub"), 0o755)
+	_ = os.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("a"), 0o600)
+	_ = os.Symlink("sub/a.txt", filepath.Join(src, "link"))
+
+	if err := moveDir(src, dst); err != nil {
+		t.Fatalf("moveDir: %v", err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source should be gone, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "link")); string(data) != "a" {
+		t.Errorf("want tree with file and symlink copied, got %q", data)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "sub", "a.txt")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("want mode kept, got %v %v", info, err)
+	}
+}
+
+// statDev returns the device number of the filesystem holding path.
+func statDev(t *testing.T, path string) uint64 {
+	t.Helper()
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return uint64(st.Dev)
+}
+
+func TestDeleteFile_MovesToTrash(t *testing.T) {
+	useTempShareDir(t)
+	trash := useTempTrash(t)
+	_ = os.MkdirAll(filepath.Join(shareDir, "Docs"), 0o755)
+	_ = os.WriteFile(filepath.Join(shareDir, "Docs", "old report.pdf"), []byte("pdf"), 0o644)
+	base := startServer(t)
+
+	status, body := doRequest(t, http.MethodDelete, base+"/files/"+url.PathEscape("Docs/old report.pdf"), nil)
+	if status != 200 || body["trashed"] != true {
+		t.Fatalf("want 200 trashed, got %d %v", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(trash, "files", "old report.pdf")); err != nil {
+		t.Errorf("file not in trash: %v", err)
+	}
+	info, err := os.ReadFile(filepath.Join(trash, "info", "old report.pdf.trashinfo"))
+	if err != nil || !strings.Contains(string(info), "Path="+trashInfoPath(filepath.Join(shareDir, "Docs", "old report.pdf"))) ||
+		!strings.Contains(string(info), "old%20report.pdf") {
+		t.Errorf("bad trashinfo: %q (%v)", info, err)
+	}
+}
+
+func TestDeleteFile_Permanent(t *testing.T) {
+	useTempShareDir(t)
+	trash := useTempTrash(t)
+	_ = os.MkdirAll(filepath.Join(shareDir, "dir"), 0o755)
+	_ = os.WriteFile(filepath.Join(shareDir, "dir", "x.txt"), []byte("x"), 0o644)
+	base := startServer(t)
+
+	if status, _ := doRequest(t, http.MethodDelete, base+"/files/dir?trash=false", nil); status != 409 {
+		t.Errorf("non-empty dir without recursive: want 409, got %d", status)
+	}
+	if status, _ := doRequest(t, http.MethodDelete, base+"/files/dir?trash=false&recursive=true", nil); status != 200 {
+		t.Errorf("recursive delete: want 200, got %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(shareDir, "dir")); !os.IsNotExist(err) {
+		t.Error("dir should be gone")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(trash, "files")); len(entries) != 0 {
+		t.Errorf("permanent delete must not use the trash, found %v", entries)
+	}
+	if status, _ := doRequest(t, http.MethodDelete, base+"/files/missing.txt", nil); status != 404 {
+		t.Errorf("missing: want 404, got %d", status)
+	}
+	if status, _ := doRequest(t, http.MethodDelete, base+"/files/"+url.PathEscape("../x"), nil); status != 400 {
+		t.Errorf("traversal: want 400, got %d", status)
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	useTempShareDir(t)
+	_ = os.WriteFile(filepath.Join(shareDir, "a.txt"), []byte("a"), 0o644)
+	_ = os.WriteFile(filepath.Join(shareDir, "b.txt"), []byte("b"), 0o644)
+	base := startServer(t)
+
+	status, _ := post(t, base, "/files/a.txt/rename", []byte(`{"new_name":"b.txt"}`))
+	if status != 409 {
+		t.Errorf("taken name: want 409, got %d", status)
+	}
+	status, body := post(t, base, "/files/a.txt/rename", []byte(`{"new_name":"b.txt","conflict":"rename"}`))
+	if status != 200 || body["path"] != "b (1).txt" {
+		t.Errorf("rename policy: want b (1).txt, got %d %v", status, body)
+	}
+	if status, _ := post(t, base, "/files/b.txt/rename", []byte(`{"new_name":"../c.txt"}`)); status != 400 {
+		t.Errorf("path in new_name: want 400, got %d", status)
+	}
+	if got, _ := os.ReadFile(filepath.Join(shareDir, "b (1).txt")); string(got) != "a" {
+		t.Errorf("renamed content: want a, got %q", got)
+	}
+}
+
+func TestMoveFile_UploadToShare(t *testing.T) {
+	useTempUploadDirs(t)
+	useTempShareDir(t)
+	_ = os.WriteFile(filepath.Join(uploadDir, "photo.jpg"), []byte("jpg"), 0o644)
+	base := startServer(t)
+
+	status, body := post(t, base, "/files/move", []byte(`{"name":"photo.jpg","from":"upload","to":"share","dest":"Album"}`))
+	if status != 200 || body["path"] != "Album/photo.jpg" {
+		t.Fatalf("want Album/photo.jpg, got %d %v", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "photo.jpg")); !os.IsNotExist(err) {
+		t.Error("source should be gone after move")
+	}
+
+	_ = os.WriteFile(filepath.Join(uploadDir, "photo.jpg"), []byte("jpg2"), 0o644)
+	status, _ = post(t, base, "/files/move", []byte(`{"name":"photo.jpg","from":"upload","to":"share","dest":"Album","conflict":"fail"}`))
+	if status != 409 {
+		t.Errorf("conflict fail: want 409, got %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "photo.jpg")); err != nil {
+		t.Errorf("failed move must leave the source in place: %v", err)
+	}
+	if status, _ := post(t, base, "/files/move", []byte(`{"name":"photo.jpg","from":"upload","to":"elsewhere"}`)); status != 400 {
+		t.Errorf("bad root: want 400, got %d", status)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// GET /thumbnail/{filename}
+// ---------------------------------------------------------------------------
+
+func useTempThumbnailCache(t *testing.T, max int64) {
+	t.Helper()
+	orig := thumbnails
+	thumbnails = newThumbnailCache(t.TempDir(), max)
+	t.Cleanup(func() { thumbnails = orig })
+}
+
+func writeTestJPEG(t *testing.T, path string, w, h int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	_ = os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+func TestThumbnail_ScalesAndCachesImages(t *testing.T) {
+	useTempShareDir(t)
+	useTempThumbnailCache(t, 1<<20)
+	path := filepath.Join(shareDir, "wide.jpg")
+	writeTestJPEG(t, path, 400, 200)
+	base := startServer(t)
+
+	fetch := func() image.Image {
+		t.Helper()
+		resp, err := http.Get(base + "/thumbnail/wide.jpg?size=100")
+		if err != nil {
+			t.Fatalf("GET /thumbnail: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("want 200 image/jpeg, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		img, _, err := image.Decode(resp.Body)
+		if err != nil {
+			t.Fatalf("decode thumbnail: %v", err)
+		}
+		return img
+	}
+
+	if b := fetch().Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Errorf("want 100x50, got %dx%d", b.Dx(), b.Dy())
+	}
+	if entries, _ := os.ReadDir(thumbnails.dir); len(entries) != 1 {
+		t.Fatalf("want one cached thumbnail, got %d", len(entries))
+	}
+
+	// Changing the source invalidates the cached thumbnail.
+	writeTestJPEG(t, path, 100, 400)
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(path, later, later)
+	if b := fetch().Bounds(); b.Dx() != 25 || b.Dy() != 100 {
+		t.Errorf("after edit: want 25x100, got %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestThumbnail_TextPreviewAndIcon(t *testing.T) {
+	useTempShareDir(t)
+	useTempThumbnailCache(t, 1<<20)
+	_ = os.WriteFile(filepath.Join(shareDir, "notes.txt"), []byte(strings.Repeat("line\n", 100)), 0o644)
+	_ = os.WriteFile(filepath.Join(shareDir, "clip.mp4"), []byte("not really"), 0o644)
+	base := startServer(t)
+
+	status, body := get(t, base, "/thumbnail/notes.txt")
+	preview, _ := body["preview"].(string)
+	if status != 200 || body["type"] != "text" || body["truncated"] != true || strings.Count(preview, "\n") != maxTextPreviewLines {
+		t.Errorf("want truncated text preview of %d lines, got %d %v", maxTextPreviewLines, status, body)
+	}
+
+	status, body = get(t, base, "/thumbnail/clip.mp4")
+	if status != 200 || body["type"] != "icon" || body["icon"] != "video" {
+		t.Errorf("want video icon hint, got %d %v", status, body)
+	}
+
+	if status, _ := get(t, base, "/thumbnail/missing.jpg"); status != 404 {
+		t.Errorf("missing: want 404, got %d", status)
+	}
+}
+
+func TestTextPreview_InvalidBytesAndSplitRunes(t *testing.T) {
+	dir := t.TempDir()
+	latin1 := filepath.Join(dir, "latin1.txt")
+	_ = os.WriteFile(latin1, []byte("caf\xe9 au lait\n"+strings.Repeat("x", 100)), 0o644)
+	if preview, _, err := textPreview(latin1); err != nil || !strings.HasPrefix(preview, "caf\uFFFD au lait\n") || !strings.HasSuffix(preview, "xxx") {
+		t.Errorf("stray byte should be replaced, not empty the preview: %q, %v", preview, err)
+	}
+
+	// "a" then two-byte runes: the cut at maxTextPreviewBytes splits one.
+	split := filepath.Join(dir, "split.txt")
+	_ = os.WriteFile(split, []byte("a"+strings.Repeat("é", maxTextPreviewBytes)), 0o644)
+	preview, truncated, err := textPreview(split)
+	if err != nil || !truncated || strings.ContainsRune(preview, utf8.RuneError) || len(preview) != maxTextPreviewBytes-1 {
+		t.Errorf("want the split rune dropped, got %d bytes, truncated=%v, %v", len(preview), truncated, err)
+	}
+}
+
+// genericImage hides an image's concrete type so scaleToFit takes the At
+// path.
+type genericImage struct{ image.Image }
+
+func TestScaleToFit_FastPathsMatchAt(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	gray := image.NewGray(rgba.Bounds())
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			rgba.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(x + y), 0xFF})
+			gray.Set(x, y, color.Gray{uint8(x * 3)})
+		}
+	}
+	ycc := image.NewYCbCr(rgba.Bounds(), image.YCbCrSubsampleRatio420)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			ycc.Y[ycc.YOffset(x, y)] = uint8(x * 4)
+			ycc.Cb[ycc.COffset(x, y)] = uint8(y * 5)
+			ycc.Cr[ycc.COffset(x, y)] = 128
+		}
+	}
+	for name, img := range map[string]image.Image{"rgba": rgba, "gray": gray, "ycbcr": ycc} {
+		fast, slow := scaleToFit(img, 16), scaleToFit(genericImage{img}, 16)
+		if !bytes.Equal(fast.Pix, slow.Pix) {
+			t.Errorf("%s: fast path differs from At", name)
+		}
+	}
+}
+
+func TestRenderThumbnail_GivesUpWhenNoSlotFrees(t *testing.T) {
+	for range maxThumbnailRenders {
+		thumbnailRenders <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for range maxThumbnailRenders {
+			<-thumbnailRenders
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := renderThumbnail(ctx, "unused.jpg", 64); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded while renders are busy, got %v", err)
+	}
+}
+
+func TestThumbnailCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newThumbnailCache(t.TempDir(), 250)
+	c.put("a", bytes.Repeat([]byte("a"), 100))
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(filepath.Join(c.dir, "a"), old, old)
+	c.put("b", bytes.Repeat([]byte("b"), 100))
+	_ = os.Chtimes(filepath.Join(c.dir, "b"), old.Add(time.Minute), old.Add(time.Minute))
+	if _, ok := c.get("a"); !ok { // a becomes most recently used
+		t.Fatal("a should be cached")
+	}
+	c.put("c", bytes.Repeat([]byte("c"), 100))
+
+	if _, ok := c.get("b"); ok {
+		t.Error("b was least recently used and should be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("a should survive eviction")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Error("c should be cached")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Share directory change feed
+// ---------------------------------------------------------------------------
+
+// startShareWatcher watches a fresh directory and returns it with a channel
+// of emitted events.
+func startShareWatcher(t *testing.T) (string, <-chan shareEvent) {
+	t.Helper()
+	dir := t.TempDir()
+	events := make(chan shareEvent, 50)
+	w, err := newShareWatcher(dir, func(e shareEvent) { events <- e })
+	if err != nil {
+		t.Fatalf("newShareWatcher: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { _ = w.run(ctx); close(done) }()
+	t.Cleanup(func() { cancel(); <-done })
+	return dir, events
+}
+
+func nextShareEvent(t *testing.T, events <-chan shareEvent) shareEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for share event")
+	}
+	return shareEvent{}
+}
+
+func expectNoShareEvent(t *testing.T, events <-chan shareEvent) {
+	t.Helper()
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestShareWatcher_DebouncesWritesUntilClose(t *testing.T) {
+	dir, events := startShareWatcher(t)
+
+	f, err := os.Create(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		_, _ = f.Write(bytes.Repeat([]byte("x"), 1000))
+	}
+	time.Sleep(shareWatchSettleDelay + 200*time.Millisecond)
+	expectNoShareEvent(t, events)
+	f.Close()
+
+	if e := nextShareEvent(t, events); e.Type != shareEventCreated || e.Path != "big.bin" || e.Size != 5000 {
+		t.Errorf("want one created big.bin of 5000 bytes, got %+v", e)
+	}
+	expectNoShareEvent(t, events)
+
+	_ = os.WriteFile(filepath.Join(dir, "big.bin"), []byte("short"), 0o644)
+	if e := nextShareEvent(t, events); e.Type != shareEventModified || e.Size != 5 {
+		t.Errorf("want modified big.bin, got %+v", e)
+	}
+
+	_ = os.Remove(filepath.Join(dir, "big.bin"))
+	if e := nextShareEvent(t, events); e.Type != shareEventDeleted || e.Path != "big.bin" {
+		t.Errorf("want deleted big.bin, got %+v", e)
+	}
+}
+
+func TestShareWatcher_WatchesNewSubdirectories(t *testing.T) {
+	dir, events := startShareWatcher(t)
+
+	_ = os.Mkdir(filepath.Join(dir, "Album"), 0o755)
+	if e := nextShareEvent(t, events); e.Type != shareEventCreated || e.Path != "Album" || !e.IsDir {
+		t.Fatalf("want created dir Album, got %+v", e)
+	}
+	_ = os.WriteFile(filepath.Join(dir, "Album", "a.jpg"), []byte("jpg"), 0o644)
+	if e := nextShareEvent(t, events); e.Type != shareEventCreated || e.Path != "Album/a.jpg" {
+		t.Errorf("want created Album/a.jpg, got %+v", e)
+	}
+}
+
+func TestShareWatcher_ReportsHardLinkedPlacement(t *testing.T) {
+	dir, events := startShareWatcher(t)
+
+	// Mirrors placeFile: write a hidden temp file, link it into place.
+	tmp := filepath.Join(dir, ".partial-1")
+	_ = os.WriteFile(tmp, []byte("data"), 0o644)
+	_ = os.Link(tmp, filepath.Join(dir, "placed.txt"))
+	_ = os.Remove(tmp)
+
+	var got []string
+	deadline := time.After(3 * time.Second)
+	for len(got) == 0 || got[len(got)-1] != "created placed.txt" {
+		select {
+		case e := <-events:
+			got = append(got, e.Type+" "+e.Path)
+		case <-deadline:
+			t.Fatalf("want created placed.txt, got %v", got)
+		}
+	}
+}
+
+func TestShareWatcher_IgnoresHiddenDirectories(t *testing.T) {
+	dir, events := startShareWatcher(t)
+
+	_ = os.Mkdir(filepath.Join(dir, "Photos"), 0o755)
+	nextShareEvent(t, events)
+	staging := filepath.Join(dir, "Photos", ".sync_staging")
+	_ = os.Mkdir(staging, 0o755)
+	// Reported here, but dropped by publishShareEvent below.
+	if e := nextShareEvent(t, events); e.Path != "Photos/.sync_staging" {
+		t.Fatalf("want created Photos/.sync_staging, got %+v", e)
+	}
+	_ = os.WriteFile(filepath.Join(staging, "abc123"), []byte("data"), 0o644)
+	_ = os.Remove(filepath.Join(staging, "abc123"))
+	time.Sleep(shareWatchSettleDelay + 100*time.Millisecond)
+	expectNoShareEvent(t, events)
+
+	orig := shareEvents
+	shareEvents = newShareEventLog(10)
+	t.Cleanup(func() { shareEvents = orig })
+	for _, p := range []string{"Photos/.sync_staging", "Photos/.sync_staging/abc123", ".partial-1"} {
+		publishShareEvent(shareEvent{Type: shareEventCreated, Path: p})
+	}
+	publishShareEvent(shareEvent{Type: shareEventCreated, Path: "Photos/a.jpg"})
+	if got := shareEvents.after(0); len(got) != 1 || got[0].Path != "Photos/a.jpg" {
+		t.Errorf("want only Photos/a.jpg published, got %+v", got)
+	}
+}
+
+func TestShareEvents_StreamReplaysAfterLastEventID(t *testing.T) {
+	orig := shareEvents
+	shareEvents = newShareEventLog(10)
+	t.Cleanup(func() { shareEvents = orig })
+	first := shareEvents.push(shareEvent{Type: shareEventCreated, Path: "a.txt"})
+	shareEvents.push(shareEvent{Type: shareEventDeleted, Path: "b.txt"})
+
+	base := startServer(t)
+	req, _ := http.NewRequest(http.MethodGet, base+"/files/events", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(first.ID, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /files/events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	var eventType string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			eventType = strings.TrimPrefix(line, "event: ")
+		}
+		if strings.HasPrefix(line, "data: ") {
+			var e shareEvent
+			_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+			if eventType != shareEventDeleted || e.Path != "b.txt" {
+				t.Errorf("want only the deleted b.txt event, got %s %+v", eventType, e)
+			}
+			return
+		}
+	}
+	t.Fatal("stream ended without events")
+}
+
+// ---------------------------------------------------------------------------
+// Share links
+// ---------------------------------------------------------------------------
+
+func resetShareLinks(t *testing.T) {
+	t.Helper()
+	orig := shareLinks
+	shareLinks = newShareLinkStore(10)
+	t.Cleanup(func() { shareLinks = orig })
+}
+
+// createShareLink posts payload and returns the link's URL path.
+func createShareLink(t *testing.T, base, payload string) string {
+	t.Helper()
+	status, body := post(t, base, "/share-links", []byte(payload))
+	if status != 201 {
+		t.Fatalf("POST /share-links: want 201, got %d %v", status, body)
+	}
+	u, err := url.Parse(body["url"].(string))
+	if err != nil {
+		t.Fatalf("bad url %v: %v", body["url"], err)
+	}
+	return u.Path
+}
+
+func fetchStatus(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestShareLink_DownloadAndCount(t *testing.T) {
+	useTempShareDir(t)
+	resetShareLinks(t)
+	_ = os.WriteFile(filepath.Join(shareDir, "slides.pdf"), []byte("%PDF"), 0o644)
+	base := startServer(t)
+
+	path := createShareLink(t, base, `{"path":"slides.pdf"}`)
+	resp, err := http.Get(base + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(data) != "%PDF" || !strings.Contains(resp.Header.Get("Content-Disposition"), "slides.pdf") {
+		t.Fatalf("want slides.pdf attachment, got %d %q %q", resp.StatusCode, data, resp.Header.Get("Content-Disposition"))
+	}
+	if status := fetchStatus(t, base+path); status != 200 {
+		t.Errorf("reusable link: want 200 on second fetch, got %d", status)
+	}
+	if links := shareLinks.list(); len(links) != 1 || links[0].Downloads != 2 {
+		t.Errorf("want 2 downloads counted, got %+v", links)
+	}
+}
+
+func TestShareLink_SingleUseAndRevoke(t *testing.T) {
+	useTempShareDir(t)
+	resetShareLinks(t)
+	_ = os.WriteFile(filepath.Join(shareDir, "a.txt"), []byte("a"), 0o644)
+	base := startServer(t)
+
+	once := createShareLink(t, base, `{"path":"a.txt","single_use":true}`)
+	if status := fetchStatus(t, base+once); status != 200 {
+		t.Fatalf("first use: want 200, got %d", status)
+	}
+	if status := fetchStatus(t, base+once); status != 410 {
+		t.Errorf("second use: want 410, got %d", status)
+	}
+
+	revoked := createShareLink(t, base, `{"path":"a.txt"}`)
+	token := strings.TrimPrefix(revoked, "/s/")
+	if status, _ := doRequest(t, http.MethodDelete, base+"/share-links/"+token, nil); status != 204 {
+		t.Errorf("revoke: want 204, got %d", status)
+	}
+	if status := fetchStatus(t, base+revoked); status != 404 {
+		t.Errorf("revoked link: want 404, got %d", status)
+	}
+}
+
+func TestShareLink_SingleUseSurvivesHeadAndMissingFile(t *testing.T) {
+	useTempShareDir(t)
+	resetShareLinks(t)
+	file := filepath.Join(shareDir, "a.txt")
+	_ = os.WriteFile(file, []byte("a"), 0o644)
+	base := startServer(t)
+
+	once := createShareLink(t, base, `{"path":"a.txt","single_use":true}`)
+	resp, err := http.Head(base + once)
+	if err != nil {
+		t.Fatalf("HEAD %s: %v", once, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("HEAD: want 200, got %d", resp.StatusCode)
+	}
+
+	_ = os.Rename(file, file+".moved")
+	if status := fetchStatus(t, base+once); status != 404 {
+		t.Errorf("missing file: want 404, got %d", status)
+	}
+	_ = os.Rename(file+".moved", file)
+
+	if status := fetchStatus(t, base+once); status != 200 {
+		t.Errorf("HEAD and a missing file must not spend the link, got %d", status)
+	}
+	if status := fetchStatus(t, base+once); status != 410 {
+		t.Errorf("second download: want 410, got %d", status)
+	}
+}
+
+func TestShareLink_SingleUseResumesWithRange(t *testing.T) {
+	useTempShareDir(t)
+	resetShareLinks(t)
+	_ = os.WriteFile(filepath.Join(shareDir, "a.txt"), []byte("abcdef"), 0o644)
+	now := time.Now()
+	shareLinks.now = func() time.Time { return now }
+	base := startServer(t)
+
+	once := createShareLink(t, base, `{"path":"a.txt","single_use":true}`)
+	fetchRange := func(spec string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+once, nil)
+		req.Header.Set("Range", spec)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", once, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := fetchRange("bytes=0-"); status != 206 {
+		t.Fatalf("range probe: want 206, got %d", status)
+	}
+	if status := fetchStatus(t, base+once); status != 200 {
+		t.Fatalf("a range probe must not spend the link, got %d", status)
+	}
+	if status := fetchRange("bytes=3-"); status != 206 {
+		t.Errorf("resume: want 206, got %d", status)
+	}
+	if status := fetchStatus(t, base+once); status != 410 {
+		t.Errorf("second full download: want 410, got %d", status)
+	}
+	token := strings.TrimPrefix(once, "/s/")
+	if _, _, err := shareLinks.get(token, "192.0.2.1", true); !errors.Is(err, errShareLinkUsed) {
+		t.Errorf("another client: want errShareLinkUsed, got %v", err)
+	}
+	now = now.Add(shareLinkResumeWindow)
+	if status := fetchRange("bytes=3-"); status != 410 {
+		t.Errorf("resume after the window: want 410, got %d", status)
+	}
+}
+
+func TestShareLink_Expires(t *testing.T) {
+	useTempShareDir(t)
+	resetShareLinks(t)
+	_ = os.WriteFile(filepath.Join(shareDir, "a.txt"), []byte("a"), 0o644)
+	now := time.Now()
+	shareLinks.now = func() time.Time { return now }
+	base := startServer(t)
+
+	path := createShareLink(t, base, `{"path":"a.txt","ttl_seconds":60}`)
+	now = now.Add(61 * time.Second)
+	if status := fetchStatus(t, base+path); status != 410 {
+		t.Errorf("expired link: want 410, got %d", status)
+	}
+}
+
+func TestShareLink_Validation(t *testing.T) {
+	useTempShareDir(t)
+	resetShareLinks(t)
+	_ = os.Mkdir(filepath.Join(shareDir, "dir"), 0o755)
+	base := startServer(t)
+
+	cases := map[string]int{
+		`{"path":"missing.txt"}`:                404,
+		`{"path":"../etc/passwd"}`:              400,
+		`{"path":"dir"}`:                        400,
+		`{"path":"dir","ttl_seconds":99999999}`: 400,
+		`{"path":"x","ttl_seconds":-1}`:         400,
+	}
+	for payload, want := range cases {
+		if status, _ := post(t, base, "/share-links", []byte(payload)); status != want {
+			t.Errorf("%s: want %d, got %d", payload, want, status)
+		}
+	}
+}
+
+func TestShareLink_FullStoreRefusesNewLinks(t *testing.T) {
+	useTempShareDir(t)
+	resetShareLinks(t)
+	_ = os.WriteFile(filepath.Join(shareDir, "a.txt"), []byte("a"), 0o644)
+	base := startServer(t)
+
+	first := createShareLink(t, base, `{"path":"a.txt","ttl_seconds":60}`)
+	for range 9 {
+		createShareLink(t, base, `{"path":"a.txt"}`)
+	}
+	if status, body := post(t, base, "/share-links", []byte(`{"path":"a.txt"}`)); status != 429 {
+		t.Errorf("full store: want 429, got %d %v", status, body)
+	}
+	if status := fetchStatus(t, base+first); status != 200 {
+		t.Errorf("existing links must keep working, got %d", status)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Conditional requests
+// ---------------------------------------------------------------------------
+
+func conditionalGet(t *testing.T, url string, headers map[string]string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestListFiles_ETagAnd304(t *testing.T) {
+	useTempShareDir(t)
+	_ = os.WriteFile(filepath.Join(shareDir, "a.txt"), []byte("a"), 0o644)
+	base := startServer(t)
+
+	first := conditionalGet(t, base+"/list-files", nil)
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != 200 || !strings.HasPrefix(etag, `"`) || first.Header.Get("Last-Modified") == "" {
+		t.Fatalf("want 200 with strong ETag and Last-Modified, got %d %q", first.StatusCode, etag)
+	}
+	if resp := conditionalGet(t, base+"/list-files", map[string]string{"If-None-Match": etag}); resp.StatusCode != 304 {
+		t.Errorf("unchanged listing: want 304, got %d", resp.StatusCode)
+	}
+	if resp := conditionalGet(t, base+"/list-files?hash=sha256", map[string]string{"If-None-Match": etag}); resp.StatusCode != 200 {
+		t.Errorf("different options must not match: want 200, got %d", resp.StatusCode)
+	}
+
+	_ = os.WriteFile(filepath.Join(shareDir, "b.txt"), []byte("b"), 0o644)
+	resp := conditionalGet(t, base+"/list-files", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != 200 || resp.Header.Get("ETag") == etag {
+		t.Errorf("changed listing: want 200 with new ETag, got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestDownload_ETagAnd304(t *testing.T) {
+	useTempShareDir(t)
+	path := filepath.Join(shareDir, "a.txt")
+	_ = os.WriteFile(path, []byte("a"), 0o644)
+	base := startServer(t)
+
+	first := conditionalGet(t, base+"/download/a.txt", nil)
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != 200 || etag == "" {
+		t.Fatalf("want 200 with ETag, got %d %q", first.StatusCode, etag)
+	}
+	if resp := conditionalGet(t, base+"/download/a.txt", map[string]string{"If-None-Match": etag}); resp.StatusCode != 304 {
+		t.Errorf("If-None-Match: want 304, got %d", resp.StatusCode)
+	}
+	lastMod := first.Header.Get("Last-Modified")
+	if resp := conditionalGet(t, base+"/download/a.txt", map[string]string{"If-Modified-Since": lastMod}); resp.StatusCode != 304 {
+		t.Errorf("If-Modified-Since: want 304, got %d", resp.StatusCode)
+	}
+
+	later := time.Now().Add(time.Hour)
+	_ = os.WriteFile(path, []byte("b"), 0o644)
+	_ = os.Chtimes(path, later, later)
+	if resp := conditionalGet(t, base+"/download/a.txt", map[string]string{"If-None-Match": etag}); resp.StatusCode != 200 {
+		t.Errorf("modified file: want 200, got %d", resp.StatusCode)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Folder sync
+// ---------------------------------------------------------------------------
+
+// syncIndex fetches /sync/{pair}/index?since= and returns the sequence and
+// entries.
+func syncIndex(t *testing.T, base, pair string, since uint64) (uint64, []syncEntry) {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("%s/sync/%s/index?since=%d", base, pair, since))
+	if err != nil {
+		t.Fatalf("GET index: %v", err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Seq     uint64      `json:"seq"`
+		Entries []syncEntry `json:"entries"`
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("index: want 200, got %d", resp.StatusCode)
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return out.Seq, out.Entries
+}
+
+// syncChange sends a phone-side PUT (body non-nil) or DELETE for path.
+func syncChange(t *testing.T, base, method, path string, syncBase versionVector, body []byte) (int, syncResult) {
+	t.Helper()
+	req, _ := http.NewRequest(method, base+"/sync/notes/files/"+path, bytes.NewReader(body))
+	req.Header.Set(deviceIDHeader, "pixel")
+	if syncBase != nil {
+		v, _ := json.Marshal(syncBase)
+		req.Header.Set(syncBaseHeader, string(v))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	var result syncResult
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b versionVector
+		want versionOrder
+	}{
+		{versionVector{}, versionVector{}, versionEqual},
+		{versionVector{"laptop": 1}, versionVector{"laptop": 1, "pixel": 0}, versionEqual},
+		{versionVector{"laptop": 1}, versionVector{"laptop": 2}, versionBefore},
+		{versionVector{"laptop": 2, "pixel": 1}, versionVector{"laptop": 2}, versionAfter},
+		{versionVector{"laptop": 2}, versionVector{"laptop": 1, "pixel": 1}, versionConcurrent},
+	}
+	for _, c := range cases {
+		if got := compareVersions(c.a, c.b); got != c.want {
+			t.Errorf("compare(%v, %v) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestSyncIndex_TracksLaptopChanges(t *testing.T) {
+	useTempShareDir(t)
+	base := startServer(t)
+	dir := filepath.Join(shareDir, "notes")
+	_ = os.MkdirAll(filepath.Join(dir, "sub"), 0o755)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("b"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, ".hidden"), []byte("x"), 0o644)
+
+	seq, entries := syncIndex(t, base, "notes", 0)
+	if len(entries) != 2 || seq != 2 {
+		t.Fatalf("want 2 entries at seq 2, got %d at %d: %+v", len(entries), seq, entries)
+	}
+	if entries[0].Version[syncLocalReplica] != 1 || entries[0].SHA256 == "" {
+		t.Errorf("new file: want laptop version 1 and hash, got %+v", entries[0])
+	}
+	if _, again := syncIndex(t, base, "notes", seq); len(again) != 0 {
+		t.Errorf("no changes: want empty delta, got %+v", again)
+	}
+
+	later := time.Now().Add(time.Hour)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a2"), 0o644)
+	_ = os.Chtimes(filepath.Join(dir, "a.txt"), later, later)
+	_ = os.Remove(filepath.Join(dir, "sub", "b.txt"))
+	_, delta := syncIndex(t, base, "notes", seq)
+	byPath := map[string]syncEntry{}
+	for _, e := range delta {
+		byPath[e.Path] = e
+	}
+	if e := byPath["a.txt"]; e.Version[syncLocalReplica] != 2 || e.Deleted {
+		t.Errorf("edited file: want laptop version 2, got %+v", e)
+	}
+	if e := byPath["sub/b.txt"]; !e.Deleted || e.Version[syncLocalReplica] != 2 {
+		t.Errorf("removed file: want tombstone, got %+v", e)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, syncIndexFile)); err != nil {
+		t.Errorf("index not persisted: %v", err)
+	}
+	if status, _ := get(t, base, "/sync/..bad/index"); status != 400 {
+		t.Errorf("invalid pair: want 400, got %d", status)
+	}
+}
+
+func TestSyncUpload_FastForwardAndConflict(t *testing.T) {
+	useTempShareDir(t)
+	base := startServer(t)
+	dir := filepath.Join(shareDir, "notes")
+
+	status, created := syncChange(t, base, http.MethodPut, "todo.txt", nil, []byte("v1"))
+	if status != 200 || created.Status != "applied" || created.Entry.Version["pixel"] != 1 {
+		t.Fatalf("create: want applied with pixel 1, got %d %+v", status, created)
+	}
+
+	status, edited := syncChange(t, base, http.MethodPut, "todo.txt", created.Entry.Version, []byte("v2"))
+	if status != 200 || edited.Status != "applied" || edited.Entry.Version["pixel"] != 2 {
+		t.Fatalf("edit: want applied with pixel 2, got %d %+v", status, edited)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "todo.txt")); string(data) != "v2" {
+		t.Errorf("want v2 on disk, got %q", data)
+	}
+
+	// The laptop edits, then the phone pushes an edit of v2 it made offline.
+	later := time.Now().Add(time.Hour)
+	_ = os.WriteFile(filepath.Join(dir, "todo.txt"), []byte("laptop"), 0o644)
+	_ = os.Chtimes(filepath.Join(dir, "todo.txt"), later, later)
+	status, conflict := syncChange(t, base, http.MethodPut, "todo.txt", edited.Entry.Version, []byte("phone"))
+	if status != 200 || conflict.Status != "conflict" || conflict.ConflictCopy == nil {
+		t.Fatalf("concurrent edit: want conflict with copy, got %d %+v", status, conflict)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "todo.txt")); string(data) != "laptop" {
+		t.Errorf("laptop version must stay in place, got %q", data)
+	}
+	copyPath := conflict.ConflictCopy.Path
+	if data, _ := os.ReadFile(filepath.Join(dir, filepath.FromSlash(copyPath))); string(data) != "phone" ||
+		!strings.HasPrefix(copyPath, "todo (conflict from pixel ") || !strings.HasSuffix(copyPath, ").txt") {
+		t.Errorf("want phone version kept as conflict copy, got %q", copyPath)
+	}
+	if compareVersions(conflict.Entry.Version, edited.Entry.Version) != versionAfter {
+		t.Errorf("resolved version must supersede the phone's, got %v", conflict.Entry.Version)
+	}
+
+	resp := conditionalGet(t, base+"/sync/notes/files/todo.txt", nil)
+	var served versionVector
+	_ = json.Unmarshal([]byte(resp.Header.Get(syncVersionHeader)), &served)
+	if resp.StatusCode != 200 || compareVersions(served, conflict.Entry.Version) != versionEqual {
+		t.Errorf("download: want 200 with resolved version, got %d %v", resp.StatusCode, served)
+	}
+
+	// Re-sending identical content is acknowledged without a new copy.
+	status, same := syncChange(t, base, http.MethodPut, "todo.txt", conflict.Entry.Version, []byte("laptop"))
+	if status != 200 || same.Status != "unchanged" {
+		t.Errorf("identical content: want unchanged, got %d %+v", status, same)
+	}
+	if status, _ := syncChange(t, base, http.MethodPut, ".sync_index.json", nil, []byte("x")); status != 400 {
+		t.Errorf("dot-file: want 400, got %d", status)
+	}
+}
+
+func TestSyncPair_CreatedOnlyByUpload(t *testing.T) {
+	useTempShareDir(t)
+	base := startServer(t)
+	dir := filepath.Join(shareDir, "notes")
+
+	for _, path := range []string{"/sync/notes/index", "/sync/notes/files/a.txt"} {
+		if status, _ := get(t, base, path); status != 404 {
+			t.Errorf("GET %s on unknown pair: want 404, got %d", path, status)
+		}
+	}
+	if status, _ := syncChange(t, base, http.MethodDelete, "a.txt", nil, nil); status != 404 {
+		t.Errorf("DELETE on unknown pair: want 404, got %d", status)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("reads must not create the pair folder, stat err = %v", err)
+	}
+
+	if status, _ := putRaw(t, base+"/sync/notes/files/a.txt", strings.NewReader("a"), nil); status != 400 {
+		t.Errorf("PUT without %s: want 400, got %d", deviceIDHeader, status)
+	}
+	if status, result := syncChange(t, base, http.MethodPut, "a.txt", nil, []byte("a")); status != 200 || result.Status != "applied" {
+		t.Fatalf("first PUT: want applied, got %d %+v", status, result)
+	}
+	if _, entries := syncIndex(t, base, "notes", 0); len(entries) != 1 {
+		t.Errorf("want the uploaded file indexed, got %+v", entries)
+	}
+}
+
+func TestSyncDelete_KeepsLaptopEdits(t *testing.T) {
+	useTempShareDir(t)
+	base := startServer(t)
+	dir := filepath.Join(shareDir, "notes")
+	_ = os.MkdirAll(dir, 0o755)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644)
+	_ = os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0o644)
+	seq, entries := syncIndex(t, base, "notes", 0)
+	versions := map[string]versionVector{}
+	for _, e := range entries {
+		versions[e.Path] = e.Version
+	}
+
+	status, deleted := syncChange(t, base, http.MethodDelete, "a.txt", versions["a.txt"], nil)
+	if status != 200 || deleted.Status != "applied" || !deleted.Entry.Deleted {
+		t.Fatalf("delete: want applied tombstone, got %d %+v", status, deleted)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("file should be gone, stat err = %v", err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	_ = os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b2"), 0o644)
+	_ = os.Chtimes(filepath.Join(dir, "b.txt"), later, later)
+	status, kept := syncChange(t, base, http.MethodDelete, "b.txt", versions["b.txt"], nil)
+	if status != 200 || kept.Status != "conflict" || kept.Entry.Deleted {
+		t.Fatalf("delete of edited file: want conflict, got %d %+v", status, kept)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); err != nil {
+		t.Errorf("edited file must be kept: %v", err)
+	}
+
+	_, delta := syncIndex(t, base, "notes", seq)
+	if len(delta) != 2 {
+		t.Errorf("want tombstone and kept file in delta, got %+v", delta)
+	}
+	if status, _ := syncChange(t, base, http.MethodDelete, "missing.txt", nil, nil); status != 404 {
+		t.Errorf("unknown file: want 404, got %d", status)
+	}
+}
+
+func TestSyncFolder_IndexHiddenFromShareEndpoints(t *testing.T) {
+	useTempShareDir(t)
+	base := startServer(t)
+	dir := filepath.Join(shareDir, "notes")
+	_ = os.MkdirAll(dir, 0o755)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644)
+	syncIndex(t, base, "notes", 0)
+
+	resp, err := http.Get(base + "/list-files?path=notes")
+	if err != nil {
+		t.Fatalf("GET /list-files: %v", err)
+	}
+	var files []map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&files)
+	resp.Body.Close()
+	if len(files) != 1 || files[0]["name"] != "a.txt" {
+		t.Errorf("listing should only show a.txt, got %v", files)
+	}
+
+	if status, _ := get(t, base, "/download/notes/"+syncIndexFile); status != 404 {
+		t.Errorf("download index: want 404, got %d", status)
+	}
+	if status, _ := doRequest(t, http.MethodDelete, base+"/files/"+url.PathEscape("notes/"+syncIndexFile), nil); status != 404 {
+		t.Errorf("delete index: want 404, got %d", status)
+	}
+	if status, _ := post(t, base, "/files/"+url.PathEscape("notes/a.txt")+"/rename", []byte(`{"new_name":"`+syncIndexFile+`"}`)); status != 400 {
+		t.Errorf("rename onto index: want 400, got %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, syncIndexFile)); err != nil {
+		t.Errorf("index must survive: %v", err)
+	}
+}
+
+func TestSyncDownload_SavesIndexOnlyOnChange(t *testing.T) {
+	useTempShareDir(t)
+	base := startServer(t)
+	dir := filepath.Join(shareDir, "notes")
+	_ = os.MkdirAll(dir, 0o755)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644)
+	syncIndex(t, base, "notes", 0)
+
+	index := filepath.Join(dir, syncIndexFile)
+	earlier := time.Now().Add(-time.Hour).Truncate(time.Second)
+	_ = os.Chtimes(index, earlier, earlier)
+	if status, _ := get(t, base, "/sync/notes/files/a.txt"); status != 200 {
+		t.Fatalf("download: want 200, got %d", status)
+	}
+	if info, err := os.Stat(index); err != nil || !info.ModTime().Equal(earlier) {
+		t.Errorf("unchanged file: index should not be rewritten (%v)", err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a2"), 0o644)
+	_ = os.Chtimes(filepath.Join(dir, "a.txt"), later, later)
+	if status, _ := get(t, base, "/sync/notes/files/a.txt"); status != 200 {
+		t.Fatalf("download: want 200, got %d", status)
+	}
+	if info, err := os.Stat(index); err != nil || info.ModTime().Equal(earlier) {
+		t.Errorf("edited file: index should be saved (%v)", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Clipboard
+// ---------------------------------------------------------------------------
+
+// useMemoryClipboard installs a fresh in-memory clipboard with sync enabled
+// and the toggle persisted to a temp file.
+func useMemoryClipboard(t *testing.T) *memoryClipboard {
+	t.Helper()
+	orig, origFile := clipboard, clipboardSyncFile
+	clipboard = newClipboardSync()
+	clipboardSyncFile = filepath.Join(t.TempDir(), "clipboard_sync.state")
+	t.Cleanup(func() { clipboard, clipboardSyncFile = orig, origFile })
+	mem := &memoryClipboard{}
+	clipboard.setProvider(mem)
+	clipboard.setEnabled(true)
+	return mem
+}
+
+func TestClipboard_DisabledByDefault(t *testing.T) {
+	useMemoryClipboard(t)
+	clipboard.setEnabled(false)
+	base := startServer(t)
+
+	if status, _ := get(t, base, "/clipboard"); status != 403 {
+		t.Errorf("disabled GET: want 403, got %d", status)
+	}
+	if status, _ := post(t, base, "/clipboard", []byte(`{"text":"hi"}`)); status != 403 {
+		t.Errorf("disabled POST: want 403, got %d", status)
+	}
+
+	status, body := post(t, base, "/clipboard/settings", []byte(`{"enabled":true}`))
+	if status != 200 || body["enabled"] != true || body["provider"] != "memory" {
+		t.Fatalf("enable: want enabled memory provider, got %d %v", status, body)
+	}
+	if data, _ := os.ReadFile(clipboardSyncFile); string(data) != "enabled" {
+		t.Errorf("toggle not persisted, got %q", data)
+	}
+	if status, _ := get(t, base, "/clipboard"); status != 204 {
+		t.Errorf("empty clipboard: want 204, got %d", status)
+	}
+}
+
+func TestClipboard_SetAndGet(t *testing.T) {
+	mem := useMemoryClipboard(t)
+	base := startServer(t)
+
+	status, _ := post(t, base, "/clipboard", []byte(`{"text":"https://example.com"}`))
+	if status != 200 || string(mem.data) != "https://example.com" {
+		t.Fatalf("set text: want 200 and clipboard set, got %d %q", status, mem.data)
+	}
+	status, body := get(t, base, "/clipboard")
+	if status != 200 || body["mime"] != "text/plain" || body["text"] != "https://example.com" {
+		t.Errorf("get text: got %d %v", status, body)
+	}
+
+	png := base64.StdEncoding.EncodeToString(tinyPNG(t))
+	status, _ = post(t, base, "/clipboard", []byte(`{"mime":"image/png","data":"`+png+`"}`))
+	if status != 200 || mem.mime != "image/png" {
+		t.Fatalf("set image: want 200 and image/png, got %d %q", status, mem.mime)
+	}
+	status, body = get(t, base, "/clipboard")
+	if status != 200 || body["mime"] != "image/png" || body["data"] != png {
+		t.Errorf("get image: want base64 PNG back, got %d mime=%v", status, body["mime"])
+	}
+
+	cases := map[string]int{
+		`{}`:                                     400,
+		`{"mime":"text/html","data":"PGI+"}`:     400,
+		`{"mime":"image/png","data":"aGVsbG8="}`: 400,
+		`{"text":"` + strings.Repeat("x", maxClipboardBytes+1) + `"}`: 413,
+	}
+	for payload, want := range cases {
+		if status, _ := post(t, base, "/clipboard", []byte(payload)); status != want {
+			t.Errorf("%.40s: want %d, got %d", payload, want, status)
+		}
+	}
+	if mem.mime != "image/png" || base64.StdEncoding.EncodeToString(mem.data) != png {
+		t.Errorf("rejected payloads must leave the clipboard alone, got %q", mem.mime)
+	}
+}
+
+func TestClipboardWatcher_StreamsLaptopChanges(t *testing.T) {
+	mem := useMemoryClipboard(t)
+	origInterval := clipboardPollInterval
+	clipboardPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { clipboardPollInterval = origInterval })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { runClipboardWatcher(ctx); close(done) }()
+	t.Cleanup(func() { cancel(); <-done })
+
+	base := startServer(t)
+	resp, err := http.Get(base + "/clipboard/stream")
+	if err != nil {
+		t.Fatalf("GET /clipboard/stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	_ = mem.Write(context.Background(), "UTF8_STRING", []byte("copied on laptop"))
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data: ") {
+			var c clipboardContent
+			_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &c)
+			if c.Text != "copied on laptop" || c.Source != "laptop" || c.ID == 0 {
+				t.Errorf("want laptop text event, got %+v", c)
+			}
+			return
+		}
+	}
+	t.Fatal("stream ended without events")
+}
+
+func TestPickClipboardTarget(t *testing.T) {
+	cases := []struct {
+		targets      []string
+		target, mime string
+	}{
+		{[]string{"TARGETS", "UTF8_STRING", "STRING"}, "UTF8_STRING", "text/plain"},
+		{[]string{"text/uri-list", "image/png", "text/plain"}, "image/png", "image/png"},
+		{[]string{"text/html"}, "", ""},
+	}
+	for _, c := range cases {
+		target, mime, _ := pickClipboardTarget(c.targets)
+		if target != c.target || mime != c.mime {
+			t.Errorf("%v: want %q %q, got %q %q", c.targets, c.target, c.mime, target, mime)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Open URL and text snippets
+// ---------------------------------------------------------------------------
+
+func resetTextSnippets(t *testing.T) {
+	t.Helper()
+	orig := textSnippets
+	textSnippets = newTextHistory(10)
+	t.Cleanup(func() { textSnippets = orig })
+}
+
+func TestOpenURL_OpensOnlyHTTP(t *testing.T) {
+	resetTextSnippets(t)
+	var opened []string
+	orig := openURLCmd
+	openURLCmd = func(u string) error { opened = append(opened, u); return nil }
+	t.Cleanup(func() { openURLCmd = orig })
+	base := startServer(t)
+
+	status, body := post(t, base, "/open-url", []byte(`{"url":"https://example.com/a?b=c"}`))
+	if status != 200 || body["url"] != "https://example.com/a?b=c" {
+		t.Fatalf("want 200, got %d %v", status, body)
+	}
+	for _, bad := range []string{"", "file:///etc/passwd", "javascript:alert(1)", "https://", "http://u:p@host/",
+		"https://example.com/\nfoo", "ssh://host"} {
+		payload, _ := json.Marshal(openURLPayload{URL: bad})
+		if status, _ := post(t, base, "/open-url", payload); status != 400 {
+			t.Errorf("%q: want 400, got %d", bad, status)
+		}
+	}
+	if len(opened) != 1 {
+		t.Errorf("want exactly one URL opened, got %v", opened)
+	}
+	if h := textSnippets.latest(10); len(h) != 1 || h[0].Kind != "url" {
+		t.Errorf("want the opened URL in history, got %+v", h)
+	}
+}
+
+func TestText_Actions(t *testing.T) {
+	resetTextSnippets(t)
+	mem := useMemoryClipboard(t)
+	clipboard.setEnabled(false)
+	origNotes := textNotesFile
+	textNotesFile = filepath.Join(t.TempDir(), "notes", "phone_notes.md")
+	t.Cleanup(func() { textNotesFile = origNotes })
+	var typed string
+	origType := typeTextCmd
+	typeTextCmd = func(_ context.Context, text string) error { typed = text; return nil }
+	t.Cleanup(func() { typeTextCmd = origType })
+	base := startServer(t)
+
+	if status, _ := post(t, base, "/text", []byte(`{"text":"copy me"}`)); status != 403 || mem.data != nil {
+		t.Errorf("clipboard sync disabled: want 403 and clipboard untouched, got %d %q", status, mem.data)
+	}
+	clipboard.setEnabled(true)
+	if status, _ := post(t, base, "/text", []byte(`{"text":"copy me"}`)); status != 200 || string(mem.data) != "copy me" {
+		t.Errorf("clipboard: want 200 and clipboard set, got %d %q", status, mem.data)
+	}
+	if status, _ := post(t, base, "/text", []byte(`{"text":"type me","action":"type"}`)); status != 200 || typed != "type me" {
+		t.Errorf("type: want 200 and text typed, got %d %q", status, typed)
+	}
+	if status, _ := post(t, base, "/text", []byte(`{"text":"note me","action":"notes"}`)); status != 200 {
+		t.Errorf("notes: want 200, got %d", status)
+	}
+	if data, _ := os.ReadFile(textNotesFile); !strings.Contains(string(data), "note me") {
+		t.Errorf("notes file missing snippet: %q", data)
+	}
+
+	cases := map[string]int{
+		`{"text":""}`:                   400,
+		`{"text":"x","action":"shout"}`: 400,
+		`{"text":"` + strings.Repeat("x", maxTypedTextBytes+1) + `","action":"type"}`: 413,
+	}
+	for payload, want := range cases {
+		if status, _ := post(t, base, "/text", []byte(payload)); status != want {
+			t.Errorf("%.40s: want %d, got %d", payload, want, status)
+		}
+	}
+
+	resp, err := http.Get(base + "/text/history?limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var history []textSnippet
+	_ = json.NewDecoder(resp.Body).Decode(&history)
+	if len(history) != 2 || history[0].Action != "notes" || history[1].Action != "type" {
+		t.Errorf("want the two newest snippets, newest first, got %+v", history)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Media control
+// ---------------------------------------------------------------------------
+
+// fakeMedia is an in-memory mediaController. Follow reports every player
+// sent on follow.
+type fakeMedia struct {
+	mu       sync.Mutex
+	players  []mediaPlayer
+	commands []string
+	follow   chan mediaPlayer
+}
+
+func (f *fakeMedia) Players(context.Context) ([]mediaPlayer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.players), nil
+}
+
+func (f *fakeMedia) Control(_ context.Context, player string, cmd mediaCommand) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, player+" "+cmd.Action)
+	for i := range f.players {
+		if f.players[i].Name == player && cmd.Action == "pause" {
+			f.players[i].Status = "Paused"
+		}
+	}
+	return nil
+}
+
+func (f *fakeMedia) Follow(ctx context.Context, emit func(mediaPlayer)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p := <-f.follow:
+			emit(p)
+		}
+	}
+}
+
+func useFakeMedia(t *testing.T, players ...mediaPlayer) *fakeMedia {
+	t.Helper()
+	origMedia, origEvents := media, mediaEvents
+	fake := &fakeMedia{players: players, follow: make(chan mediaPlayer)}
+	media, mediaEvents = fake, newMediaEventLog(10)
+	t.Cleanup(func() { media, mediaEvents = origMedia, origEvents })
+	return fake
+}
+
+func TestMedia_ListAndCommand(t *testing.T) {
+	fake := useFakeMedia(t,
+		mediaPlayer{Name: "firefox", Status: "Paused", Title: "Video"},
+		mediaPlayer{Name: "spotify", Status: "Playing", Title: "Song", Artist: "Band"})
+	base := startServer(t)
+
+	resp, err := http.Get(base + "/media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct{ Players []mediaPlayer }
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Players) != 2 {
+		t.Fatalf("want 2 players, got %+v", list.Players)
+	}
+	if status, body := get(t, base, "/media/active"); status != 200 || body["name"] != "spotify" {
+		t.Errorf("active: want the playing spotify, got %d %v", status, body)
+	}
+
+	status, body := post(t, base, "/media/active", []byte(`{"action":"pause"}`))
+	player, _ := body["player"].(map[string]any)
+	if status != 200 || player["status"] != "Paused" {
+		t.Errorf("pause: want 200 with paused state, got %d %v", status, body)
+	}
+	if status, _ := post(t, base, "/media/firefox", []byte(`{"action":"seek","offset":-10}`)); status != 200 {
+		t.Errorf("seek: want 200, got %d", status)
+	}
+	if got := strings.Join(fake.commands, ","); got != "spotify pause,firefox seek" {
+		t.Errorf("commands sent: %q", got)
+	}
+
+	cases := map[string]int{
+		`{"action":"shuffle"}`:                      400,
+		`{"action":"seek"}`:                         400,
+		`{"action":"seek","position":1,"offset":1}`: 400,
+		`{"action":"volume","volume":1.5}`:          400,
+	}
+	for payload, want := range cases {
+		if status, _ := post(t, base, "/media/spotify", []byte(payload)); status != want {
+			t.Errorf("%s: want %d, got %d", payload, want, status)
+		}
+	}
+	if status, _ := post(t, base, "/media/vlc", []byte(`{"action":"play"}`)); status != 404 {
+		t.Errorf("unknown player: want 404, got %d", status)
+	}
+}
+
+func TestMediaStream_ReportsTrackAndStatusChanges(t *testing.T) {
+	fake := useFakeMedia(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { runMediaMonitor(ctx); close(done) }()
+	t.Cleanup(func() { cancel(); <-done })
+
+	base := startServer(t)
+	resp, err := http.Get(base + "/media/stream")
+	if err != nil {
+		t.Fatalf("GET /media/stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	song := mediaPlayer{Name: "spotify", Status: "Playing", Title: "One"}
+	fake.follow <- song
+	fake.follow <- song // unchanged: no event
+	song.Status = "Paused"
+	fake.follow <- song
+	song.Title = "Two"
+	fake.follow <- song
+
+	scanner := bufio.NewScanner(resp.Body)
+	var got []string
+	for scanner.Scan() && len(got) < 3 {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			var e mediaEvent
+			_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+			got = append(got, e.Type+":"+e.Player.Title+":"+e.Player.Status)
+		}
+	}
+	if want := "track:One:Playing,status:One:Paused,track:Two:Paused"; strings.Join(got, ",") != want {
+		t.Errorf("want %s, got %v", want, got)
+	}
+}
+
+func TestParseMediaLines(t *testing.T) {
+	out := "spotify\x1fPlaying\x1f/track/1\x1fSong\x1fBand\x1fAlbum\x1fhttps://i/art\x1f215000000\x1f12500000\x1f0.65\n" +
+		"\n" + "garbage line\n"
+	var players []mediaPlayer
+	parseMediaLines(strings.NewReader(out), func(p mediaPlayer) { players = append(players, p) })
+	if len(players) != 1 {
+		t.Fatalf("want 1 player, got %+v", players)
+	}
+	p := players[0]
+	if p.Name != "spotify" || p.Title != "Song" || p.Length != 215 || p.Position != 12.5 || p.Volume != 0.65 {
+		t.Errorf("parsed %+v", p)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Volume and brightness
+// ---------------------------------------------------------------------------
+
+// useFakeAudioCmd answers wpctl/pactl "get" calls from outputs (keyed by
+// the subcommand) and records every call.
+func useFakeAudioCmd(t *testing.T, backend audioController, outputs map[string]string) *[]string {
+	t.Helper()
+	var calls []string
+	origCmd, origAudio := runAudioCmd, audio
+	runAudioCmd = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		calls = append(calls, name+" "+strings.Join(args, " "))
+		return []byte(outputs[args[0]]), nil
+	}
+	audio = backend
+	audioProbe.invalidate()
+	t.Cleanup(func() {
+		runAudioCmd, audio = origCmd, origAudio
+		audioProbe.invalidate()
+	})
+	return &calls
+}
+
+func TestAudio_Wpctl(t *testing.T) {
+	calls := useFakeAudioCmd(t, wpctlAudio{}, map[string]string{"get-volume": "Volume: 0.40 [MUTED]\n"})
+	base := startServer(t)
+
+	status, body := get(t, base, "/audio")
+	if status != 200 || body["volume"] != float64(40) || body["muted"] != true || body["backend"] != "wpctl" {
+		t.Fatalf("get: want 40%% muted, got %d %v", status, body)
+	}
+	*calls = nil
+	if status, _ := post(t, base, "/audio", []byte(`{"volume":250,"muted":false}`)); status != 200 {
+		t.Fatalf("set: want 200, got %d", status)
+	}
+	want := []string{
+		"wpctl set-volume @DEFAULT_AUDIO_SINK@ 100%",
+		"wpctl set-mute @DEFAULT_AUDIO_SINK@ 0",
+		"wpctl get-volume @DEFAULT_AUDIO_SINK@",
+	}
+	if !slices.Equal(*calls, want) {
+		t.Errorf("want clamped volume and unmute:\n%v\ngot\n%v", want, *calls)
+	}
+	if status, _ := post(t, base, "/audio", []byte(`{}`)); status != 400 {
+		t.Errorf("empty payload: want 400, got %d", status)
+	}
+}
+
+func TestAudio_PactlAndUnavailable(t *testing.T) {
+	useFakeAudioCmd(t, pactlAudio{}, map[string]string{
+		"get-sink-volume": "Volume: front-left: 26214 /  40% / -23.88 dB,   front-right: 26214 /  40% / -23.88 dB\n",
+		"get-sink-mute":   "Mute: no\n",
+	})
+	base := startServer(t)
+	if status, body := get(t, base, "/audio"); status != 200 || body["volume"] != float64(40) || body["muted"] != false {
+		t.Errorf("pactl: want 40%% unmuted, got %d %v", status, body)
+	}
+	if _, body := get(t, base, "/stats"); body["audio"] == nil {
+		t.Errorf("stats should include audio, got %v", body)
+	}
+
+	audio = nil
+	if status, _ := get(t, base, "/audio"); status != 503 {
+		t.Errorf("no backend: want 503, got %d", status)
+	}
+}
+
+// useTempBacklight creates fake backlight devices under a temp backlightDir.
+// Each device is "name:type:max:current".
+func useTempBacklight(t *testing.T, devices ...string) {
+	t.Helper()
+	orig := backlightDir
+	backlightDir = t.TempDir()
+	t.Cleanup(func() { backlightDir = orig })
+	for _, d := range devices {
+		parts := strings.Split(d, ":")
+		dir := filepath.Join(backlightDir, parts[0])
+		_ = os.MkdirAll(dir, 0o755)
+		_ = os.WriteFile(filepath.Join(dir, "type"), []byte(parts[1]+"\n"), 0o644)
+		_ = os.WriteFile(filepath.Join(dir, "max_brightness"), []byte(parts[2]+"\n"), 0o644)
+		_ = os.WriteFile(filepath.Join(dir, "brightness"), []byte(parts[3]+"\n"), 0o644)
+	}
+}
+
+func TestBrightness_GetSetClamped(t *testing.T) {
+	useTempBacklight(t, "intel_backlight:raw:1000:500", "acpi_video0:firmware:100:30")
+	base := startServer(t)
+
+	status, body := get(t, base, "/display/brightness")
+	if status != 200 || body["device"] != "acpi_video0" || body["percent"] != float64(30) {
+		t.Fatalf("get: want firmware device at 30%%, got %d %v", status, body)
+	}
+	if status, body := post(t, base, "/display/brightness", []byte(`{"percent":75}`)); status != 200 || body["brightness"] != float64(75) {
+		t.Errorf("set 75: got %d %v", status, body)
+	}
+	if status, body := post(t, base, "/display/brightness", []byte(`{"percent":-5}`)); status != 200 || body["percent"] != float64(minBrightnessPercent) {
+		t.Errorf("set -5: want clamped to %d%%, got %d %v", minBrightnessPercent, status, body)
+	}
+	if status, body := post(t, base, "/display/brightness", []byte(`{"percent":400}`)); status != 200 || body["brightness"] != float64(100) {
+		t.Errorf("set 400: want clamped to max, got %d %v", status, body)
+	}
+	if status, _ := post(t, base, "/display/brightness", []byte(`{}`)); status != 400 {
+		t.Errorf("missing percent: want 400, got %d", status)
+	}
+	_, stats := get(t, base, "/stats")
+	if b, _ := stats["brightness"].(map[string]any); b["device"] != "acpi_video0" {
+		t.Errorf("stats should include brightness, got %v", stats["brightness"])
+	}
+}
+
+func TestBrightness_NoBacklight(t *testing.T) {
+	useTempBacklight(t)
+	base := startServer(t)
+	if status, _ := get(t, base, "/display/brightness"); status != 404 {
+		t.Errorf("want 404, got %d", status)
+	}
+	if _, stats := get(t, base, "/stats"); stats["brightness"] != nil {
+		t.Errorf("stats should omit brightness, got %v", stats["brightness"])
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Session state
+// ---------------------------------------------------------------------------
+
+// useFakeLoginctl answers loginctl calls from outputs (keyed by subcommand)
+// and records every call. A subcommand mapped to an error string fails.
+func useFakeLoginctl(t *testing.T, outputs map[string]string) *[]string {
+	t.Helper()
+	var calls []string
+	orig := runLoginctl
+	runLoginctl = func(_ context.Context, args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, " "))
+		out := outputs[args[0]]
+		if strings.HasPrefix(out, "error: ") {
+			return nil, errors.New(strings.TrimPrefix(out, "error: "))
+		}
+		return []byte(out), nil
+	}
+	sessionProbe.invalidate()
+	t.Cleanup(func() {
+		runLoginctl = orig
+		sessionProbe.invalidate()
+	})
+	t.Setenv("XDG_SESSION_ID", "")
+	return &calls
+}
+
+func TestSession_State(t *testing.T) {
+	idleSince := time.Now().Add(-90 * time.Second).UnixMicro()
+	useFakeLoginctl(t, map[string]string{
+		"show-user": "2\n",
+		"show-session": "Id=2\nName=alex\nSeat=seat0\nType=wayland\nState=active\nActive=yes\n" +
+			"LockedHint=yes\nIdleHint=yes\nIdleSinceHint=" + strconv.FormatInt(idleSince, 10) + "\n",
+		"list-users": "1000 alex no active\n1001 sam  no online\n",
+	})
+	base := startServer(t)
+
+	status, body := get(t, base, "/session")
+	if status != 200 || body["id"] != "2" || body["seat"] != "seat0" || body["active"] != true || body["locked"] != true {
+		t.Fatalf("want active locked session 2 on seat0, got %d %v", status, body)
+	}
+	if idle, _ := body["idle_seconds"].(float64); idle < 89 || idle > 95 {
+		t.Errorf("want ~90 idle seconds, got %v", body["idle_seconds"])
+	}
+	if users, _ := body["users"].([]any); len(users) != 2 || users[1] != "sam" {
+		t.Errorf("want both users, got %v", body["users"])
+	}
+	if _, stats := get(t, base, "/stats"); stats["session"] == nil {
+		t.Errorf("stats should include the session")
+	}
+}
+
+func TestStats_CachesSessionAndAudio(t *testing.T) {
+	sessionCalls := useFakeLoginctl(t, map[string]string{
+		"show-user":    "2\n",
+		"show-session": "Id=2\nActive=yes\nLockedHint=no\n",
+	})
+	audioCalls := useFakeAudioCmd(t, wpctlAudio{}, map[string]string{"get-volume": "Volume: 0.40\n"})
+	base := startServer(t)
+
+	for range 3 {
+		if _, stats := get(t, base, "/stats"); stats["session"] == nil || stats["audio"] == nil {
+			t.Fatalf("stats should include session and audio, got %v", stats)
+		}
+	}
+	if n := len(*sessionCalls); n != 3 {
+		t.Errorf("want one show-user, show-session and list-users for three polls, got %v", *sessionCalls)
+	}
+	if n := len(*audioCalls); n != 1 {
+		t.Errorf("want one wpctl call for three polls, got %v", *audioCalls)
+	}
+
+	if status, _ := post(t, base, "/session/lock", nil); status != 200 {
+		t.Fatalf("lock: want 200, got %d", status)
+	}
+	before := len(*sessionCalls)
+	get(t, base, "/stats")
+	if !slices.Contains((*sessionCalls)[before:], "list-users --no-legend") {
+		t.Errorf("locking should refresh the cached session, got %v", (*sessionCalls)[before:])
+	}
+}
+
+func TestSession_LockAndUnlock(t *testing.T) {
+	calls := useFakeLoginctl(t, map[string]string{"show-user": "2\n"})
+	base := startServer(t)
+
+	if status, _ := post(t, base, "/session/lock", nil); status != 200 {
+		t.Errorf("lock: want 200, got %d", status)
+	}
+	if status, _ := post(t, base, "/session/unlock", nil); status != 403 {
+		t.Errorf("unlock disabled: want 403, got %d", status)
+	}
+	orig := allowSessionUnlock
+	allowSessionUnlock = true
+	t.Cleanup(func() { allowSessionUnlock = orig })
+	if status, _ := post(t, base, "/session/unlock", nil); status != 200 {
+		t.Errorf("unlock allowed: want 200, got %d", status)
+	}
+	if !slices.Contains(*calls, "lock-session 2") || !slices.Contains(*calls, "unlock-session 2") {
+		t.Errorf("want lock and unlock of session 2, got %v", *calls)
+	}
+	if n := len(slices.DeleteFunc(slices.Clone(*calls), func(c string) bool { return c != "unlock-session 2" })); n != 1 {
+		t.Errorf("disabled unlock must not reach loginctl, got %v", *calls)
+	}
+
+	useFakeLoginctl(t, map[string]string{"show-user": "2\n", "lock-session": "error: Access denied"})
+	if status, _ := post(t, base, "/session/lock", nil); status != 403 {
+		t.Errorf("polkit refusal: want 403, got %d", status)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaPlayer is an MPRIS player's state. Length and Position are seconds;
+// Volume is 0–1.
+type mediaPlayer struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"` // Playing, Paused or Stopped
+	TrackID  string  `json:"track_id,omitempty"`
+	Title    string  `json:"title"`
+	Artist   string  `json:"artist"`
+	Album    string  `json:"album"`
+	ArtURL   string  `json:"art_url,omitempty"`
+	Length   float64 `json:"length"`
+	Position float64 `json:"position"`
+	Volume   float64 `json:"volume"`
+}
+
+// sameTrack reports whether p and o show the same track.
+func (p mediaPlayer) sameTrack(o mediaPlayer) bool {
+	return p.TrackID == o.TrackID && p.Title == o.Title && p.Artist == o.Artist && p.Album == o.Album
+}
+
+// mediaCommand is a playback command. Position (absolute) or Offset
+// (relative) are seconds for seek; Volume is 0–1.
+type mediaCommand struct {
+	Action   string   `json:"action"` // play, pause, play-pause, stop, next, previous, seek or volume
+	Position *float64 `json:"position"`
+	Offset   *float64 `json:"offset"`
+	Volume   *float64 `json:"volume"`
+}
+
+func (c mediaCommand) validate() error {
+	switch c.Action {
+	case "play", "pause", "play-pause", "stop", "next", "previous":
+		return nil
+	case "seek":
+		if (c.Position == nil) == (c.Offset == nil) {
+			return fmt.Errorf("seek needs exactly one of position or offset")
+		}
+		if c.Position != nil && *c.Position < 0 {
+			return fmt.Errorf("position must not be negative")
+		}
+		return nil
+	case "volume":
+		if c.Volume == nil || *c.Volume < 0 || *c.Volume > 1 {
+			return fmt.Errorf("volume must be between 0 and 1")
+		}
+		return nil
+	}
+	return fmt.Errorf("action must be play, pause, play-pause, stop, next, previous, seek or volume")
+}
+
+// mediaController talks to the MPRIS players on the session bus. Follow
+// blocks until ctx is cancelled or the source fails, calling emit whenever
+// a player's track or playback status may have changed.
+type mediaController interface {
+	Players(ctx context.Context) ([]mediaPlayer, error)
+	Control(ctx context.Context, player string, cmd mediaCommand) error
+	Follow(ctx context.Context, emit func(mediaPlayer)) error
+}
+
+// playerctlFormat renders a player as fields separated by the ASCII unit
+// separator, which never occurs in titles. See parseMediaLine.
+const playerctlFormat = "{{playerName}}\x1f{{status}}\x1f{{mpris:trackid}}\x1f{{xesam:title}}\x1f{{xesam:artist}}\x1f" +
+	"{{xesam:album}}\x1f{{mpris:artUrl}}\x1f{{mpris:length}}\x1f{{position}}\x1f{{volume}}"
+
+// playerctlController drives MPRIS players through playerctl.
+type playerctlController struct{}
+
+func (playerctlController) Players(ctx context.Context) ([]mediaPlayer, error) {
+	out, err := exec.CommandContext(ctx, "playerctl", "--all-players", "metadata", "--format", playerctlFormat).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return []mediaPlayer{}, nil // "No players found"
+		}
+		return nil, err
+	}
+	players := []mediaPlayer{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if p, ok := parseMediaLine(line); ok {
+			players = append(players, p)
+		}
+	}
+	return players, nil
+}
+
+func (playerctlController) Control(ctx context.Context, player string, cmd mediaCommand) error {
+	args := []string{"--player", player}
+	switch cmd.Action {
+	case "seek":
+		if cmd.Position != nil {
+			args = append(args, "position", strconv.FormatFloat(*cmd.Position, 'f', 3, 64))
+		} else if *cmd.Offset >= 0 {
+			args = append(args, "position", strconv.FormatFloat(*cmd.Offset, 'f', 3, 64)+"+")
+		} else {
+			args = append(args, "position", strconv.FormatFloat(-*cmd.Offset, 'f', 3, 64)+"-")
+		}
+	case "volume":
+		args = append(args, "volume", strconv.FormatFloat(*cmd.Volume, 'f', 2, 64))
+	default:
+		args = append(args, cmd.Action)
+	}
+	if out, err := exec.CommandContext(ctx, "playerctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("playerctl %s: %w: %s", cmd.Action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (playerctlController) Follow(ctx context.Context, emit func(mediaPlayer)) error {
+	cmd := exec.CommandContext(ctx, "playerctl", "--all-players", "--follow", "metadata", "--format", playerctlFormat)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	parseMediaLines(stdout, emit)
+	return cmd.Wait()
+}
+
+// parseMediaLine parses one line of playerctlFormat output. playerctl
+// reports lengths and positions in microseconds.
+func parseMediaLine(line string) (mediaPlayer, bool) {
+	f := strings.Split(line, "\x1f")
+	if len(f) != 10 || f[0] == "" {
+		return mediaPlayer{}, false
+	}
+	micros := func(s string) float64 {
+		n, _ := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		return n / 1e6
+	}
+	volume, _ := strconv.ParseFloat(strings.TrimSpace(f[9]), 64)
+	return mediaPlayer{
+		Name:     f[0],
+		Status:   f[1],
+		TrackID:  f[2],
+		Title:    f[3],
+		Artist:   f[4],
+		Album:    f[5],
+		ArtURL:   f[6],
+		Length:   micros(f[7]),
+		Position: micros(f[8]),
+		Volume:   volume,
+	}, true
+}
+
+// parseMediaLines calls emit for every player line read from r; blank lines
+// (printed when the last player exits) are skipped.
+func parseMediaLines(r io.Reader, emit func(mediaPlayer)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if p, ok := parseMediaLine(scanner.Text()); ok {
+			emit(p)
+		}
+	}
+}
+
+// media is the controller the /media endpoints use; tests substitute a fake.
+var media mediaController = playerctlController{}
+
+// mediaEvent is a track or playback status change, as pushed on
+// GET /media/stream.
+type mediaEvent struct {
+	ID     uint64      `json:"id"`
+	Type   string      `json:"type"` // track or status
+	Player mediaPlayer `json:"player"`
+	Time   time.Time   `json:"time"`
+}
+
+// mediaEventLog keeps recent media events and each player's last state so
+// repeated reports of an unchanged player are dropped.
+type mediaEventLog struct {
+	mu      sync.Mutex
+	max     int
+	nextID  uint64
+	items   []mediaEvent
+	last    map[string]mediaPlayer
+	changed chan struct{} // closed and replaced on every push
+}
+
+func newMediaEventLog(max int) *mediaEventLog {
+	return &mediaEventLog{
+		max:     max,
+		nextID:  uint64(time.Now().UnixMilli()),
+		last:    map[string]mediaPlayer{},
+		changed: make(chan struct{}),
+	}
+}
+
+// observe records p's state and pushes an event if its track or playback
+// status changed since the last observation.
+func (l *mediaEventLog) observe(p mediaPlayer) (mediaEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev, seen := l.last[p.Name]
+	l.last[p.Name] = p
+	kind := ""
+	switch {
+	case !seen || !prev.sameTrack(p):
+		kind = "track"
+	case prev.Status != p.Status:
+		kind = "status"
+	default:
+		return mediaEvent{}, false
+	}
+	l.nextID++
+	e := mediaEvent{ID: l.nextID, Type: kind, Player: p, Time: time.Now()}
+	l.items = append(l.items, e)
+	if len(l.items) > l.max {
+		l.items = l.items[1:]
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return e, true
+}
+
+// after returns the retained events with an id greater than id.
+func (l *mediaEventLog) after(id uint64) []mediaEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []mediaEvent{}
+	for _, e := range l.items {
+		if e.ID > id {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// wait returns a channel that is closed on the next push.
+func (l *mediaEventLog) wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.changed
+}
+
+var mediaEvents = newMediaEventLog(maxMediaEvents)
+
+// runMediaMonitor feeds mediaEvents from the controller until ctx is
+// cancelled, restarting with backoff if following fails.
+func runMediaMonitor(ctx context.Context) {
+	if _, ok := media.(playerctlController); ok {
+		if _, err := exec.LookPath("playerctl"); err != nil {
+			slog.Warn("playerctl not found; media control disabled")
+			return
+		}
+	}
+
+	backoff := time.Second
+	for {
+		err := media.Follow(ctx, func(p mediaPlayer) {
+			if e, ok := mediaEvents.observe(p); ok {
+				slog.Debug("Media player changed", "player", p.Name, "type", e.Type, "title", p.Title)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Media monitor exited; restarting", "err", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// activeMediaPlayer is the {player} alias for the player the user most
+// likely means: the first one playing, else the first one listed.
+const activeMediaPlayer = "active"
+
+// findMediaPlayer looks up name, which may be activeMediaPlayer, writing the
+// error response itself.
+func findMediaPlayer(ctx context.Context, w http.ResponseWriter, name string) (mediaPlayer, bool) {
+	players, err := media.Players(ctx)
+	if err != nil {
+		slog.Error("Failed to list media players", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to list media players")
+		return mediaPlayer{}, false
+	}
+	if name == activeMediaPlayer && len(players) > 0 {
+		for _, p := range players {
+			if p.Status == "Playing" {
+				return p, true
+			}
+		}
+		return players[0], true
+	}
+	for _, p := range players {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	errorJSON(w, http.StatusNotFound, "media player not found")
+	return mediaPlayer{}, false
+}
+
+// handleListMedia serves GET /media: every MPRIS player with its
+// now-playing metadata, position and playback status.
+func handleListMedia(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), mediaCommandTimeout)
+	defer cancel()
+	players, err := media.Players(ctx)
+	if err != nil {
+		slog.Error("Failed to list media players", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to list media players")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"players": players})
+}
+
+// handleGetMedia serves GET /media/{player}; {player} may be "active".
+func handleGetMedia(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), mediaCommandTimeout)
+	defer cancel()
+	if p, ok := findMediaPlayer(ctx, w, r.PathValue("player")); ok {
+		writeJSON(w, http.StatusOK, p)
+	}
+}
+
+// handleMediaCommand serves POST /media/{player} with a mediaCommand, e.g.
+// {"action": "seek", "offset": -10} or {"action": "volume", "volume": 0.5}.
+// It replies with the player's state after the command.
+func handleMediaCommand(w http.ResponseWriter, r *http.Request) {
+	var cmd mediaCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	if err := cmd.validate(); err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), mediaCommandTimeout)
+	defer cancel()
+	p, ok := findMediaPlayer(ctx, w, r.PathValue("player"))
+	if !ok {
+		return
+	}
+	if err := media.Control(ctx, p.Name, cmd); err != nil {
+		slog.Error("Media command failed", "player", p.Name, "action", cmd.Action, "err", err)
+		errorJSON(w, http.StatusBadGateway, "media player rejected the command")
+		return
+	}
+	slog.Info("Media command sent", "player", p.Name, "action", cmd.Action)
+
+	if updated, err := media.Players(ctx); err == nil {
+		for _, u := range updated {
+			if u.Name == p.Name {
+				p = u
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "success", "player": p})
+}
+
+// handleMediaStream serves GET /media/stream as Server-Sent Events: "track"
+// when a player starts a different track (or appears) and "status" when it
+// plays, pauses or stops. Events after the client's last event id are
+// replayed first.
+func handleMediaStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+
+	after := lastEventID(r)
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	slog.Info("Media stream opened", "client", r.RemoteAddr, "after", after)
+	for {
+		changed := mediaEvents.wait()
+		for _, e := range mediaEvents.after(after) {
+			if err := writeSSE(w, strconv.FormatUint(e.ID, 10), e.Type, e); err != nil {
+				return
+			}
+			after = e.ID
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			slog.Info("Media stream closed", "client", r.RemoteAddr)
+			return
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		}
+	}
+}
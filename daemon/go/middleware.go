@@ -1,13 +1,22 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Tus-Resumable, X-Next-Cursor, ETag, Last-Modified, X-Sync-Version")
 		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, HEAD, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers",
+				"Content-Type, Upload-Length, Upload-Offset, Upload-Metadata, Tus-Resumable, If-None-Match, If-Modified-Since, X-Sync-Base")
+			// OPTIONS doubles as tus capability discovery.
+			if r.URL.Path == tusBasePath || strings.HasPrefix(r.URL.Path, tusBasePath+"/") {
+				setTusDiscoveryHeaders(w.Header())
+			}
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -1,5 +1,14 @@
 package main
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
 type statsResponse struct {
 	CPUUsage       float64 `json:"cpu_usage"`
 	RAMUsage       float64 `json:"ram_usage"`
@@ -7,15 +16,185 @@ type statsResponse struct {
 	BatteryPercent float64 `json:"battery_percent"`
 	IsPlugged      bool    `json:"is_plugged"`
 	Timestamp      float64 `json:"timestamp"`
+
+	// Omitted when the laptop has no audio backend, backlight or logind
+	// session.
+	Audio      *audioState      `json:"audio,omitempty"`
+	Brightness *brightnessState `json:"brightness,omitempty"`
+	Session    *sessionState    `json:"session,omitempty"`
 }
 
 type notificationPayload struct {
-	PackageName string `json:"package_name"`
-	Title       string `json:"title"`
-	Text        string `json:"text"`
-	PostedAt    any    `json:"posted_at"`
+	Event        string           `json:"event"` // "posted" (default) or "removed"
+	Key          string           `json:"key"`
+	PackageName  string           `json:"package_name"`
+	AppLabel     string           `json:"app_label"`
+	Title        string           `json:"title"`
+	Text         string           `json:"text"`
+	BigText      string           `json:"big_text"`
+	Category     string           `json:"category"`
+	Conversation string           `json:"conversation"`
+	Sender       string           `json:"sender"`
+	Icon         string           `json:"icon"`  // base64-encoded PNG/JPEG
+	Image        string           `json:"image"` // base64-encoded PNG/JPEG
+	Progress     *int             `json:"progress"`
+	CanReply     bool             `json:"can_reply"` // notification has a RemoteInput action
+	PostedAt     notificationTime `json:"posted_at"`
+
+	// Decoded attachments, filled in by parseNotificationPayload from either
+	// the base64 fields above or multipart file parts.
+	iconData  []byte
+	imageData []byte
+}
+
+// notificationTime accepts either epoch milliseconds (as the Android
+// StatusBarNotification.postTime is sent) or an RFC3339 string.
+type notificationTime struct {
+	time.Time
+}
+
+// errInvalidPostedAt is returned for a posted_at in neither accepted form.
+var errInvalidPostedAt = errors.New("posted_at must be epoch millis or RFC3339")
+
+func (t *notificationTime) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		return t.parse(s)
+	}
+	var ms json.Number
+	if err := json.Unmarshal(data, &ms); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidPostedAt, err)
+	}
+	return t.parse(ms.String())
+}
+
+// parse handles the string forms: RFC3339, or epoch millis sent as a string
+// (multipart form values are always strings).
+func (t *notificationTime) parse(s string) error {
+	if s == "" {
+		return nil
+	}
+	if ms, err := strconv.ParseFloat(s, 64); err == nil {
+		t.Time = time.UnixMilli(int64(ms))
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return errInvalidPostedAt
+	}
+	t.Time = parsed
+	return nil
 }
 
 type lidInhibitPayload struct {
 	Enabled bool `json:"enabled"`
 }
+
+type laptopNotificationAckPayload struct {
+	ID uint64 `json:"id"`
+}
+
+type phoneReplyPayload struct {
+	Text string `json:"text"`
+}
+
+type phoneReplyAckPayload struct {
+	IDs []uint64 `json:"ids"`
+}
+
+// uploadResult reports the outcome for one file of a POST /upload batch.
+type uploadResult struct {
+	Filename string `json:"filename"`
+	Path     string `json:"path,omitempty"`      // client-supplied relative path
+	StoredAs string `json:"stored_as,omitempty"` // relative to uploadDir
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	Status   string `json:"status"` // "success", "skipped" or "error"
+	Error    string `json:"error,omitempty"`
+	Code     string `json:"code,omitempty"` // machine-readable quota failure
+
+	code int // HTTP status for single-file responses
+}
+
+// backupManifestEntry describes one file in the phone's camera roll.
+type backupManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	MTime  int64  `json:"mtime"` // epoch millis
+	SHA256 string `json:"sha256"`
+}
+
+type backupManifestPayload struct {
+	Files []backupManifestEntry `json:"files"`
+}
+
+// archivePayload selects share files for POST /download/archive: explicit
+// paths, a folder, or both.
+type archivePayload struct {
+	Files []string `json:"files"`
+	Path  string   `json:"path"`
+	Name  string   `json:"name"` // archive filename, defaults to share.zip
+}
+
+type renamePayload struct {
+	NewName  string `json:"new_name"`
+	Conflict string `json:"conflict"` // defaults to fail
+}
+
+// movePayload moves a file between uploadDir ("upload") and shareDir
+// ("share"); Dest optionally names a subfolder of the destination.
+type movePayload struct {
+	Name     string `json:"name"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Dest     string `json:"dest"`
+	Conflict string `json:"conflict"` // defaults to rename
+}
+
+// shareLinkPayload creates a link for Path (relative to shareDir). TTL is
+// in seconds; zero selects defaultShareLinkTTL.
+type shareLinkPayload struct {
+	Path       string `json:"path"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+	SingleUse  bool   `json:"single_use"`
+}
+
+// clipboardPayload sets the laptop clipboard: Text, or an image as base64
+// Data with its MIME type.
+type clipboardPayload struct {
+	Text string `json:"text"`
+	MIME string `json:"mime"`
+	Data string `json:"data"`
+}
+
+type clipboardSettingsPayload struct {
+	Enabled bool `json:"enabled"`
+}
+
+type openURLPayload struct {
+	URL string `json:"url"`
+}
+
+// textPayload sends a snippet to the laptop. Action is clipboard (the
+// default), type or notes.
+type textPayload struct {
+	Text   string `json:"text"`
+	Action string `json:"action"`
+}
+
+// audioPayload changes the default output; omitted fields are left alone.
+type audioPayload struct {
+	Volume *int  `json:"volume"` // percent
+	Muted  *bool `json:"muted"`
+}
+
+type brightnessPayload struct {
+	Percent *int `json:"percent"`
+}
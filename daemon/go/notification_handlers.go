@@ -1,56 +1,526 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-func handlePhoneNotification(w http.ResponseWriter, r *http.Request) {
+// errAttachmentTooLarge distinguishes size-limit failures (413) from other
+// validation errors (400).
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+// notificationEventRemoved is the "event" value the phone sends when a
+// notification is dismissed or cancelled on the device.
+const notificationEventRemoved = "removed"
+
+// notificationHistory remembers recent phone notifications so later
+// dismissals can find the matching desktop popup.
+var notificationHistory = newNotificationStore(maxNotificationHistory)
+
+// popupWaiters tracks the `notify-send --wait` process listening for the
+// Reply action of each popup id. Only one may run per popup: every waiter
+// on a replaced popup would otherwise see the same click.
+type popupWaiters struct {
+	mu    sync.Mutex
+	procs map[uint32]*os.Process
+}
+
+var replyWaiters = &popupWaiters{procs: map[uint32]*os.Process{}}
+
+// stop kills the waiter for popup id, if any. The popup itself stays open.
+func (p *popupWaiters) stop(id uint32) {
+	p.mu.Lock()
+	proc, ok := p.procs[id]
+	delete(p.procs, id)
+	p.mu.Unlock()
+	if ok {
+		_ = proc.Kill()
+	}
+}
+
+func (p *popupWaiters) add(id uint32, proc *os.Process) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.procs[id] = proc
+}
+
+// done forgets proc once it exits, unless a newer waiter took its place.
+func (p *popupWaiters) done(id uint32, proc *os.Process) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.procs[id] == proc {
+		delete(p.procs, id)
+	}
+}
+
+// showDesktopNotification runs notify-send with args and returns the id the
+// notification server assigned. A non-zero replaceID updates that popup in
+// place, stopping the previous Reply waiter. If onReply is non-nil the popup
+// gets a "Reply" action and onReply is called from a background goroutine
+// when it is clicked. It is a variable so tests can stub out the desktop
+// session.
+var showDesktopNotification = func(args []string, replaceID uint32, onReply func()) (uint32, error) {
+	// Mirrors Python's `which("notify-send")`.
+	notifySend, err := exec.LookPath("notify-send")
+	if err != nil {
+		return 0, fmt.Errorf("notify-send not found; skipping desktop popup")
+	}
+	if !notifySendHasPopupIDs() {
+		// Without ids the popup can't be replaced, closed or replied to.
+		return 0, exec.Command(notifySend, args...).Run()
+	}
+	flags := []string{"--print-id"}
+	if replaceID != 0 {
+		replyWaiters.stop(replaceID)
+		flags = append(flags, "--replace-id="+strconv.FormatUint(uint64(replaceID), 10))
+	}
+	if onReply == nil {
+		out, err := exec.Command(notifySend, append(flags, args...)...).Output()
+		if err != nil {
+			return 0, err
+		}
+		return parsePopupID(string(out))
+	}
+
+	// With --wait notify-send prints the id, then blocks until the popup
+	// closes, printing the key of any action that was invoked.
+	flags = append(flags, "--action=reply=Reply", "--wait")
+	cmd := exec.Command(notifySend, append(flags, args...)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(stdout)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		_ = cmd.Wait()
+		return 0, fmt.Errorf("notify-send exited before printing an id: %w", err)
+	}
+	id, err := parsePopupID(line)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return 0, err
+	}
+	replyWaiters.add(id, cmd.Process)
+	go func() {
+		defer replyWaiters.done(id, cmd.Process)
+		defer cmd.Wait()
+		for {
+			line, err := reader.ReadString('\n')
+			if strings.TrimSpace(line) == "reply" {
+				onReply()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return id, nil
+}
+
+// notifySendHasPopupIDs reports whether notify-send supports --print-id,
+// --replace-id, --action and --wait, which arrived in libnotify 0.7.10.
+// Older versions reject them as unknown options.
+var notifySendHasPopupIDs = sync.OnceValue(func() bool {
+	out, err := exec.Command("notify-send", "--help").Output()
+	if err != nil {
+		return false
+	}
+	return notifySendHelpHasPopupIDs(string(out))
+})
+
+func notifySendHelpHasPopupIDs(help string) bool {
+	for _, flag := range []string{"--print-id", "--replace-id", "--action", "--wait"} {
+		if !strings.Contains(help, flag) {
+			return false
+		}
+	}
+	return true
+}
+
+func parsePopupID(out string) (uint32, error) {
+	id, err := strconv.ParseUint(strings.TrimSpace(out), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected notify-send output %q", out)
+	}
+	return uint32(id), nil
+}
+
+// closeDesktopNotification closes a popup previously shown by
+// showDesktopNotification. It is a variable so tests can stub it.
+var closeDesktopNotification = func(id uint32) error {
+	return exec.Command("gdbus", "call", "--session",
+		"--dest", "org.freedesktop.Notifications",
+		"--object-path", "/org/freedesktop/Notifications",
+		"--method", "org.freedesktop.Notifications.CloseNotification",
+		strconv.FormatUint(uint64(id), 10),
+	).Run()
+}
+
+// androidCategoryHints maps Android Notification.CATEGORY_* values onto the
+// closest freedesktop notification category. Unmapped categories are still
+// accepted; they just don't produce a hint.
+var androidCategoryHints = map[string]string{
+	"msg":      "im.received",
+	"email":    "email.arrived",
+	"progress": "transfer",
+	"err":      "device.error",
+}
+
+// parseNotificationPayload decodes a JSON or multipart/form-data request
+// into a notificationPayload and decodes any attachments.
+func parseNotificationPayload(r *http.Request) (*notificationPayload, error) {
 	var payload notificationPayload
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxNotificationBodyBytes); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				return nil, errAttachmentTooLarge
+			}
+			return nil, fmt.Errorf("invalid multipart payload")
+		}
+		payload.Event = r.FormValue("event")
+		payload.Key = r.FormValue("key")
+		payload.PackageName = r.FormValue("package_name")
+		payload.AppLabel = r.FormValue("app_label")
+		payload.Title = r.FormValue("title")
+		payload.Text = r.FormValue("text")
+		payload.BigText = r.FormValue("big_text")
+		payload.Category = r.FormValue("category")
+		payload.Conversation = r.FormValue("conversation")
+		payload.Sender = r.FormValue("sender")
+		payload.Icon = r.FormValue("icon")
+		payload.Image = r.FormValue("image")
+		if v := r.FormValue("progress"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("progress must be an integer")
+			}
+			payload.Progress = &n
+		}
+		if v := r.FormValue("can_reply"); v != "" {
+			canReply, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("can_reply must be a boolean")
+			}
+			payload.CanReply = canReply
+		}
+		if err := payload.PostedAt.parse(r.FormValue("posted_at")); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if payload.iconData, err = readFormAttachment(r, "icon", maxNotificationIconBytes); err != nil {
+			return nil, err
+		}
+		if payload.imageData, err = readFormAttachment(r, "image", maxNotificationImageBytes); err != nil {
+			return nil, err
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, errAttachmentTooLarge
+		}
+		if errors.Is(err, errInvalidPostedAt) {
+			return nil, errInvalidPostedAt
+		}
+		return nil, fmt.Errorf("Invalid JSON payload")
+	}
+
+	if payload.Progress != nil && (*payload.Progress < 0 || *payload.Progress > 100) {
+		return nil, fmt.Errorf("progress must be between 0 and 100")
+	}
+
+	var err error
+	if payload.iconData == nil {
+		if payload.iconData, err = decodeAttachment("icon", payload.Icon, maxNotificationIconBytes); err != nil {
+			return nil, err
+		}
+	}
+	if payload.imageData == nil {
+		if payload.imageData, err = decodeAttachment("image", payload.Image, maxNotificationImageBytes); err != nil {
+			return nil, err
+		}
+	}
+	return &payload, nil
+}
+
+// readFormAttachment reads an optional file part, enforcing limit.
+func readFormAttachment(r *http.Request, field string, limit int64) ([]byte, error) {
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		return nil, nil
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s", field)
+	}
+	return checkAttachment(field, data, limit)
+}
+
+// decodeAttachment decodes an optional base64 attachment, enforcing limit.
+func decodeAttachment(field, encoded string, limit int64) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	// Tolerate data URLs ("data:image/png;base64,....").
+	if i := strings.Index(encoded, ";base64,"); i >= 0 && strings.HasPrefix(encoded, "data:") {
+		encoded = encoded[i+len(";base64,"):]
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(encoded))) > limit+2 {
+		return nil, fmt.Errorf("%s: %w", field, errAttachmentTooLarge)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid base64", field)
+	}
+	return checkAttachment(field, data, limit)
+}
+
+func checkAttachment(field string, data []byte, limit int64) ([]byte, error) {
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s: %w", field, errAttachmentTooLarge)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	switch http.DetectContentType(data) {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return data, nil
+	}
+	return nil, fmt.Errorf("%s must be a PNG, JPEG, GIF or WebP image", field)
+}
+
+// saveNotificationMedia writes an attachment to notificationMediaDir, named by
+// content hash so repeated app icons are stored once, and prunes stale files.
+func saveNotificationMedia(data []byte) (string, error) {
+	if err := ensureDir(notificationMediaDir); err != nil {
+		return "", err
+	}
+	pruneNotificationMedia()
+
+	sum := sha256.Sum256(data)
+	ext := ".img"
+	if exts, _ := mime.ExtensionsByType(http.DetectContentType(data)); len(exts) > 0 {
+		ext = exts[0]
+	}
+	path := filepath.Join(notificationMediaDir, hex.EncodeToString(sum[:16])+ext)
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+		return path, nil
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func pruneNotificationMedia() {
+	entries, err := os.ReadDir(notificationMediaDir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-notificationMediaTTL)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		if info.ModTime().Before(cutoff) {
+			_ = os.Remove(filepath.Join(notificationMediaDir, entry.Name()))
+		}
+	}
+}
+
+// notifySendArgs builds the notify-send argument list for a payload whose
+// fields have already been trimmed and truncated.
+func notifySendArgs(p *notificationPayload, iconPath, imagePath string) []string {
+	summary := "Phone notification"
+	switch {
+	case p.Title != "":
+		summary = "Phone: " + p.Title
+	case p.Conversation != "":
+		summary = "Phone: " + p.Conversation
+	}
+
+	body := p.Text
+	if p.BigText != "" {
+		body = p.BigText
+	}
+	if p.Sender != "" && p.Sender != p.Title && body != "" {
+		body = p.Sender + ": " + body
+	}
+	if body == "" {
+		body = p.AppLabel
+	}
+
+	args := []string{"--app-name=Phone Sync"}
+	if iconPath != "" {
+		args = append(args, "--icon="+iconPath)
+	}
+	if imagePath != "" {
+		args = append(args, "--hint=string:image-path:"+imagePath)
+	}
+	if hint, ok := androidCategoryHints[p.Category]; ok {
+		args = append(args, "--category="+hint)
+	}
+	if p.Progress != nil {
+		args = append(args, "--hint=int:value:"+strconv.Itoa(*p.Progress))
+	}
+	return append(args, truncate(summary, 200), truncate(body, 500))
+}
+
+func handlePhoneNotification(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxNotificationBodyBytes)
+	payload, err := parseNotificationPayload(r)
+	if err != nil {
+		if errors.Is(err, errAttachmentTooLarge) {
+			errorJSON(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		errorJSON(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	appName := truncate(strings.TrimSpace(payload.PackageName), 200)
-	if appName == "" {
-		appName = "unknown_app"
+	if strings.EqualFold(strings.TrimSpace(payload.Event), notificationEventRemoved) {
+		dismissPhoneNotification(w, payload.Key)
+		return
 	}
-	title := truncate(strings.TrimSpace(payload.Title), 200)
-	text := truncate(strings.TrimSpace(payload.Text), 500)
 
-	if title == "" && text == "" {
+	payload.PackageName = truncate(strings.TrimSpace(payload.PackageName), 200)
+	if payload.PackageName == "" {
+		payload.PackageName = "unknown_app"
+	}
+	payload.AppLabel = truncate(strings.TrimSpace(payload.AppLabel), 200)
+	if payload.AppLabel == "" {
+		payload.AppLabel = payload.PackageName
+	}
+	payload.Title = truncate(strings.TrimSpace(payload.Title), 200)
+	payload.Text = truncate(strings.TrimSpace(payload.Text), 500)
+	payload.BigText = truncate(strings.TrimSpace(payload.BigText), 2000)
+	payload.Category = truncate(strings.TrimSpace(payload.Category), 64)
+	payload.Conversation = truncate(strings.TrimSpace(payload.Conversation), 200)
+	payload.Sender = truncate(strings.TrimSpace(payload.Sender), 200)
+
+	if payload.Title == "" && payload.Text == "" && payload.BigText == "" {
 		errorJSON(w, http.StatusBadRequest, "Missing title/text")
 		return
 	}
 
 	slog.Info("Phone notification",
-		"app", appName,
-		"title", title,
-		"text", text,
-		"posted_at", payload.PostedAt,
+		"app", payload.PackageName,
+		"label", payload.AppLabel,
+		"category", payload.Category,
+		"title", payload.Title,
+		"text", payload.Text,
+		"sender", payload.Sender,
+		"has_icon", payload.iconData != nil,
+		"has_image", payload.imageData != nil,
+		"posted_at", payload.PostedAt.Time,
 	)
 
-	// Call notify-send if available (mirrors Python's `which("notify-send")`)
-	notifySend, err := exec.LookPath("notify-send")
-	if err == nil {
-		summary := "Phone notification"
-		if title != "" {
-			summary = "Phone: " + title
+	var iconPath, imagePath string
+	if payload.iconData != nil {
+		if iconPath, err = saveNotificationMedia(payload.iconData); err != nil {
+			slog.Warn("Failed to save notification icon", "err", err)
 		}
-		body := text
-		if body == "" {
-			body = appName
+	}
+	if payload.imageData != nil {
+		if imagePath, err = saveNotificationMedia(payload.imageData); err != nil {
+			slog.Warn("Failed to save notification image", "err", err)
+		}
+	}
+
+	// Re-posts of the same key (e.g. a message thread gaining a line) replace
+	// the existing popup instead of stacking a new one.
+	var replaceID uint32
+	if payload.Key != "" {
+		replaceID = notificationHistory.put(notificationEntry{
+			Key:         payload.Key,
+			PackageName: payload.PackageName,
+			AppLabel:    payload.AppLabel,
+			Title:       payload.Title,
+			Text:        payload.Text,
+			PostedAt:    payload.PostedAt.Time,
+			ReceivedAt:  time.Now(),
+			CanReply:    payload.CanReply,
+		})
+	}
+
+	var onReply func()
+	if payload.CanReply && payload.Key != "" {
+		key, title := payload.Key, payload.Title
+		if title == "" {
+			title = payload.AppLabel
+		}
+		onReply = func() { replyFromDesktop(key, title) }
+	}
+
+	id, err := showDesktopNotification(notifySendArgs(payload, iconPath, imagePath), replaceID, onReply)
+	if err != nil {
+		slog.Warn("Desktop popup failed", "err", err)
+	} else if payload.Key != "" && !notificationHistory.setPopupID(payload.Key, id) && id != 0 {
+		// Dismissed on the phone before the popup had an id to close.
+		if err := closeDesktopNotification(id); err != nil {
+			slog.Warn("Failed to close desktop popup", "key", payload.Key, "id", id, "err", err)
 		}
-		cmd := exec.Command(notifySend, "--app-name=Phone Sync",
-			truncate(summary, 200), truncate(body, 500))
-		_ = cmd.Run()
-	} else {
-		slog.Warn("notify-send not found; skipping desktop popup")
 	}
 
 	writeJSON(w, http.StatusOK, map[string]string{"status": "success"})
 }
+
+// handleDismissPhoneNotification serves POST /phone-notification/{key}/dismiss.
+func handleDismissPhoneNotification(w http.ResponseWriter, r *http.Request) {
+	dismissPhoneNotification(w, r.PathValue("key"))
+}
+
+// dismissPhoneNotification closes the desktop popup for key and marks its
+// history entry as dismissed. Shared by the dismiss route and the "removed"
+// event variant of POST /phone-notification.
+func dismissPhoneNotification(w http.ResponseWriter, key string) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		errorJSON(w, http.StatusBadRequest, "Missing key")
+		return
+	}
+
+	popupID, ok := notificationHistory.dismiss(key)
+	if !ok {
+		errorJSON(w, http.StatusNotFound, "Unknown notification key")
+		return
+	}
+	if popupID != 0 {
+		if err := closeDesktopNotification(popupID); err != nil {
+			slog.Warn("Failed to close desktop popup", "key", key, "id", popupID, "err", err)
+		}
+	}
+
+	slog.Info("Phone notification dismissed", "key", key)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "success", "key": key})
+}
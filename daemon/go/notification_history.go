@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// notificationEntry is one phone notification as seen by the daemon.
+type notificationEntry struct {
+	Key         string     `json:"key"`
+	PackageName string     `json:"package_name"`
+	AppLabel    string     `json:"app_label"`
+	Title       string     `json:"title"`
+	Text        string     `json:"text"`
+	PostedAt    time.Time  `json:"posted_at"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	CanReply    bool       `json:"can_reply"`
+	Dismissed   bool       `json:"dismissed"`
+	DismissedAt *time.Time `json:"dismissed_at,omitempty"`
+
+	// popupID is the freedesktop notification id returned by notify-send,
+	// used to replace or close the desktop popup for this key.
+	popupID uint32
+}
+
+// notificationStore keeps the most recent phone notifications in memory,
+// keyed by the StatusBarNotification key the phone sends.
+type notificationStore struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*notificationEntry
+	order   []string // insertion order, oldest first
+}
+
+func newNotificationStore(max int) *notificationStore {
+	return &notificationStore{max: max, entries: make(map[string]*notificationEntry)}
+}
+
+// put records entry, replacing any previous entry with the same key, and
+// returns the popup id of the replaced entry (0 if none).
+func (s *notificationStore) put(entry notificationEntry) (prevPopupID uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if prev, ok := s.entries[entry.Key]; ok {
+		prevPopupID = prev.popupID
+		s.removeFromOrder(entry.Key)
+	}
+	s.entries[entry.Key] = &entry
+	s.order = append(s.order, entry.Key)
+
+	for len(s.order) > s.max {
+		delete(s.entries, s.order[0])
+		s.order = s.order[1:]
+	}
+	return prevPopupID
+}
+
+// setPopupID records the desktop popup shown for key. It reports false,
+// recording nothing, if the entry was dismissed while the popup was being
+// shown; the caller then closes the popup itself.
+func (s *notificationStore) setPopupID(key string, id uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if ok && e.Dismissed {
+		return false
+	}
+	if ok {
+		e.popupID = id
+	}
+	return true
+}
+
+// dismiss marks the entry for key as dismissed and returns its popup id.
+// ok is false if the key is unknown.
+func (s *notificationStore) dismiss(key string) (popupID uint32, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return 0, false
+	}
+	popupID = e.popupID
+	if !e.Dismissed {
+		now := time.Now()
+		e.Dismissed = true
+		e.DismissedAt = &now
+	}
+	e.popupID = 0
+	return popupID, true
+}
+
+func (s *notificationStore) get(key string) (notificationEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return notificationEntry{}, false
+	}
+	return *e, true
+}
+
+func (s *notificationStore) removeFromOrder(key string) {
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
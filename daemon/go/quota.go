@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// deviceIDHeader lets the phone identify itself, e.g. as a sync replica.
+// Sync requires it; other requests without it are labelled with their
+// client IP.
+const deviceIDHeader = "X-Device-ID"
+
+// quotaError is a structured upload rejection, returned as JSON before any
+// bytes reach uploadDir.
+type quotaError struct {
+	httpStatus int
+	Status     string `json:"status"` // always "error"
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Limit      int64  `json:"limit"`
+	Requested  int64  `json:"requested"`
+}
+
+func (e *quotaError) Error() string { return e.Message }
+
+func newQuotaError(status int, code string, limit, requested int64, format string, args ...any) *quotaError {
+	return &quotaError{
+		httpStatus: status,
+		Status:     "error",
+		Code:       code,
+		Message:    fmt.Sprintf(format, args...),
+		Limit:      limit,
+		Requested:  requested,
+	}
+}
+
+func writeQuotaError(w http.ResponseWriter, e *quotaError) {
+	writeJSON(w, e.httpStatus, e)
+}
+
+// uploadDeviceID identifies the uploading device.
+func uploadDeviceID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get(deviceIDHeader)); id != "" {
+		return truncate(id, 64)
+	}
+	return uploadQuotaKey(r)
+}
+
+// uploadQuotaKey is who the daily upload volume is charged to: the client's
+// IP. Unlike deviceIDHeader, a client can't change it at will to reset its
+// allowance.
+func uploadQuotaKey(r *http.Request) string {
+	return clientIP(r)
+}
+
+// checkUploadFileSize enforces maxUploadFileBytes for a single file.
+func checkUploadFileSize(size int64) *quotaError {
+	if maxUploadFileBytes > 0 && size > maxUploadFileBytes {
+		return newQuotaError(http.StatusRequestEntityTooLarge, "file_too_large",
+			maxUploadFileBytes, size, "file exceeds the %d byte limit", maxUploadFileBytes)
+	}
+	return nil
+}
+
+// checkUploadQuota reports whether size more bytes from client (an
+// uploadQuotaKey), bound for dir, fit within the directory quota, the
+// free-space floor of dir's filesystem and the client's daily volume.
+// Limits set to zero are disabled.
+func checkUploadQuota(dir, client string, size int64) *quotaError {
+	if maxUploadDirBytes > 0 {
+		used := dirSize(dir)
+		if used+size > maxUploadDirBytes {
+			return newQuotaError(http.StatusInsufficientStorage, "upload_dir_full",
+				maxUploadDirBytes, size, "upload directory quota exceeded (%d of %d bytes used)", used, maxUploadDirBytes)
+		}
+	}
+	if minFreeDiskBytes > 0 {
+		if free, err := freeDiskBytes(dir); err == nil && free-size < minFreeDiskBytes {
+			return newQuotaError(http.StatusInsufficientStorage, "insufficient_disk_space",
+				minFreeDiskBytes, size, "upload would leave less than %d bytes free", minFreeDiskBytes)
+		}
+	}
+	if maxDailyUploadBytesPerClient > 0 {
+		used := dailyUploads.used(client)
+		if used+size > maxDailyUploadBytesPerClient {
+			return newQuotaError(http.StatusRequestEntityTooLarge, "daily_quota_exceeded",
+				maxDailyUploadBytesPerClient, size, "daily upload volume exceeded (%d of %d bytes used today)", used, maxDailyUploadBytesPerClient)
+		}
+	}
+	return nil
+}
+
+// freeDiskBytes returns the space available to unprivileged users on the
+// filesystem holding path. It is a variable so tests can fake a full disk.
+var freeDiskBytes = func(path string) (int64, error) {
+	usage, err := disk.Usage(path)
+	if err != nil {
+		return 0, err
+	}
+	return int64(usage.Free), nil
+}
+
+// dirSize sums the sizes of regular files below dir.
+func dirSize(dir string) int64 {
+	var total int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// uploadVolume tracks bytes uploaded per client for the current local day.
+type uploadVolume struct {
+	mu    sync.Mutex
+	day   string
+	bytes map[string]int64
+	now   func() time.Time // replaceable in tests
+}
+
+var dailyUploads = &uploadVolume{bytes: map[string]int64{}, now: time.Now}
+
+// rollLocked resets the counters when the day changes.
+func (v *uploadVolume) rollLocked() {
+	if today := v.now().Format(time.DateOnly); today != v.day {
+		v.day = today
+		v.bytes = map[string]int64{}
+	}
+}
+
+func (v *uploadVolume) used(client string) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.rollLocked()
+	return v.bytes[client]
+}
+
+func (v *uploadVolume) record(client string, n int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.rollLocked()
+	v.bytes[client] += n
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+var phoneReplies = newPhoneReplyQueue(phoneReplyTTL, maxPendingReplies)
+
+// promptReplyText asks the laptop user for reply text with a zenity or
+// kdialog input box. It is a variable so tests can stub the dialog.
+var promptReplyText = func(prompt string) (string, error) {
+	if zenity, err := exec.LookPath("zenity"); err == nil {
+		out, err := exec.Command(zenity, "--entry", "--title=Reply", "--text="+prompt).Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	if kdialog, err := exec.LookPath("kdialog"); err == nil {
+		out, err := exec.Command(kdialog, "--title", "Reply", "--inputbox", prompt).Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	return "", fmt.Errorf("neither zenity nor kdialog found")
+}
+
+// replyFromDesktop runs when the "Reply" action on a phone notification
+// popup is clicked.
+func replyFromDesktop(key, title string) {
+	text, err := promptReplyText("Reply to " + title)
+	if err != nil {
+		slog.Warn("Reply prompt failed", "key", key, "err", err)
+		return
+	}
+	if text == "" {
+		return
+	}
+	reply := phoneReplies.add(key, truncate(text, maxReplyLength))
+	slog.Info("Queued reply from desktop", "key", key, "id", reply.ID)
+}
+
+// handlePhoneNotificationReply serves POST /phone-notification/{key}/reply,
+// the scriptable counterpart of the popup's "Reply" action.
+func handlePhoneNotificationReply(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimSpace(r.PathValue("key"))
+	var payload phoneReplyPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	text := strings.TrimSpace(payload.Text)
+	if text == "" {
+		errorJSON(w, http.StatusBadRequest, "Missing text")
+		return
+	}
+
+	entry, ok := notificationHistory.get(key)
+	if !ok {
+		errorJSON(w, http.StatusNotFound, "Unknown notification key")
+		return
+	}
+	if !entry.CanReply {
+		errorJSON(w, http.StatusConflict, "Notification does not accept replies")
+		return
+	}
+
+	reply := phoneReplies.add(key, truncate(text, maxReplyLength))
+	slog.Info("Queued reply", "key", key, "id", reply.ID)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": "success",
+		"reply":  reply,
+	})
+}
+
+// handleListPhoneReplies serves GET /phone-notification/replies. Replies stay
+// queued until acknowledged, so a phone that crashes mid-send retries them.
+func handleListPhoneReplies(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, phoneReplies.pending())
+}
+
+// handleAckPhoneReplies serves POST /phone-notification/replies/ack.
+func handleAckPhoneReplies(w http.ResponseWriter, r *http.Request) {
+	var payload phoneReplyAckPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	if len(payload.IDs) == 0 {
+		errorJSON(w, http.StatusBadRequest, "Missing ids")
+		return
+	}
+
+	removed := phoneReplies.ack(payload.IDs)
+	slog.Info("Phone replies acknowledged", "ids", payload.IDs, "removed", removed)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":  "success",
+		"removed": removed,
+	})
+}
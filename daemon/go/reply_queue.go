@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// phoneReply is a reply typed on the laptop, waiting for the phone to send
+// it through the original notification's RemoteInput.
+type phoneReply struct {
+	ID        uint64    `json:"id"`
+	Key       string    `json:"key"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// phoneReplyQueue holds replies until the phone acknowledges them or they
+// expire. Expiry keeps a phone that was offline for an hour from sending a
+// stale "on my way".
+type phoneReplyQueue struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	max    int
+	nextID uint64
+	items  []phoneReply
+	now    func() time.Time // replaceable in tests
+}
+
+func newPhoneReplyQueue(ttl time.Duration, max int) *phoneReplyQueue {
+	return &phoneReplyQueue{ttl: ttl, max: max, now: time.Now}
+}
+
+// add queues text as a reply to the notification identified by key. The
+// oldest reply is dropped when the queue is full.
+func (q *phoneReplyQueue) add(key, text string) phoneReply {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.purgeLocked()
+
+	now := q.now()
+	q.nextID++
+	reply := phoneReply{
+		ID:        q.nextID,
+		Key:       key,
+		Text:      text,
+		CreatedAt: now,
+		ExpiresAt: now.Add(q.ttl),
+	}
+	q.items = append(q.items, reply)
+	if len(q.items) > q.max {
+		q.items = q.items[1:]
+	}
+	return reply
+}
+
+// pending returns the unexpired, unacknowledged replies, oldest first.
+func (q *phoneReplyQueue) pending() []phoneReply {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.purgeLocked()
+	return append([]phoneReply{}, q.items...)
+}
+
+// ack removes the replies with the given ids and returns how many were found.
+func (q *phoneReplyQueue) ack(ids []uint64) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	drop := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+	kept := q.items[:0]
+	removed := 0
+	for _, reply := range q.items {
+		if drop[reply.ID] {
+			removed++
+			continue
+		}
+		kept = append(kept, reply)
+	}
+	q.items = kept
+	return removed
+}
+
+func (q *phoneReplyQueue) purgeLocked() {
+	now := q.now()
+	kept := q.items[:0]
+	for _, reply := range q.items {
+		if now.Before(reply.ExpiresAt) {
+			kept = append(kept, reply)
+		}
+	}
+	q.items = kept
+}
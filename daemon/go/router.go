@@ -26,13 +26,73 @@ func newMux() *http.ServeMux {
 
 	mux.HandleFunc("POST /sleep", handleSleep)
 	mux.HandleFunc("POST /phone-notification", handlePhoneNotification)
+	mux.HandleFunc("POST /phone-notification/{key}/dismiss", handleDismissPhoneNotification)
+	mux.HandleFunc("POST /phone-notification/{key}/reply", handlePhoneNotificationReply)
+	mux.HandleFunc("GET /phone-notification/replies", handleListPhoneReplies)
+	mux.HandleFunc("POST /phone-notification/replies/ack", handleAckPhoneReplies)
+
+	mux.HandleFunc("GET /laptop-notifications", handleListLaptopNotifications)
+	mux.HandleFunc("GET /laptop-notifications/stream", handleLaptopNotificationStream)
+	mux.HandleFunc("POST /laptop-notifications/ack", handleAckLaptopNotifications)
 
 	mux.HandleFunc("POST /upload", handleUpload)
 	mux.HandleFunc("GET /upload", methodNotAllowed("POST"))
+	mux.HandleFunc("PUT /files/upload/{name}", handleRawUpload)
+
+	mux.HandleFunc("POST "+tusBasePath, handleTusCreate)
+	mux.HandleFunc("HEAD "+tusBasePath+"/{id}", handleTusHead)
+	mux.HandleFunc("PATCH "+tusBasePath+"/{id}", handleTusPatch)
+	mux.HandleFunc("DELETE "+tusBasePath+"/{id}", handleTusDelete)
+
+	mux.HandleFunc("POST /backup/manifest", handleBackupManifest)
+	mux.HandleFunc("PUT /backup/files/{sha256}", handleBackupUpload)
+
+	mux.HandleFunc("GET /hooks", handleListHooks)
+	mux.HandleFunc("GET /hooks/results", handleHookResults)
 
 	mux.HandleFunc("POST /inhibit-lid-sleep", handleInhibitLidSleep)
 	mux.HandleFunc("GET /list-files", handleListFiles)
-	mux.HandleFunc("GET /download/{filename}", handleDownload)
+	mux.HandleFunc("GET /download/{filename...}", handleDownload)
+	mux.HandleFunc("POST /download/archive", handleDownloadArchive)
+	mux.HandleFunc("GET /thumbnail/{filename...}", handleThumbnail)
+	mux.HandleFunc("DELETE /files/{name}", handleDeleteFile)
+	mux.HandleFunc("POST /files/{name}/rename", handleRenameFile)
+	mux.HandleFunc("POST /files/move", handleMoveFile)
+	mux.HandleFunc("GET /files/events", handleShareEvents)
+
+	mux.HandleFunc("POST /share-links", handleCreateShareLink)
+	mux.HandleFunc("GET /share-links", handleListShareLinks)
+	mux.HandleFunc("DELETE /share-links/{token}", handleRevokeShareLink)
+	mux.HandleFunc("GET /s/{token}", handleShareLinkDownload)
+
+	mux.HandleFunc("GET /clipboard", handleGetClipboard)
+	mux.HandleFunc("POST /clipboard", handleSetClipboard)
+	mux.HandleFunc("GET /clipboard/stream", handleClipboardStream)
+	mux.HandleFunc("GET /clipboard/settings", handleClipboardSettings)
+	mux.HandleFunc("POST /clipboard/settings", handleClipboardSettings)
+
+	mux.HandleFunc("POST /open-url", handleOpenURL)
+	mux.HandleFunc("POST /text", handleText)
+	mux.HandleFunc("GET /text/history", handleTextHistory)
+
+	mux.HandleFunc("GET /media", handleListMedia)
+	mux.HandleFunc("GET /media/stream", handleMediaStream)
+	mux.HandleFunc("GET /media/{player}", handleGetMedia)
+	mux.HandleFunc("POST /media/{player}", handleMediaCommand)
+
+	mux.HandleFunc("GET /audio", handleGetAudio)
+	mux.HandleFunc("POST /audio", handleSetAudio)
+	mux.HandleFunc("GET /display/brightness", handleGetBrightness)
+	mux.HandleFunc("POST /display/brightness", handleSetBrightness)
+
+	mux.HandleFunc("GET /session", handleGetSession)
+	mux.HandleFunc("POST /session/lock", sessionLockHandler(true))
+	mux.HandleFunc("POST /session/unlock", sessionLockHandler(false))
+
+	mux.HandleFunc("GET /sync/{pair}/index", handleSyncIndex)
+	mux.HandleFunc("GET /sync/{pair}/files/{path...}", handleSyncDownload)
+	mux.HandleFunc("PUT /sync/{pair}/files/{path...}", handleSyncUpload)
+	mux.HandleFunc("DELETE /sync/{pair}/files/{path...}", handleSyncDelete)
 
 	// Catch-all 404
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
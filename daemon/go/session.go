@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionState is the logind state of the desktop session the daemon runs
+// in, plus every user with a session on the machine.
+type sessionState struct {
+	ID          string   `json:"id"`
+	User        string   `json:"user"`
+	Seat        string   `json:"seat"`
+	Type        string   `json:"type"`  // x11, wayland, tty...
+	State       string   `json:"state"` // online, active or closing
+	Active      bool     `json:"active"`
+	Locked      bool     `json:"locked"`
+	Idle        bool     `json:"idle"`
+	IdleSeconds int64    `json:"idle_seconds"`
+	Users       []string `json:"users"`
+}
+
+// runLoginctl runs loginctl and returns its output. It is a variable so
+// tests can replay canned output.
+var runLoginctl = func(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, "loginctl", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("loginctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// errSessionDenied means polkit refused a lock or unlock.
+var errSessionDenied = errors.New("not permitted by logind")
+
+// parseLoginctlProperties parses show-session style "Key=Value" lines.
+func parseLoginctlProperties(out []byte) map[string]string {
+	props := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			props[k] = v
+		}
+	}
+	return props
+}
+
+// currentSessionID finds the daemon's session: $XDG_SESSION_ID when started
+// from the session, else the user's graphical session (for a systemd user
+// service, which has none of its own).
+func currentSessionID(ctx context.Context) (string, error) {
+	if id := os.Getenv("XDG_SESSION_ID"); id != "" {
+		return id, nil
+	}
+	out, err := runLoginctl(ctx, "show-user", strconv.Itoa(os.Getuid()), "--property=Display", "--value")
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(out))
+	if id == "" {
+		return "", fmt.Errorf("user has no graphical session")
+	}
+	return id, nil
+}
+
+// readSession reports the current session's state.
+func readSession(ctx context.Context) (sessionState, error) {
+	id, err := currentSessionID(ctx)
+	if err != nil {
+		return sessionState{}, err
+	}
+	out, err := runLoginctl(ctx, "show-session", id,
+		"--property=Id", "--property=Name", "--property=Seat", "--property=Type", "--property=State",
+		"--property=Active", "--property=LockedHint", "--property=IdleHint", "--property=IdleSinceHint")
+	if err != nil {
+		return sessionState{}, err
+	}
+	props := parseLoginctlProperties(out)
+	s := sessionState{
+		ID:     props["Id"],
+		User:   props["Name"],
+		Seat:   props["Seat"],
+		Type:   props["Type"],
+		State:  props["State"],
+		Active: props["Active"] == "yes",
+		Locked: props["LockedHint"] == "yes",
+		Idle:   props["IdleHint"] == "yes",
+		Users:  []string{},
+	}
+	// IdleSinceHint is microseconds since the epoch.
+	if since, err := strconv.ParseInt(props["IdleSinceHint"], 10, 64); err == nil && s.Idle && since > 0 {
+		s.IdleSeconds = max(0, int64(time.Since(time.UnixMicro(since)).Seconds()))
+	}
+
+	// "UID USER [LINGER STATE]" per line.
+	out, err = runLoginctl(ctx, "list-users", "--no-legend")
+	if err != nil {
+		return sessionState{}, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			s.Users = append(s.Users, fields[1])
+		}
+	}
+	return s, nil
+}
+
+// setSessionLocked locks or unlocks the current session. Unlocking is
+// refused unless allowSessionUnlock is set: it hands the desktop to whoever
+// holds the phone.
+func setSessionLocked(ctx context.Context, locked bool) error {
+	if !locked && !allowSessionUnlock {
+		return errSessionDenied
+	}
+	id, err := currentSessionID(ctx)
+	if err != nil {
+		return err
+	}
+	verb := "lock-session"
+	if !locked {
+		verb = "unlock-session"
+	}
+	if _, err := runLoginctl(ctx, verb, id); err != nil {
+		msg := strings.ToLower(err.Error())
+		if strings.Contains(msg, "access denied") || strings.Contains(msg, "authentication required") {
+			return fmt.Errorf("%w: %v", errSessionDenied, err)
+		}
+		return err
+	}
+	return nil
+}
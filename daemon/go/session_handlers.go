@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// handleGetSession serves GET /session: whether the desktop session is
+// active, locked or idle, and who is logged in.
+func handleGetSession(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), sessionCommandTimeout)
+	defer cancel()
+	state, err := readSession(ctx)
+	if err != nil {
+		slog.Error("Failed to read session state", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to read session state")
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// sessionLockHandler serves POST /session/lock and /session/unlock.
+func sessionLockHandler(locked bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), sessionCommandTimeout)
+		defer cancel()
+		if err := setSessionLocked(ctx, locked); err != nil {
+			if errors.Is(err, errSessionDenied) {
+				slog.Warn("Session lock change refused", "locked", locked, "err", err)
+				errorJSON(w, http.StatusForbidden, err.Error())
+				return
+			}
+			slog.Error("Failed to change session lock", "locked", locked, "err", err)
+			errorJSON(w, http.StatusInternalServerError, "failed to change session lock")
+			return
+		}
+		sessionProbe.invalidate()
+		slog.Info("Session lock changed from phone", "locked", locked)
+		writeJSON(w, http.StatusOK, map[string]any{"status": "success", "locked": locked})
+	}
+}
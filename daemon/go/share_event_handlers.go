@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handleShareEvents serves GET /files/events as Server-Sent Events: every
+// retained change below shareDir newer than the client's Last-Event-ID (or
+// ?after=), then new changes as they happen. Clients that were away longer
+// than the retained history should re-list with /list-files.
+func handleShareEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+
+	after := lastEventID(r)
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	slog.Info("Share event stream opened", "client", r.RemoteAddr, "after", after)
+	for {
+		changed := shareEvents.wait()
+		for _, e := range shareEvents.after(after) {
+			if err := writeSSE(w, strconv.FormatUint(e.ID, 10), e.Type, e); err != nil {
+				return
+			}
+			after = e.ID
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			slog.Info("Share event stream closed", "client", r.RemoteAddr)
+			return
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -1,45 +1,279 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type fileInfo struct {
-	Name    string  `json:"name"`
-	Size    int64   `json:"size"`
-	ModTime float64 `json:"mod_time"`
+	Name     string  `json:"name"`
+	Path     string  `json:"path"` // relative to shareDir, slash-separated
+	Type     string  `json:"type"` // "file" or "dir"
+	Size     int64   `json:"size"`
+	ModTime  float64 `json:"mod_time"`
+	MIME     string  `json:"mime,omitempty"`
+	Children *int    `json:"children,omitempty"` // entries in a directory
+	SHA256   string  `json:"sha256,omitempty"`
+
+	modTime time.Time
+}
+
+// nextCursorHeader carries the cursor for the following /list-files page;
+// it is absent on the last page.
+const nextCursorHeader = "X-Next-Cursor"
+
+// resolveSharePath maps a client-supplied path relative to shareDir to an
+// absolute one; see resolveInDir. Sync bookkeeping files are reported as
+// not existing.
+func resolveSharePath(rel string) (string, error) {
+	path, err := resolveInDir(shareDir, rel)
+	if err == nil && syncPrivatePath(path) {
+		return "", fs.ErrNotExist
+	}
+	return path, err
+}
+
+// resolveInDir maps a client-supplied path relative to dir to an absolute
+// one, rejecting ".." and symlinks that lead outside dir. An empty rel is
+// dir itself.
+func resolveInDir(dir, rel string) (string, error) {
+	if strings.Trim(rel, "/") == "" {
+		return dir, nil
+	}
+	path, err := safeRelPath(dir, strings.Trim(rel, "/"))
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes directory")
+	}
+	return path, nil
+}
+
+// sortFileInfos orders directories before files, then by key ("name",
+// "size" or "mtime"), breaking ties by name.
+func sortFileInfos(files []fileInfo, key string, desc bool) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.Type != b.Type {
+			return a.Type == "dir"
+		}
+		var less, equal bool
+		switch key {
+		case "size":
+			less, equal = a.Size < b.Size, a.Size == b.Size
+		case "mtime":
+			less, equal = a.modTime.Before(b.modTime), a.modTime.Equal(b.modTime)
+		default:
+			less, equal = a.Name < b.Name, a.Name == b.Name
+		}
+		if equal {
+			return a.Name < b.Name
+		}
+		return less != desc
+	})
+}
+
+// listingETag is a strong validator for one /list-files page: a hash of
+// every entry's name, type, size and mtime plus the options that shape the
+// response. Directory mtimes cover their child counts.
+func listingETag(dirModTime time.Time, page []fileInfo, next string, withHash bool) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%t\n", dirModTime.UnixNano(), next, withHash)
+	for _, fi := range page {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\n", fi.Path, fi.Type, fi.Size, fi.modTime.UnixNano())
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// fileETag is a strong validator for a file from its identity and
+// modification metadata, so downloads need not be hashed.
+func fileETag(info os.FileInfo) string {
+	var ino uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		ino = st.Ino
+	}
+	return fmt.Sprintf(`"%x-%x-%x"`, ino, info.Size(), info.ModTime().UnixNano())
 }
 
+func encodeListCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeListCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.Atoi(string(raw))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return offset, nil
+}
+
+// handleListFiles serves GET /list-files: one directory of shareDir as a
+// JSON array, directories first.
+//
+//   - path=a/b lists a subdirectory
+//   - sort=name|size|mtime and order=asc|desc
+//   - limit=N (default and maximum maxListFilesPage) and cursor=, taken
+//     from the previous page's X-Next-Cursor header
+//   - hash=sha256 adds each file's digest, cached by size and mtime
 func handleListFiles(w http.ResponseWriter, r *http.Request) {
-	entries, err := os.ReadDir(shareDir)
+	q := r.URL.Query()
+	withHash := q.Get("hash") == "sha256"
+
+	sortKey := q.Get("sort")
+	switch sortKey {
+	case "", "name", "size", "mtime":
+	default:
+		errorJSON(w, http.StatusBadRequest, "sort must be one of name, size, mtime")
+		return
+	}
+	order := q.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		errorJSON(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+	limit := maxListFilesPage
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			errorJSON(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxListFilesPage)
+	}
+	offset := 0
+	if raw := q.Get("cursor"); raw != "" {
+		var err error
+		if offset, err = decodeListCursor(raw); err != nil {
+			errorJSON(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+
+	relDir := strings.Trim(q.Get("path"), "/")
+	dir, err := resolveSharePath(relDir)
 	if err != nil {
-		slog.Error("Failed to read share directory", "dir", shareDir, "err", err)
+		if os.IsNotExist(err) {
+			errorJSON(w, http.StatusNotFound, "directory not found")
+			return
+		}
+		errorJSON(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			errorJSON(w, http.StatusNotFound, "directory not found")
+			return
+		}
+		slog.Error("Failed to read share directory", "dir", dir, "err", err)
 		errorJSON(w, http.StatusInternalServerError, "could not read share directory")
 		return
 	}
 
-	files := []fileInfo{}
+	files := make([]fileInfo, 0, len(entries))
 	for _, entry := range entries {
-		if entry.IsDir() {
+		// Follow symlinks for type and size, but only within shareDir.
+		info, err := os.Stat(filepath.Join(dir, entry.Name()))
+		if err != nil || (!info.IsDir() && !info.Mode().IsRegular()) || syncPrivatePath(filepath.Join(dir, entry.Name())) {
 			continue
 		}
-		info, err := entry.Info()
-		if err != nil {
-			continue
+		rel := entry.Name()
+		if relDir != "" {
+			rel = relDir + "/" + entry.Name()
 		}
-		files = append(files, fileInfo{
-			Name:    info.Name(),
+		fi := fileInfo{
+			Name:    entry.Name(),
+			Path:    rel,
+			Type:    "file",
 			Size:    info.Size(),
 			ModTime: float64(info.ModTime().UnixMilli()) / 1000.0,
-		})
+			modTime: info.ModTime(),
+		}
+		if info.IsDir() {
+			fi.Type, fi.Size = "dir", 0
+		}
+		files = append(files, fi)
+	}
+	sortFileInfos(files, sortKey, order == "desc")
+
+	// Paginate before the per-entry work below, which touches the disk.
+	page := files[min(offset, len(files)):]
+	next := ""
+	if len(page) > limit {
+		page = page[:limit]
+		next = encodeListCursor(offset + limit)
+		w.Header().Set(nextCursorHeader, next)
+	}
+
+	// The page's validators derive from directory state alone, so an
+	// unchanged listing is answered before any MIME sniffing or hashing.
+	lastMod := time.Time{}
+	if info, err := os.Stat(dir); err == nil {
+		lastMod = info.ModTime()
+	}
+	for _, fi := range page {
+		if fi.modTime.After(lastMod) {
+			lastMod = fi.modTime
+		}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if notModified(w, r, listingETag(lastMod, page, next, withHash), lastMod) {
+		return
 	}
 
-	writeJSON(w, http.StatusOK, files)
-	slog.Info("Listed share files", "count", len(files))
+	for i := range page {
+		fi := &page[i]
+		path := filepath.Join(dir, fi.Name)
+		if fi.Type == "dir" {
+			if children, err := os.ReadDir(path); err == nil {
+				n := len(children)
+				fi.Children = &n
+			}
+			continue
+		}
+		fi.MIME = detectMIME(path)
+		if withHash {
+			if info, err := os.Stat(path); err == nil {
+				if fi.SHA256, err = fileSHA256(path, info); err != nil {
+					slog.Warn("Failed to hash share file", "path", fi.Path, "err", err)
+				}
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, page)
+	slog.Info("Listed share files", "path", relDir, "count", len(page), "total", len(files))
 }
 
+// handleDownload serves GET /download/{filename...}; filename may include
+// subdirectories of shareDir, as returned in /list-files "path".
 func handleDownload(w http.ResponseWriter, r *http.Request) {
 	filename := r.PathValue("filename")
 	if filename == "" {
@@ -47,16 +281,25 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dest, err := safePath(shareDir, filename)
+	dest, err := resolveSharePath(filename)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
 		errorJSON(w, http.StatusBadRequest, "invalid filename")
 		return
 	}
 
-	if _, err := os.Stat(dest); os.IsNotExist(err) {
+	info, err := os.Stat(dest)
+	if err != nil || info.IsDir() {
 		http.NotFound(w, r)
 		return
 	}
+	// ServeFile honours If-None-Match and If-Range against this ETag, and
+	// adds Last-Modified itself.
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Cache-Control", "no-cache")
 
 	slog.Info("Serving file to phone", "filename", filename, "path", dest)
 	http.ServeFile(w, r, dest)
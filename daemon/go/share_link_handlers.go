@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// shareLinkURL is the absolute URL for token as reachable by whoever made
+// the request.
+func shareLinkURL(r *http.Request, token string) string {
+	return "http://" + r.Host + "/s/" + token
+}
+
+// handleCreateShareLink serves POST /share-links.
+func handleCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	var payload shareLinkPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	ttl := defaultShareLinkTTL
+	if payload.TTLSeconds < 0 {
+		errorJSON(w, http.StatusBadRequest, "ttl_seconds must not be negative")
+		return
+	}
+	if payload.TTLSeconds > 0 {
+		ttl = time.Duration(payload.TTLSeconds) * time.Second
+	}
+	if ttl > maxShareLinkTTL {
+		errorJSON(w, http.StatusBadRequest, "ttl_seconds exceeds the maximum of "+maxShareLinkTTL.String())
+		return
+	}
+
+	path, err := resolveSharePath(payload.Path)
+	if os.IsNotExist(err) {
+		errorJSON(w, http.StatusNotFound, "file not found")
+		return
+	}
+	if err != nil || path == shareDir {
+		errorJSON(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		errorJSON(w, http.StatusBadRequest, "only files can be shared")
+		return
+	}
+
+	link, err := shareLinks.create(relTo(shareDir, path), ttl, payload.SingleUse)
+	if errors.Is(err, errShareLinksFull) {
+		errorJSON(w, http.StatusTooManyRequests, err.Error()+"; revoke one first")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to create share link", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "could not create link")
+		return
+	}
+	slog.Info("Share link created", "path", link.Path, "expires_at", link.ExpiresAt, "single_use", link.SingleUse)
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"link": link,
+		"url":  shareLinkURL(r, link.Token),
+	})
+}
+
+// handleListShareLinks serves GET /share-links: active links with their
+// download counters.
+func handleListShareLinks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, shareLinks.list())
+}
+
+// handleRevokeShareLink serves DELETE /share-links/{token}.
+func handleRevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	if !shareLinks.revoke(r.PathValue("token")) {
+		errorJSON(w, http.StatusNotFound, "unknown share link")
+		return
+	}
+	slog.Info("Share link revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleShareLinkDownload serves GET /s/{token}. The token is the only
+// credential, so it is meant for devices that are not paired with the
+// daemon; unknown tokens get a plain 404. A download is only counted once
+// the file is about to be sent: HEAD requests and links whose file has gone
+// leave a single-use link unspent. Range requests from the first client may
+// resume a single-use download for a while, but aren't counted.
+func handleShareLinkDownload(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	client, ranged := clientIP(r), r.Header.Get("Range") != ""
+	link, ok, err := shareLinks.get(token, client, ranged)
+	if !shareLinkUsable(w, r, ok, err) {
+		return
+	}
+
+	path, err := resolveSharePath(link.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodHead {
+		// Claimed again: another request may have spent the link meanwhile.
+		link, ok, err = shareLinks.claim(token, client, ranged)
+		if !shareLinkUsable(w, r, ok, err) {
+			return
+		}
+		slog.Info("Serving share link download", "path", link.Path, "downloads", link.Downloads, "ranged", ranged, "client", r.RemoteAddr)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeFile(w, r, path)
+}
+
+// shareLinkUsable writes the response for an unknown (404), expired or
+// used-up (410) link and reports whether the link may be served.
+func shareLinkUsable(w http.ResponseWriter, r *http.Request, ok bool, err error) bool {
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+		return false
+	case errors.Is(err, errShareLinkExpired), errors.Is(err, errShareLinkUsed):
+		errorJSON(w, http.StatusGone, err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// shareLink is a capability URL for one file in shareDir that works for
+// anyone holding the token until it expires or, if single-use, is fetched.
+type shareLink struct {
+	Token          string     `json:"token"`
+	Path           string     `json:"path"` // relative to shareDir
+	SingleUse      bool       `json:"single_use"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	Downloads      int        `json:"downloads"`
+	LastDownloadAt *time.Time `json:"last_download_at,omitempty"`
+
+	// claimedBy and claimedAt record the first fetch of a single-use link.
+	// Only that client may fetch it again, for shareLinkResumeWindow, and
+	// only ranges once the whole file has been sent.
+	claimedBy string
+	claimedAt time.Time
+}
+
+var (
+	errShareLinkExpired = errors.New("share link expired")
+	errShareLinkUsed    = errors.New("share link already used")
+	errShareLinksFull   = errors.New("too many active links")
+)
+
+// shareLinkStore holds active links in memory; they do not survive a
+// daemon restart, which errs on the side of revoking access.
+type shareLinkStore struct {
+	mu    sync.Mutex
+	max   int
+	links map[string]*shareLink
+	now   func() time.Time // replaceable in tests
+}
+
+func newShareLinkStore(max int) *shareLinkStore {
+	return &shareLinkStore{max: max, links: map[string]*shareLink{}, now: time.Now}
+}
+
+var shareLinks = newShareLinkStore(maxShareLinks)
+
+// create issues a link for rel valid for ttl. A full store refuses with
+// errShareLinksFull rather than break a URL already handed out.
+func (s *shareLinkStore) create(rel string, ttl time.Duration, singleUse bool) (shareLink, error) {
+	token, err := randomID()
+	if err != nil {
+		return shareLink{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeLocked()
+
+	now := s.now()
+	link := &shareLink{
+		Token:     token,
+		Path:      rel,
+		SingleUse: singleUse,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if len(s.links) >= s.max {
+		return shareLink{}, errShareLinksFull
+	}
+	s.links[token] = link
+	return *link, nil
+}
+
+// get returns the link for token without counting a download. Unknown
+// tokens report ok=false; expired and used-up ones an error, so the caller
+// can answer 410 rather than 404. client and ranged describe the request,
+// as for claim.
+func (s *shareLinkStore) get(token, client string, ranged bool) (shareLink, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok, err := s.checkLocked(token, client, ranged)
+	if !ok {
+		return shareLink{}, false, nil
+	}
+	return *link, true, err
+}
+
+// claim is get that also records the fetch. Only whole-file (non-Range)
+// responses count as downloads.
+func (s *shareLinkStore) claim(token, client string, ranged bool) (shareLink, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok, err := s.checkLocked(token, client, ranged)
+	if !ok {
+		return shareLink{}, false, nil
+	}
+	if err != nil {
+		return *link, true, err
+	}
+	now := s.now()
+	if link.SingleUse && link.claimedBy == "" {
+		link.claimedBy, link.claimedAt = client, now
+	}
+	if !ranged {
+		link.Downloads++
+	}
+	link.LastDownloadAt = &now
+	return *link, true, nil
+}
+
+func (s *shareLinkStore) checkLocked(token, client string, ranged bool) (*shareLink, bool, error) {
+	link, ok := s.links[token]
+	if !ok {
+		return nil, false, nil
+	}
+	now := s.now()
+	if !now.Before(link.ExpiresAt) {
+		delete(s.links, token)
+		return link, true, errShareLinkExpired
+	}
+	if link.SingleUse && link.claimedBy != "" {
+		resumable := client == link.claimedBy && now.Before(link.claimedAt.Add(shareLinkResumeWindow))
+		if !resumable || (!ranged && link.Downloads > 0) {
+			return link, true, errShareLinkUsed
+		}
+	}
+	return link, true, nil
+}
+
+// revoke deletes token and reports whether it existed.
+func (s *shareLinkStore) revoke(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.links[token]
+	delete(s.links, token)
+	return ok
+}
+
+// list returns the unexpired links, newest first.
+func (s *shareLinkStore) list() []shareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeLocked()
+	out := make([]shareLink, 0, len(s.links))
+	for _, l := range s.links {
+		out = append(out, *l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+func (s *shareLinkStore) purgeLocked() {
+	now := s.now()
+	for token, l := range s.links {
+		if !now.Before(l.ExpiresAt) {
+			delete(s.links, token)
+		}
+	}
+}
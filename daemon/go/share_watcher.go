@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// shareEvent is one change below shareDir, as pushed on GET /files/events.
+type shareEvent struct {
+	ID    uint64    `json:"id"`
+	Type  string    `json:"type"` // created, modified or deleted
+	Path  string    `json:"path"` // relative to shareDir, slash-separated
+	IsDir bool      `json:"is_dir"`
+	Size  int64     `json:"size,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+const (
+	shareEventCreated  = "created"
+	shareEventModified = "modified"
+	shareEventDeleted  = "deleted"
+)
+
+// shareEventLog keeps the most recent share events so a reconnecting
+// stream can resume from its Last-Event-ID.
+type shareEventLog struct {
+	mu      sync.Mutex
+	max     int
+	nextID  uint64
+	items   []shareEvent
+	changed chan struct{} // closed and replaced on every push
+}
+
+func newShareEventLog(max int) *shareEventLog {
+	return &shareEventLog{
+		max: max,
+		// Clock-seeded like the laptop notification queue so ids survive
+		// daemon restarts.
+		nextID:  uint64(time.Now().UnixMilli()),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *shareEventLog) push(e shareEvent) shareEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	e.ID = l.nextID
+	l.items = append(l.items, e)
+	if len(l.items) > l.max {
+		l.items = l.items[1:]
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return e
+}
+
+// after returns the retained events with an id greater than id.
+func (l *shareEventLog) after(id uint64) []shareEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []shareEvent{}
+	for _, e := range l.items {
+		if e.ID > id {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// wait returns a channel that is closed on the next push.
+func (l *shareEventLog) wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.changed
+}
+
+var shareEvents = newShareEventLog(maxShareEvents)
+
+const shareWatchMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_DELETE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF
+
+// shareWatcher turns inotify events for a directory tree into share events.
+// Files being written are held back until they are closed, so a large copy
+// produces one "created" event rather than a stream of modifications.
+type shareWatcher struct {
+	root string
+	fd   int
+	file *os.File
+	emit func(shareEvent)
+
+	mu      sync.Mutex
+	dirs    map[int]string          // watch descriptor -> dir relative to root ("" is root)
+	pending map[string]*pendingFile // rel path -> change awaiting IN_CLOSE_WRITE
+}
+
+type pendingFile struct {
+	kind    string
+	written bool
+}
+
+func newShareWatcher(root string, emit func(shareEvent)) (*shareWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &shareWatcher{
+		root:    root,
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"), // non-blocking: reads park in the runtime poller
+		dirs:    map[int]string{},
+		pending: map[string]*pendingFile{},
+		emit:    emit,
+	}
+	if err := w.watchTree("", false); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// watchTree adds watches for rel and every directory below it, except
+// hidden ones such as a synced folder's staging area. With announce set,
+// files and directories found are reported as created; they may have
+// appeared before the watch existed.
+func (w *shareWatcher) watchTree(rel string, announce bool) error {
+	return filepath.WalkDir(filepath.Join(w.root, rel), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == filepath.Join(w.root, rel) {
+				return err
+			}
+			return nil // vanished mid-walk
+		}
+		sub, _ := filepath.Rel(w.root, p)
+		sub = filepath.ToSlash(sub)
+		if sub == "." {
+			sub = ""
+		}
+		if d.IsDir() && sub != "" && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			wd, err := unix.InotifyAddWatch(w.fd, p, shareWatchMask)
+			if err != nil {
+				slog.Warn("Failed to watch share subdirectory", "dir", p, "err", err)
+				return filepath.SkipDir
+			}
+			w.dirs[wd] = sub
+		}
+		if announce && sub != rel {
+			w.emitPath(shareEventCreated, sub, d.IsDir())
+		}
+		return nil
+	})
+}
+
+func (w *shareWatcher) emitPath(kind, rel string, isDir bool) {
+	e := shareEvent{Type: kind, Path: rel, IsDir: isDir, Time: time.Now()}
+	if kind != shareEventDeleted && !isDir {
+		if info, err := os.Stat(filepath.Join(w.root, filepath.FromSlash(rel))); err == nil {
+			e.Size = info.Size()
+		}
+	}
+	w.emit(e)
+}
+
+// forget drops the watches for rel and everything below it.
+func (w *shareWatcher) forget(rel string) {
+	for wd, dir := range w.dirs {
+		if dir == rel || strings.HasPrefix(dir, rel+"/") {
+			_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+	for p := range w.pending {
+		if strings.HasPrefix(p, rel+"/") {
+			delete(w.pending, p)
+		}
+	}
+}
+
+// run reads events until ctx is cancelled or the watched root goes away.
+func (w *shareWatcher) run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		w.file.Close()
+	}()
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if !w.handle(buf[:n]) {
+			return errors.New("share directory removed")
+		}
+	}
+}
+
+// settle reports a created file that saw no writes shortly after creation:
+// a hard link or rename-free placement that never produces IN_CLOSE_WRITE.
+// Files still being written have seen IN_MODIFY and wait for their close.
+func (w *shareWatcher) settle(rel string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.pending[rel]; ok && !p.written {
+		delete(w.pending, rel)
+		w.emitPath(shareEventCreated, rel, false)
+	}
+}
+
+// handle processes one read's worth of packed inotify_event records and
+// reports whether the root is still watched.
+func (w *shareWatcher) handle(buf []byte) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for off := 0; off+unix.SizeofInotifyEvent <= len(buf); {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(raw.Len)]
+		off += unix.SizeofInotifyEvent + int(raw.Len)
+
+		if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+			slog.Warn("Share watcher queue overflowed; events were lost")
+			continue
+		}
+		dir, ok := w.dirs[int(raw.Wd)]
+		if !ok {
+			continue
+		}
+		if raw.Mask&(unix.IN_IGNORED|unix.IN_DELETE_SELF) != 0 {
+			delete(w.dirs, int(raw.Wd))
+			if dir == "" {
+				return false
+			}
+			continue
+		}
+		name := strings.TrimRight(string(nameBytes), "\x00")
+		if name == "" {
+			continue
+		}
+		rel := path.Join(dir, name)
+		isDir := raw.Mask&unix.IN_ISDIR != 0
+
+		switch {
+		case isDir && raw.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+			w.emitPath(shareEventCreated, rel, true)
+			if err := w.watchTree(rel, true); err != nil {
+				slog.Warn("Failed to watch new share directory", "path", rel, "err", err)
+			}
+		case isDir && raw.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+			w.forget(rel)
+			w.emitPath(shareEventDeleted, rel, true)
+		case raw.Mask&unix.IN_CREATE != 0:
+			w.pending[rel] = &pendingFile{kind: shareEventCreated}
+			time.AfterFunc(shareWatchSettleDelay, func() { w.settle(rel) })
+		case raw.Mask&unix.IN_MODIFY != 0:
+			if p, ok := w.pending[rel]; ok {
+				p.written = true
+			} else {
+				w.pending[rel] = &pendingFile{kind: shareEventModified, written: true}
+			}
+		case raw.Mask&unix.IN_CLOSE_WRITE != 0:
+			// Opening for write without writing is not a change.
+			if p, ok := w.pending[rel]; ok {
+				delete(w.pending, rel)
+				w.emitPath(p.kind, rel, false)
+			}
+		case raw.Mask&unix.IN_MOVED_TO != 0:
+			// Renamed into place: already complete (e.g. our own uploads).
+			delete(w.pending, rel)
+			w.emitPath(shareEventCreated, rel, false)
+		case raw.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+			delete(w.pending, rel)
+			w.emitPath(shareEventDeleted, rel, false)
+		}
+	}
+	return true
+}
+
+// publishShareEvent records e unless any part of its path is hidden: the
+// ".partial-*" files uploads are written to, or a synced folder's index and
+// staging area.
+func publishShareEvent(e shareEvent) {
+	if hiddenSyncPath(e.Path) {
+		return
+	}
+	e = shareEvents.push(e)
+	slog.Debug("Share directory changed", "id", e.ID, "type", e.Type, "path", e.Path)
+}
+
+// runShareWatcher feeds shareEvents from inotify until ctx is cancelled,
+// restarting with backoff if the watch fails (e.g. shareDir was removed).
+func runShareWatcher(ctx context.Context) {
+	backoff := time.Second
+	for {
+		w, err := newShareWatcher(shareDir, publishShareEvent)
+		if err == nil {
+			slog.Info("Watching share directory", "dir", shareDir)
+			backoff = time.Second
+			err = w.run(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Share watcher stopped; restarting", "err", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"net/http"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/shirou/gopsutil/v3/cpu"
@@ -70,6 +73,50 @@ func getBattery() (percent float64, plugged bool) {
 	return 0, false
 }
 
+// statsProbe caches one desktop query made for /stats for
+// statsProbeCacheTTL, so a phone polling every second doesn't spawn
+// loginctl or wpctl each time. Failures are cached too.
+type statsProbe[T any] struct {
+	fetch func(ctx context.Context) (T, error)
+
+	mu      sync.Mutex
+	value   T
+	err     error
+	fetched time.Time
+}
+
+func (p *statsProbe[T]) get() (T, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fetched.IsZero() || time.Since(p.fetched) >= statsProbeCacheTTL {
+		// Not the request's context: a client hanging up mustn't leave a
+		// cancellation error cached for the next poll.
+		ctx, cancel := context.WithTimeout(context.Background(), statsProbeTimeout)
+		p.value, p.err = p.fetch(ctx)
+		cancel()
+		p.fetched = time.Now()
+	}
+	return p.value, p.err
+}
+
+// invalidate makes the next get query again, after a change made through
+// the daemon.
+func (p *statsProbe[T]) invalidate() {
+	p.mu.Lock()
+	p.fetched = time.Time{}
+	p.mu.Unlock()
+}
+
+var (
+	audioProbe = &statsProbe[audioState]{fetch: func(ctx context.Context) (audioState, error) {
+		if audio == nil {
+			return audioState{}, errors.New("no audio backend")
+		}
+		return audio.Get(ctx)
+	}}
+	sessionProbe = &statsProbe[sessionState]{fetch: readSession}
+)
+
 func handleStats(w http.ResponseWriter, r *http.Request) {
 	clientIP := r.RemoteAddr
 
@@ -97,6 +144,18 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 		Timestamp:      float64(time.Now().UnixMilli()) / 1000.0,
 	}
 
+	// Volume, brightness and session state ride along so the phone's
+	// controls stay in sync with changes made on the laptop.
+	if state, err := audioProbe.get(); err == nil {
+		resp.Audio = &state
+	}
+	if state, err := readBrightness(); err == nil {
+		resp.Brightness = &state
+	}
+	if state, err := sessionProbe.get(); err == nil {
+		resp.Session = &state
+	}
+
 	writeJSON(w, http.StatusOK, resp)
 	slog.Info("Served stats", "client", clientIP)
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syncBaseHeader carries, as a JSON version vector, the version of a path
+// the phone's change started from. It is omitted for files the phone
+// created.
+const syncBaseHeader = "X-Sync-Base"
+
+// syncVersionHeader carries the version vector of a downloaded file.
+const syncVersionHeader = "X-Sync-Version"
+
+// openSyncPair resolves {pair}, writing the error response itself. Only
+// uploads create a pair that has no folder yet; everything else gets 404.
+func openSyncPair(w http.ResponseWriter, r *http.Request, create bool) (*syncFolder, bool) {
+	f, err := openSyncFolder(r.PathValue("pair"), create)
+	if err != nil {
+		switch {
+		case errors.Is(err, errSyncPairNotFound):
+			errorJSON(w, http.StatusNotFound, "unknown sync pair")
+		case validSyncPair.MatchString(r.PathValue("pair")):
+			slog.Error("Failed to open sync folder", "pair", r.PathValue("pair"), "err", err)
+			errorJSON(w, http.StatusInternalServerError, "sync folder unavailable")
+		default:
+			errorJSON(w, http.StatusBadRequest, "invalid pair name")
+		}
+		return nil, false
+	}
+	return f, true
+}
+
+// syncRelPath validates {path...} inside f and returns it slash-separated.
+// Dot-files are reserved for the index and staging area.
+func syncRelPath(w http.ResponseWriter, r *http.Request, f *syncFolder) (string, bool) {
+	dest, err := safeRelPath(f.dir, r.PathValue("path"))
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid path")
+		return "", false
+	}
+	rel := relTo(f.dir, dest)
+	if hiddenSyncPath(rel) {
+		errorJSON(w, http.StatusBadRequest, "dot-files are not synced")
+		return "", false
+	}
+	return rel, true
+}
+
+// syncReplica returns the phone's replica id from deviceIDHeader, which
+// sync requires: a fallback such as the client IP would change with the
+// network and split one phone into several replicas. The laptop's own id is
+// reserved.
+func syncReplica(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if strings.TrimSpace(r.Header.Get(deviceIDHeader)) == "" {
+		errorJSON(w, http.StatusBadRequest, deviceIDHeader+" header required")
+		return "", false
+	}
+	replica := uploadDeviceID(r)
+	if replica == syncLocalReplica {
+		errorJSON(w, http.StatusBadRequest, deviceIDHeader+" "+syncLocalReplica+" is reserved")
+		return "", false
+	}
+	return replica, true
+}
+
+func parseSyncBase(w http.ResponseWriter, r *http.Request) (versionVector, bool) {
+	base := versionVector{}
+	if raw := r.Header.Get(syncBaseHeader); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &base); err != nil {
+			errorJSON(w, http.StatusBadRequest, syncBaseHeader+" must be a JSON object of counters")
+			return nil, false
+		}
+	}
+	return base, true
+}
+
+// handleSyncIndex serves GET /sync/{pair}/index?since=. It rescans the
+// folder, then returns the entries (tombstones included) changed after
+// sequence number since, and the current sequence to pass next time. If
+// since is ahead of the index, which happens when the index was rebuilt,
+// the whole index is returned with reset set.
+func handleSyncIndex(w http.ResponseWriter, r *http.Request) {
+	f, ok := openSyncPair(w, r, false)
+	if !ok {
+		return
+	}
+	var since uint64
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		var err error
+		if since, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			errorJSON(w, http.StatusBadRequest, "since must be a non-negative integer")
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.refresh(); err != nil {
+		slog.Error("Failed to scan sync folder", "pair", f.name, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to scan sync folder")
+		return
+	}
+	reset := since > f.Seq
+	if reset {
+		since = 0
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"pair":    f.name,
+		"seq":     f.Seq,
+		"reset":   reset,
+		"entries": f.changesSince(since),
+	})
+}
+
+// handleSyncDownload serves GET /sync/{pair}/files/{path...} with the
+// file's version vector in X-Sync-Version.
+func handleSyncDownload(w http.ResponseWriter, r *http.Request) {
+	f, ok := openSyncPair(w, r, false)
+	if !ok {
+		return
+	}
+	rel, ok := syncRelPath(w, r, f)
+	if !ok {
+		return
+	}
+	path, err := resolveInDir(f.dir, rel)
+	if err != nil {
+		errorJSON(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	f.mu.Lock()
+	changed, err := f.refreshPath(rel)
+	var entry syncEntry
+	if e := f.Entries[rel]; e != nil {
+		entry = *e
+	}
+	if err == nil && changed {
+		err = f.save()
+	}
+	f.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed to index sync file", "pair", f.name, "path", rel, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to read file")
+		return
+	}
+	if entry.Path == "" || entry.Deleted {
+		errorJSON(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	version, _ := json.Marshal(entry.Version)
+	w.Header().Set(syncVersionHeader, string(version))
+	if info, err := os.Stat(path); err == nil {
+		w.Header().Set("ETag", fileETag(info))
+	}
+	http.ServeFile(w, r, path)
+}
+
+// handleSyncUpload serves PUT /sync/{pair}/files/{path...}: the raw file
+// body, an X-Sync-Base header naming the version it was edited from, and
+// an optional ?mtime= (epoch millis). If the laptop changed the file in the
+// meantime both versions are kept and the status is "conflict".
+func handleSyncUpload(w http.ResponseWriter, r *http.Request) {
+	f, ok := openSyncPair(w, r, true)
+	if !ok {
+		return
+	}
+	rel, ok := syncRelPath(w, r, f)
+	if !ok {
+		return
+	}
+	replica, ok := syncReplica(w, r)
+	if !ok {
+		return
+	}
+	base, ok := parseSyncBase(w, r)
+	if !ok {
+		return
+	}
+	var mtime time.Time
+	if raw := r.URL.Query().Get("mtime"); raw != "" {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			errorJSON(w, http.StatusBadRequest, "mtime must be epoch millis")
+			return
+		}
+		mtime = time.UnixMilli(ms)
+	}
+	wantSum, err := parseSHA256(r.Header.Get(checksumHeader))
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if r.ContentLength < 0 {
+		errorJSON(w, http.StatusLengthRequired, "Content-Length required")
+		return
+	}
+	qerr := checkUploadFileSize(r.ContentLength)
+	if qerr == nil {
+		qerr = checkUploadQuota(f.dir, uploadQuotaKey(r), r.ContentLength)
+	}
+	if qerr != nil {
+		slog.Warn("Sync upload rejected by quota", "device", replica, "path", rel, "code", qerr.Code)
+		writeQuotaError(w, qerr)
+		return
+	}
+
+	// Stage first so the index is only locked for the final rename.
+	if err := ensureDir(f.stagingDir()); err != nil {
+		slog.Error("Failed to create sync staging directory", "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to write file")
+		return
+	}
+	stageName, err := randomID()
+	if err != nil {
+		errorJSON(w, http.StatusInternalServerError, "failed to write file")
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxRawUploadBytes)
+	stored, err := storeFile(f.stagingDir(), stageName, body, conflictFail, wantSum)
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		errorJSON(w, http.StatusRequestEntityTooLarge, "file exceeds maximum upload size")
+		return
+	case errors.Is(err, errChecksumMismatch):
+		errorJSON(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case err != nil:
+		slog.Error("Failed to write sync file", "pair", f.name, "path", rel, "err", err)
+		errorJSON(w, http.StatusBadRequest, "upload incomplete or failed to write file")
+		return
+	}
+	defer os.Remove(stored.Path) // no-op once placed
+	dailyUploads.record(uploadQuotaKey(r), stored.Size)
+	if !mtime.IsZero() {
+		_ = os.Chtimes(stored.Path, mtime, mtime)
+	}
+
+	result, err := f.put(rel, stored.Path, stored.SHA256, replica, base)
+	if err != nil {
+		slog.Error("Failed to apply sync upload", "pair", f.name, "path", rel, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to store file")
+		return
+	}
+	if result.Status == "conflict" {
+		slog.Warn("Sync conflict; kept both versions", "pair", f.name, "path", rel,
+			"device", replica, "copy", result.ConflictCopy.Path)
+	} else {
+		slog.Info("Synced file from phone", "pair", f.name, "path", rel, "status", result.Status)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleSyncDelete serves DELETE /sync/{pair}/files/{path...}. A file the
+// laptop changed since the X-Sync-Base version is kept, and the status is
+// "conflict".
+func handleSyncDelete(w http.ResponseWriter, r *http.Request) {
+	f, ok := openSyncPair(w, r, false)
+	if !ok {
+		return
+	}
+	rel, ok := syncRelPath(w, r, f)
+	if !ok {
+		return
+	}
+	replica, ok := syncReplica(w, r)
+	if !ok {
+		return
+	}
+	base, ok := parseSyncBase(w, r)
+	if !ok {
+		return
+	}
+	if _, err := resolveInDir(f.dir, rel); err != nil && !os.IsNotExist(err) {
+		errorJSON(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	result, err := f.remove(rel, replica, base)
+	switch {
+	case os.IsNotExist(err):
+		errorJSON(w, http.StatusNotFound, "file not found")
+		return
+	case err != nil:
+		slog.Error("Failed to apply sync delete", "pair", f.name, "path", rel, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "failed to delete file")
+		return
+	}
+	slog.Info("Synced deletion from phone", "pair", f.name, "path", rel, "status", result.Status)
+	writeJSON(w, http.StatusOK, result)
+}
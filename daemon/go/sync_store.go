@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncLocalReplica is the laptop's name in version vectors; phones use
+// their X-Device-ID.
+const syncLocalReplica = "laptop"
+
+// syncIndexFile is kept inside each synced folder. Like every dot-file
+// there, it is never synced itself.
+const syncIndexFile = ".sync_index.json"
+
+// versionVector counts the changes each replica has made to one path.
+type versionVector map[string]uint64
+
+// versionOrder is how two version vectors relate.
+type versionOrder int
+
+const (
+	versionEqual      versionOrder = iota
+	versionBefore                  // a is an ancestor of b
+	versionAfter                   // a descends from b
+	versionConcurrent              // a and b were changed independently
+)
+
+func compareVersions(a, b versionVector) versionOrder {
+	aAhead, bAhead := false, false
+	for r, n := range a {
+		if n > b[r] {
+			aAhead = true
+		}
+	}
+	for r, n := range b {
+		if n > a[r] {
+			bAhead = true
+		}
+	}
+	switch {
+	case aAhead && bAhead:
+		return versionConcurrent
+	case aAhead:
+		return versionAfter
+	case bAhead:
+		return versionBefore
+	}
+	return versionEqual
+}
+
+// merge returns the component-wise maximum of a and b.
+func (a versionVector) merge(b versionVector) versionVector {
+	out := versionVector{}
+	for r, n := range a {
+		out[r] = n
+	}
+	for r, n := range b {
+		out[r] = max(out[r], n)
+	}
+	return out
+}
+
+// bump returns a copy of v with replica's counter incremented.
+func (v versionVector) bump(replica string) versionVector {
+	out := v.merge(nil)
+	out[replica]++
+	return out
+}
+
+// syncEntry is the state of one path in a synced folder. Deleted entries
+// are kept as tombstones so deletions propagate.
+type syncEntry struct {
+	Path    string        `json:"path"` // slash-separated, relative to the folder
+	Size    int64         `json:"size"`
+	MTime   int64         `json:"mtime"` // epoch millis
+	SHA256  string        `json:"sha256,omitempty"`
+	Deleted bool          `json:"deleted"`
+	Version versionVector `json:"version"`
+	Seq     uint64        `json:"seq"` // index sequence of the last change
+}
+
+// syncFolder is one pair: shareDir/<pair> and its index. seq increases
+// with every change, so clients ask for the entries after the last seq
+// they saw.
+type syncFolder struct {
+	mu      sync.Mutex
+	name    string
+	dir     string
+	Seq     uint64                `json:"seq"`
+	Entries map[string]*syncEntry `json:"entries"`
+}
+
+var (
+	syncFoldersMu sync.Mutex
+	syncFolders   = map[string]*syncFolder{}
+)
+
+var validSyncPair = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// errSyncPairNotFound is returned by openSyncFolder for a pair with no
+// folder when it may not create one.
+var errSyncPairNotFound = errors.New("sync pair not found")
+
+// openSyncFolder returns the pair's folder, loading its index on first use.
+// A missing folder is created only if create is set; reads must not make
+// one.
+func openSyncFolder(pair string, create bool) (*syncFolder, error) {
+	if !validSyncPair.MatchString(pair) {
+		return nil, fmt.Errorf("invalid pair name")
+	}
+	syncFoldersMu.Lock()
+	defer syncFoldersMu.Unlock()
+	dir := filepath.Join(shareDir, pair)
+	if !create {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, errSyncPairNotFound
+		}
+	}
+	if f, ok := syncFolders[pair]; ok && f.dir == dir {
+		return f, nil
+	}
+	if err := ensureSubdir(shareDir, dir); err != nil {
+		return nil, err
+	}
+	f := &syncFolder{name: pair, dir: dir, Entries: map[string]*syncEntry{}}
+	data, err := os.ReadFile(filepath.Join(dir, syncIndexFile))
+	if err == nil {
+		err = json.Unmarshal(data, f)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read sync index: %w", err)
+	}
+	syncFolders[pair] = f
+	return f, nil
+}
+
+// save writes the index atomically. Callers hold f.mu.
+func (f *syncFolder) save() error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(f.dir, syncIndexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(f.dir, syncIndexFile))
+}
+
+// record stores e as changed now. Callers hold f.mu.
+func (f *syncFolder) record(e syncEntry) *syncEntry {
+	f.Seq++
+	e.Seq = f.Seq
+	f.Entries[e.Path] = &e
+	return &e
+}
+
+// hiddenSyncPath reports whether rel has a dot-file component; those are
+// the index, staging files and editor droppings, and are never synced.
+func hiddenSyncPath(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// syncPrivatePath reports whether path, below shareDir, is a dot-file in a
+// synced folder: its index, staging area or something else sync ignores.
+// The generic share endpoints neither list nor touch these.
+func syncPrivatePath(path string) bool {
+	rel, err := filepath.Rel(shareDir, path)
+	if err != nil {
+		return false
+	}
+	pair, rest, ok := strings.Cut(filepath.ToSlash(rel), "/")
+	if !ok || !hiddenSyncPath(rest) {
+		return false
+	}
+	syncFoldersMu.Lock()
+	_, open := syncFolders[pair]
+	syncFoldersMu.Unlock()
+	if open {
+		return true
+	}
+	_, err = os.Stat(filepath.Join(shareDir, pair, syncIndexFile))
+	return err == nil
+}
+
+// refresh reconciles the index with the folder, recording laptop-side
+// edits, additions and deletions as changes by syncLocalReplica. Callers
+// hold f.mu.
+func (f *syncFolder) refresh() error {
+	seen := map[string]bool{}
+	err := filepath.WalkDir(f.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != f.dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(f.dir, p)
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		_, err = f.refreshPath(rel)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for rel, e := range f.Entries {
+		if !e.Deleted && !seen[rel] {
+			f.record(syncEntry{Path: rel, Deleted: true, Version: e.Version.bump(syncLocalReplica)})
+		}
+	}
+	return f.save()
+}
+
+// refreshPath reconciles one path with the disk and reports whether the
+// index changed. Callers hold f.mu.
+func (f *syncFolder) refreshPath(rel string) (bool, error) {
+	p := filepath.Join(f.dir, filepath.FromSlash(rel))
+	current := f.Entries[rel]
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		if current != nil && !current.Deleted {
+			f.record(syncEntry{Path: rel, Deleted: true, Version: current.Version.bump(syncLocalReplica)})
+			return true, nil
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+	mtime := info.ModTime().UnixMilli()
+	if current != nil && !current.Deleted && current.Size == info.Size() && current.MTime == mtime {
+		return false, nil
+	}
+
+	sum, err := fileSHA256(p, info)
+	if err != nil {
+		return false, err
+	}
+	if current != nil && !current.Deleted && current.SHA256 == sum {
+		current.MTime = mtime // touched, not changed
+		return true, nil
+	}
+	version := versionVector{}
+	if current != nil {
+		version = current.Version
+	}
+	f.record(syncEntry{Path: rel, Size: info.Size(), MTime: mtime, SHA256: sum, Version: version.bump(syncLocalReplica)})
+	return true, nil
+}
+
+// changesSince returns the entries changed after seq, oldest first.
+// Callers hold f.mu.
+func (f *syncFolder) changesSince(seq uint64) []syncEntry {
+	out := []syncEntry{}
+	for _, e := range f.Entries {
+		if e.Seq > seq {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out
+}
+
+// stagingDir holds uploads until they are checked against the index. It is
+// inside the folder so accepting an upload is a rename.
+func (f *syncFolder) stagingDir() string {
+	return filepath.Join(f.dir, ".sync_staging")
+}
+
+// conflictCopyName names the "keep both" copy of rel written by replica.
+func conflictCopyName(rel, replica string, now time.Time) string {
+	replica = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, replica)
+	ext := filepath.Ext(rel)
+	return fmt.Sprintf("%s (conflict from %s %s)%s", strings.TrimSuffix(filepath.Base(rel), ext),
+		replica, now.Format("2006-01-02 150405"), ext)
+}
+
+// syncResult is the outcome of a phone-side change. Entry is the path's
+// state afterwards; the phone keeps its Version as the base for its next
+// change.
+type syncResult struct {
+	Status       string     `json:"status"` // applied, unchanged or conflict
+	Entry        *syncEntry `json:"entry"`
+	ConflictCopy *syncEntry `json:"conflict_copy,omitempty"`
+}
+
+// conflicts reports whether a change by a replica that last saw base would
+// lose laptop-side changes to current.
+func conflicts(base versionVector, current *syncEntry) bool {
+	if current == nil || current.Deleted {
+		return false
+	}
+	order := compareVersions(base, current.Version)
+	return order == versionBefore || order == versionConcurrent
+}
+
+// put applies a file written by replica, already staged at staged, to rel.
+// base is the version the replica's change started from. If the laptop
+// changed rel since then, both are kept: the laptop's file stays at rel
+// and the replica's is placed next to it as a conflict copy.
+func (f *syncFolder) put(rel, staged, sum, replica string, base versionVector) (syncResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.refreshPath(rel); err != nil {
+		return syncResult{}, err
+	}
+	current := f.Entries[rel]
+	version := base
+	if current != nil {
+		version = base.merge(current.Version)
+	}
+	dest := filepath.Join(f.dir, filepath.FromSlash(rel))
+
+	if current != nil && !current.Deleted && current.SHA256 == sum {
+		os.Remove(staged)
+		if compareVersions(version, current.Version) != versionEqual {
+			current = f.record(syncEntry{Path: rel, Size: current.Size, MTime: current.MTime,
+				SHA256: sum, Version: version})
+		}
+		return syncResult{Status: "unchanged", Entry: current}, f.save()
+	}
+
+	if conflicts(base, current) {
+		name := conflictCopyName(rel, replica, time.Now())
+		copyPath, _, err := placeFile(staged, filepath.Join(filepath.Dir(dest), name), conflictRename)
+		if err != nil {
+			return syncResult{}, err
+		}
+		copyRel, _ := filepath.Rel(f.dir, copyPath)
+		if _, err := f.refreshPath(filepath.ToSlash(copyRel)); err != nil {
+			return syncResult{}, err
+		}
+		// The laptop's file now supersedes both sides, so the phone pulls it
+		// along with the copy.
+		kept := *current
+		kept.Version = version.bump(syncLocalReplica)
+		result := syncResult{Status: "conflict", Entry: f.record(kept), ConflictCopy: f.Entries[filepath.ToSlash(copyRel)]}
+		return result, f.save()
+	}
+
+	if err := ensureSubdir(f.dir, filepath.Dir(dest)); err != nil {
+		return syncResult{}, err
+	}
+	if err := os.Rename(staged, dest); err != nil {
+		return syncResult{}, err
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		return syncResult{}, err
+	}
+	entry := f.record(syncEntry{Path: rel, Size: info.Size(), MTime: info.ModTime().UnixMilli(),
+		SHA256: sum, Version: version.bump(replica)})
+	return syncResult{Status: "applied", Entry: entry}, f.save()
+}
+
+// remove applies a deletion of rel by replica. A deletion never discards
+// laptop-side changes the replica had not seen; the file is kept and the
+// result reports the conflict instead.
+func (f *syncFolder) remove(rel, replica string, base versionVector) (syncResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.refreshPath(rel); err != nil {
+		return syncResult{}, err
+	}
+	current := f.Entries[rel]
+	if current == nil {
+		return syncResult{}, os.ErrNotExist
+	}
+	version := base.merge(current.Version)
+	if current.Deleted {
+		return syncResult{Status: "unchanged", Entry: current}, nil
+	}
+	if conflicts(base, current) {
+		kept := *current
+		kept.Version = version.bump(syncLocalReplica)
+		return syncResult{Status: "conflict", Entry: f.record(kept)}, f.save()
+	}
+	if err := os.Remove(filepath.Join(f.dir, filepath.FromSlash(rel))); err != nil && !os.IsNotExist(err) {
+		return syncResult{}, err
+	}
+	entry := f.record(syncEntry{Path: rel, Deleted: true, Version: version.bump(replica)})
+	return syncResult{Status: "applied", Entry: entry}, f.save()
+}
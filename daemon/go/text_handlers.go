@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// handleOpenURL serves POST /open-url: {"url"} is opened in the laptop's
+// browser. Only http and https URLs are accepted.
+func handleOpenURL(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxOpenURLLength+1024)
+	var payload openURLPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	u, err := validateOpenURL(payload.URL)
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	snippet := textSnippet{Kind: "url", Action: "open", Text: u, Device: uploadDeviceID(r),
+		Status: "success", ReceivedAt: time.Now()}
+	if err := openURLCmd(u); err != nil {
+		slog.Error("Failed to open URL", "url", u, "err", err)
+		snippet.Status, snippet.Error = "error", err.Error()
+		textSnippets.add(snippet)
+		errorJSON(w, http.StatusInternalServerError, "failed to open url")
+		return
+	}
+	snippet = textSnippets.add(snippet)
+	slog.Info("Opened URL from phone", "url", u)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "success", "id": snippet.ID, "url": u})
+}
+
+// handleText serves POST /text: {"text", "action"} copies the text to the
+// clipboard (the default), types it into the focused window, or appends it
+// to textNotesFile.
+func handleText(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxTextSnippetBytes)
+	var payload textPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errorJSON(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+	if payload.Action == "" {
+		payload.Action = textActionClipboard
+	}
+	switch {
+	case payload.Text == "":
+		errorJSON(w, http.StatusBadRequest, "Missing text")
+		return
+	case !utf8.ValidString(payload.Text):
+		errorJSON(w, http.StatusBadRequest, "text must be UTF-8")
+		return
+	case len(payload.Text) > maxTextSnippetBytes,
+		payload.Action == textActionType && len(payload.Text) > maxTypedTextBytes:
+		errorJSON(w, http.StatusRequestEntityTooLarge, "text is too long for action "+payload.Action)
+		return
+	}
+
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), textActionTimeout)
+	defer cancel()
+	var err error
+	switch payload.Action {
+	case textActionClipboard:
+		provider, ok := clipboardProviderFor(w)
+		if !ok {
+			return
+		}
+		if err = provider.Write(ctx, "text/plain;charset=utf-8", []byte(payload.Text)); err == nil {
+			clipboard.observe(newClipboardContent("text/plain", []byte(payload.Text), "phone"))
+		}
+	case textActionType:
+		err = typeTextCmd(ctx, payload.Text)
+	case textActionNotes:
+		err = appendNote(payload.Text, now)
+	default:
+		errorJSON(w, http.StatusBadRequest, "action must be clipboard, type or notes")
+		return
+	}
+
+	snippet := textSnippet{Kind: "text", Action: payload.Action, Text: payload.Text,
+		Device: uploadDeviceID(r), Status: "success", ReceivedAt: now}
+	if err != nil {
+		slog.Error("Failed to handle text from phone", "action", payload.Action, "err", err)
+		snippet.Status, snippet.Error = "error", err.Error()
+		textSnippets.add(snippet)
+		errorJSON(w, http.StatusInternalServerError, "failed to "+payload.Action+" text")
+		return
+	}
+	snippet = textSnippets.add(snippet)
+	slog.Info("Received text from phone", "action", payload.Action, "bytes", len(payload.Text))
+	writeJSON(w, http.StatusOK, map[string]any{"status": "success", "id": snippet.ID, "action": payload.Action})
+}
+
+// handleTextHistory serves GET /text/history?limit=: received URLs and
+// snippets, newest first.
+func handleTextHistory(w http.ResponseWriter, r *http.Request) {
+	limit := maxTextHistory
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			errorJSON(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxTextHistory)
+	}
+	writeJSON(w, http.StatusOK, textSnippets.latest(limit))
+}
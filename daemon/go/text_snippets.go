@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// openURLCmd opens a validated http(s) URL in the desktop's default
+// browser. It is a variable so tests can record calls instead. xdg-open is
+// not waited for: with some browsers it lives as long as the window.
+var openURLCmd = func(u string) error {
+	cmd := exec.Command("xdg-open", u)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
+
+// typeTextCmd types text into the focused window: wtype on Wayland,
+// xdotool on X11. It is a variable so tests can record calls instead.
+var typeTextCmd = func(ctx context.Context, text string) error {
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if _, err := exec.LookPath("wtype"); err == nil {
+			return exec.CommandContext(ctx, "wtype", "--", text).Run()
+		}
+	}
+	if _, err := exec.LookPath("xdotool"); err != nil {
+		return fmt.Errorf("no typing tool available (install wtype or xdotool)")
+	}
+	return exec.CommandContext(ctx, "xdotool", "type", "--clearmodifiers", "--", text).Run()
+}
+
+// validateOpenURL accepts only absolute http and https URLs, so a phone
+// cannot make xdg-open launch file:// paths or custom scheme handlers.
+func validateOpenURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("url is required")
+	}
+	if len(raw) > maxOpenURLLength {
+		return "", fmt.Errorf("url exceeds %d characters", maxOpenURLLength)
+	}
+	if strings.IndexFunc(raw, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return "", fmt.Errorf("url must not contain whitespace or control characters")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid url")
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("only http and https URLs can be opened")
+	}
+	if u.Host == "" || u.User != nil {
+		return "", fmt.Errorf("url must have a host and no credentials")
+	}
+	return u.String(), nil
+}
+
+// Text actions for POST /text.
+const (
+	textActionClipboard = "clipboard"
+	textActionType      = "type"
+	textActionNotes     = "notes"
+)
+
+// textSnippet is one URL or text snippet received from the phone.
+type textSnippet struct {
+	ID         uint64    `json:"id"`
+	Kind       string    `json:"kind"`   // url or text
+	Action     string    `json:"action"` // open, clipboard, type or notes
+	Text       string    `json:"text"`
+	Device     string    `json:"device"`
+	Status     string    `json:"status"` // success or error
+	Error      string    `json:"error,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// textHistory keeps the most recent snippets, newest last.
+type textHistory struct {
+	mu     sync.Mutex
+	max    int
+	nextID uint64
+	items  []textSnippet
+}
+
+func newTextHistory(max int) *textHistory {
+	return &textHistory{max: max}
+}
+
+func (h *textHistory) add(s textSnippet) textSnippet {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextID++
+	s.ID = h.nextID
+	h.items = append(h.items, s)
+	if len(h.items) > h.max {
+		h.items = h.items[1:]
+	}
+	return s
+}
+
+// latest returns up to limit snippets, newest first.
+func (h *textHistory) latest(limit int) []textSnippet {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []textSnippet{}
+	for i := len(h.items) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, h.items[i])
+	}
+	return out
+}
+
+var textSnippets = newTextHistory(maxTextHistory)
+
+var notesMu sync.Mutex
+
+// appendNote adds text to textNotesFile under a timestamp heading.
+func appendNote(text string, at time.Time) error {
+	notesMu.Lock()
+	defer notesMu.Unlock()
+	if err := ensureDir(filepath.Dir(textNotesFile)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(textNotesFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "## %s\n\n%s\n\n", at.Format("2006-01-02 15:04"), strings.TrimRight(text, "\n"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
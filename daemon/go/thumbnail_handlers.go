@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// handleThumbnail serves GET /thumbnail/{filename...}?size=N for a file in
+// shareDir. Decodable images (JPEG, PNG, GIF) come back as a scaled JPEG or
+// PNG; text files as JSON {"type": "text", "preview"}; anything else as
+// JSON {"type": "icon", "icon"} naming a generic icon.
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	size := defaultThumbnailSize
+	if raw := r.URL.Query().Get("size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			errorJSON(w, http.StatusBadRequest, "size must be a positive integer")
+			return
+		}
+		size = min(max(n, minThumbnailSize), maxThumbnailSize)
+	}
+
+	path, err := resolveSharePath(r.PathValue("filename"))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil || path == shareDir {
+		errorJSON(w, http.StatusBadRequest, "invalid filename")
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	mimeType := detectMIME(path)
+	if strings.HasPrefix(mimeType, "image/") {
+		key := thumbnailKey(path, info, size)
+		if data, ok := thumbnails.get(key); ok {
+			writeThumbnail(w, data)
+			return
+		}
+		data, err := renderThumbnail(r.Context(), path, size)
+		if err == nil {
+			thumbnails.put(key, data)
+			writeThumbnail(w, data)
+			return
+		}
+		if r.Context().Err() != nil {
+			return // the app scrolled past this one
+		}
+		// Formats without a pure Go decoder (HEIC, WebP...) fall through to
+		// an icon.
+		slog.Debug("No thumbnail for image", "path", path, "err", err)
+	}
+
+	if isTextMIME(mimeType) {
+		preview, truncated, err := textPreview(path)
+		if err == nil {
+			writeJSON(w, http.StatusOK, map[string]any{
+				"type":      "text",
+				"mime":      mimeType,
+				"preview":   preview,
+				"truncated": truncated,
+			})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"type": "icon",
+		"mime": mimeType,
+		"icon": iconHint(mimeType),
+	})
+}
+
+// writeThumbnail sends image bytes, sniffing JPEG vs PNG from the data.
+func writeThumbnail(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // register decoder
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// thumbnailCache stores rendered thumbnails on disk, bounded by total size
+// with least-recently-used eviction. A cache file's mtime records its last
+// use. Keys include the source's mtime and size, so editing a file
+// invalidates its thumbnails; the stale ones age out.
+type thumbnailCache struct {
+	mu     sync.Mutex
+	dir    string
+	max    int64
+	size   int64
+	loaded bool
+}
+
+func newThumbnailCache(dir string, max int64) *thumbnailCache {
+	return &thumbnailCache{dir: dir, max: max}
+}
+
+var thumbnails = newThumbnailCache(thumbnailCacheDir, maxThumbnailCacheBytes)
+
+func thumbnailKey(path string, info os.FileInfo, size int) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d", path, info.ModTime().UnixNano(), info.Size(), size)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns a cached thumbnail and marks it as recently used.
+func (c *thumbnailCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := filepath.Join(c.dir, key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return data, true
+}
+
+// put stores a thumbnail, evicting the least recently used entries to stay
+// within c.max.
+func (c *thumbnailCache) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := ensureDir(c.dir); err != nil {
+		slog.Warn("Failed to create thumbnail cache", "dir", c.dir, "err", err)
+		return
+	}
+	if !c.loaded {
+		c.size = dirSize(c.dir)
+		c.loaded = true
+	}
+	tmp := filepath.Join(c.dir, key+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		slog.Warn("Failed to write thumbnail", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(c.dir, key)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	c.size += int64(len(data))
+	if c.size > c.max {
+		c.evict()
+	}
+}
+
+// evict removes the oldest entries until the cache is at 90% of its limit,
+// leaving headroom so not every insert triggers a directory scan. Callers
+// hold c.mu.
+func (c *thumbnailCache) evict() {
+	type entry struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+	var entries []entry
+	var total int64
+	_ = filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			entries = append(entries, entry{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUse.Before(entries[j].lastUse) })
+
+	target := c.max / 10 * 9
+	for _, e := range entries {
+		if total <= target {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			total -= e.size
+		}
+	}
+	c.size = total
+}
+
+// thumbnailRenders bounds concurrent renders: decoding a large photo takes
+// a core and hundreds of megabytes, and a gallery scroll asks for dozens.
+var thumbnailRenders = make(chan struct{}, maxThumbnailRenders)
+
+// renderThumbnail decodes the image at path and scales it to fit within
+// size×size. Images with transparency are encoded as PNG, the rest as JPEG.
+// It waits for a render slot, giving up if ctx is done first.
+func renderThumbnail(ctx context.Context, path string, size int) ([]byte, error) {
+	select {
+	case thumbnailRenders <- struct{}{}:
+		defer func() { <-thumbnailRenders }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("image too large to thumbnail (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	thumb := scaleToFit(src, size)
+	var buf bytes.Buffer
+	if hasAlpha(thumb) {
+		err = png.Encode(&buf, thumb)
+	} else {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	}
+	return buf.Bytes(), err
+}
+
+// scaleToFit shrinks src to fit within size×size by averaging each
+// destination pixel's box of source pixels. Smaller images are copied as-is.
+func scaleToFit(src image.Image, size int) *image.NRGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, max(1, sh*size/sw)
+		} else {
+			dw, dh = max(1, sw*size/sh), size
+		}
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	if dw == sw && dh == sh {
+		draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+		return dst
+	}
+
+	at := nrgbaAt(src)
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := at(sx, sy)
+					r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// nrgbaAt returns an accessor for src's 8-bit non-premultiplied colour.
+// The image types the decoders produce are read straight from their pixel
+// buffers; At boxes every pixel in an interface, which on a 50 MP photo
+// means as many allocations.
+func nrgbaAt(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch img := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			yi, ci := img.YOffset(x, y), img.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+			return uint32(r), uint32(g), uint32(b), 0xFF
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := img.PixOffset(x, y)
+			return uint32(img.Pix[i]), uint32(img.Pix[i+1]), uint32(img.Pix[i+2]), uint32(img.Pix[i+3])
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := img.PixOffset(x, y)
+			r, g, b, a := uint32(img.Pix[i]), uint32(img.Pix[i+1]), uint32(img.Pix[i+2]), uint32(img.Pix[i+3])
+			if a == 0 || a == 0xFF {
+				return r, g, b, a
+			}
+			return r * 0xFF / a, g * 0xFF / a, b * 0xFF / a, a
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)])
+			return v, v, v, 0xFF
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) {
+		c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+		return uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+	}
+}
+
+func hasAlpha(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xFF {
+			return true
+		}
+	}
+	return false
+}
+
+// textPreview returns roughly the first page of a text file: at most
+// maxTextPreviewLines lines from its first maxTextPreviewBytes, cut on a
+// UTF-8 boundary. Invalid bytes (a Latin-1 "é", say) become U+FFFD.
+func textPreview(path string) (preview string, truncated bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	buf := make([]byte, maxTextPreviewBytes+1)
+	n, _ := f.Read(buf)
+	truncated = n > maxTextPreviewBytes
+	data := buf[:min(n, maxTextPreviewBytes)]
+	if truncated {
+		// Drop a character the cut split in two.
+		for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+			if start := len(data) - i; utf8.RuneStart(data[start]) {
+				if !utf8.FullRune(data[start:]) {
+					data = data[:start]
+				}
+				break
+			}
+		}
+	}
+	text := strings.ToValidUTF8(string(data), "\uFFFD")
+
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > maxTextPreviewLines {
+		lines, truncated = lines[:maxTextPreviewLines], true
+	}
+	return strings.Join(lines, ""), truncated, nil
+}
+
+// isTextMIME reports whether a file of this type is worth previewing as
+// text.
+func isTextMIME(mimeType string) bool {
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	switch mimeType {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh", "application/toml", "application/yaml":
+		return true
+	}
+	return false
+}
+
+// iconHint names the generic icon the app should show for a type it cannot
+// preview.
+func iconHint(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	case mimeType == "application/pdf":
+		return "pdf"
+	case strings.Contains(mimeType, "zip"), strings.Contains(mimeType, "x-tar"), strings.Contains(mimeType, "compressed"),
+		strings.Contains(mimeType, "gzip"), strings.Contains(mimeType, "7z"), strings.Contains(mimeType, "rar"):
+		return "archive"
+	case strings.Contains(mimeType, "document"), strings.Contains(mimeType, "msword"),
+		strings.Contains(mimeType, "spreadsheet"), strings.Contains(mimeType, "presentation"):
+		return "document"
+	case strings.HasPrefix(mimeType, "application/vnd.android.package-archive"):
+		return "apk"
+	}
+	return "file"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// moveToTrash moves path into the user's trash following the freedesktop.org
+// Trash specification, so file managers can list and restore it. It returns
+// the name the item was given inside the trash.
+func moveToTrash(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(abs)
+	if err != nil {
+		return "", err
+	}
+	filesDir, infoDir := filepath.Join(trashDir, "files"), filepath.Join(trashDir, "info")
+	if err := os.MkdirAll(filesDir, 0o700); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(infoDir, 0o700); err != nil {
+		return "", err
+	}
+
+	// Claim a unique name by creating its .trashinfo exclusively, as the
+	// spec requires, then move the item under the same name.
+	base := filepath.Base(abs)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 0; i <= maxRenameAttempts; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d%s", stem, i, ext)
+		}
+		infoPath := filepath.Join(infoDir, name+".trashinfo")
+		f, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = fmt.Fprintf(f, "[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+			trashInfoPath(abs), time.Now().Format("2006-01-02T15:04:05"))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(infoPath)
+			return "", err
+		}
+
+		dest := filepath.Join(filesDir, name)
+		if info.IsDir() {
+			err = moveDir(abs, dest)
+		} else {
+			err = moveFile(abs, dest)
+		}
+		if err != nil {
+			os.Remove(infoPath)
+			return "", err
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("no free trash name for %s", base)
+}
+
+// trashInfoPath escapes an absolute path for the Path= key, which the spec
+// defines as a URL-escaped string.
+func trashInfoPath(abs string) string {
+	parts := strings.Split(abs, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Resumable uploads implement the tus 1.0.0 core protocol plus the creation
+// and termination extensions (https://tus.io/protocols/resumable-upload):
+//
+//	POST   /uploads        create, Upload-Length + Upload-Metadata "filename <b64>"
+//	HEAD   /uploads/{id}   current Upload-Offset, to resume after a dropped connection
+//	PATCH  /uploads/{id}   append application/offset+octet-stream at Upload-Offset
+//	DELETE /uploads/{id}   abandon the upload
+//
+// Data is staged in uploadStagingDir and renamed into uploadDir once the
+// last byte arrives.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusBasePath   = "/uploads"
+)
+
+// setTusDiscoveryHeaders advertises server capabilities, as answered to
+// OPTIONS requests (see corsMiddleware).
+func setTusDiscoveryHeaders(h http.Header) {
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Extension", tusExtensions)
+	h.Set("Tus-Max-Size", strconv.FormatInt(maxResumableUploadBytes, 10))
+}
+
+// requireTusResumable enforces the protocol version header that every
+// non-OPTIONS tus request must carry, replying 412 if it is missing.
+func requireTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		errorJSON(w, http.StatusPreconditionFailed, "unsupported Tus-Resumable version")
+		return false
+	}
+	return true
+}
+
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !requireTusResumable(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		errorJSON(w, http.StatusBadRequest, "missing or invalid Upload-Length")
+		return
+	}
+	if length > maxResumableUploadBytes {
+		errorJSON(w, http.StatusRequestEntityTooLarge, "upload exceeds Tus-Max-Size")
+		return
+	}
+
+	client := uploadQuotaKey(r)
+	qerr := checkUploadFileSize(length)
+	if qerr == nil {
+		qerr = checkUploadQuota(uploadDir, client, length)
+	}
+	if qerr != nil {
+		slog.Warn("Upload rejected by quota", "client", client, "code", qerr.Code, "bytes", length)
+		writeQuotaError(w, qerr)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filename := strings.TrimSpace(metadata["filename"])
+	if _, err := safePath(uploadDir, filename); err != nil || filename == "" {
+		errorJSON(w, http.StatusBadRequest, "missing or invalid filename metadata")
+		return
+	}
+	if _, err := parseConflictPolicy(metadata["conflict"]); err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u, err := createTusUpload(filename, length, metadata)
+	if err != nil {
+		slog.Error("Failed to create resumable upload", "filename", filename, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "could not create upload")
+		return
+	}
+
+	// Zero-length files are complete as soon as they exist.
+	if length == 0 {
+		if err := completeTusUpload(u); err != nil {
+			removeTusUpload(u.ID) // the client has no Location to retry with
+			writeTusCompleteError(w, u, err)
+			return
+		}
+		fileReceived(u.StoredAs)
+	}
+
+	slog.Info("Resumable upload created", "id", u.ID, "filename", filename, "length", length)
+	w.Header().Set("Location", tusBasePath+"/"+u.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleTusHead(w http.ResponseWriter, r *http.Request) {
+	if !requireTusResumable(w, r) {
+		return
+	}
+	u, offset, err := loadTusUpload(r.PathValue("id"))
+	if err != nil {
+		writeTusLoadError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !requireTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		errorJSON(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset < 0 {
+		errorJSON(w, http.StatusBadRequest, "missing or invalid Upload-Offset")
+		return
+	}
+	conflict := r.URL.Query().Get("conflict")
+	if _, err := parseConflictPolicy(conflict); err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id := r.PathValue("id")
+	if !lockTusUpload(id) {
+		errorJSON(w, http.StatusLocked, errUploadBusy.Error())
+		return
+	}
+	defer unlockTusUpload(id)
+
+	u, offset, err := loadTusUpload(id)
+	if err != nil {
+		writeTusLoadError(w, r, err)
+		return
+	}
+	if u.Completed || clientOffset != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		errorJSON(w, http.StatusConflict, "Upload-Offset does not match current offset")
+		return
+	}
+	remaining := u.Length - offset
+	if r.ContentLength > remaining {
+		errorJSON(w, http.StatusRequestEntityTooLarge, "chunk exceeds Upload-Length")
+		return
+	}
+
+	f, err := openTusData(id)
+	if err != nil {
+		slog.Error("Failed to open staged upload", "id", id, "err", err)
+		errorJSON(w, http.StatusInternalServerError, "could not open upload")
+		return
+	}
+	// Whatever arrives before a dropped connection is kept; the client
+	// resumes from the new offset reported by HEAD.
+	written, copyErr := io.Copy(f, io.LimitReader(r.Body, remaining))
+	closeErr := f.Close()
+	offset += written
+	dailyUploads.record(uploadQuotaKey(r), written)
+
+	if copyErr != nil || closeErr != nil {
+		slog.Warn("Resumable upload chunk interrupted", "id", id, "offset", offset, "err", errors.Join(copyErr, closeErr))
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		errorJSON(w, http.StatusInternalServerError, "failed to write chunk")
+		return
+	}
+
+	if offset == u.Length {
+		// A retried final PATCH may pick another conflict policy.
+		if conflict != "" {
+			if u.Metadata == nil {
+				u.Metadata = map[string]string{}
+			}
+			u.Metadata["conflict"] = conflict
+		}
+		if err := completeTusUpload(u); err != nil {
+			writeTusCompleteError(w, u, err)
+			return
+		}
+		slog.Info("File received from phone", "filename", u.Filename, "id", id, "size", u.Length)
+		fileReceived(u.StoredAs)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !requireTusResumable(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !lockTusUpload(id) {
+		errorJSON(w, http.StatusLocked, errUploadBusy.Error())
+		return
+	}
+	defer unlockTusUpload(id)
+
+	if _, _, err := loadTusUpload(id); err != nil {
+		writeTusLoadError(w, r, err)
+		return
+	}
+	removeTusUpload(id)
+	slog.Info("Resumable upload terminated", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeTusCompleteError reports a failure to move a finished upload into
+// uploadDir. The data stays staged: after a "fail" conflict the client can
+// free the name, or send the final PATCH again with another ?conflict=.
+func writeTusCompleteError(w http.ResponseWriter, u *tusUpload, err error) {
+	if errors.Is(err, errFileExists) {
+		errorJSON(w, http.StatusConflict, err.Error())
+		return
+	}
+	slog.Error("Failed to finalise resumable upload", "id", u.ID, "err", err)
+	errorJSON(w, http.StatusInternalServerError, "failed to store file")
+}
+
+func writeTusLoadError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errUploadNotFound) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		errorJSON(w, http.StatusNotFound, err.Error())
+		return
+	}
+	slog.Error("Failed to load resumable upload", "id", r.PathValue("id"), "err", err)
+	errorJSON(w, http.StatusInternalServerError, "could not load upload")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tusUpload is the persisted state of one resumable upload. The data itself
+// lives next to it in <id>.bin; its size is the authoritative offset, so an
+// upload survives daemon restarts.
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Filename  string            `json:"filename"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+	Completed bool              `json:"completed"`
+	StoredAs  string            `json:"stored_as,omitempty"`
+}
+
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadBusy     = errors.New("upload is locked by another request")
+)
+
+// tusLocks serialises PATCH/DELETE per upload id.
+var (
+	tusLocksMu sync.Mutex
+	tusLocks   = map[string]bool{}
+)
+
+// lockTusUpload marks id as in use. It returns false if another request
+// already holds it.
+func lockTusUpload(id string) bool {
+	tusLocksMu.Lock()
+	defer tusLocksMu.Unlock()
+	if tusLocks[id] {
+		return false
+	}
+	tusLocks[id] = true
+	return true
+}
+
+func unlockTusUpload(id string) {
+	tusLocksMu.Lock()
+	defer tusLocksMu.Unlock()
+	delete(tusLocks, id)
+}
+
+func tusInfoPath(id string) string { return filepath.Join(uploadStagingDir, id+".json") }
+func tusDataPath(id string) string { return filepath.Join(uploadStagingDir, id+".bin") }
+
+// validTusID rejects anything that isn't an id produced by randomID, so a
+// crafted id can never address files outside uploadStagingDir.
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func createTusUpload(filename string, length int64, metadata map[string]string) (*tusUpload, error) {
+	if err := ensureDir(uploadStagingDir); err != nil {
+		return nil, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	u := &tusUpload{
+		ID:        id,
+		Filename:  filename,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}
+	if err := os.WriteFile(tusDataPath(id), nil, 0o644); err != nil {
+		return nil, err
+	}
+	if err := saveTusUpload(u); err != nil {
+		_ = os.Remove(tusDataPath(id))
+		return nil, err
+	}
+	return u, nil
+}
+
+func saveTusUpload(u *tusUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := tusInfoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tusInfoPath(u.ID))
+}
+
+// loadTusUpload returns the upload and its current offset.
+func loadTusUpload(id string) (*tusUpload, int64, error) {
+	if !validTusID(id) {
+		return nil, 0, errUploadNotFound
+	}
+	data, err := os.ReadFile(tusInfoPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, errUploadNotFound
+		}
+		return nil, 0, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, 0, fmt.Errorf("corrupt upload info: %w", err)
+	}
+	if u.Completed {
+		return &u, u.Length, nil
+	}
+	info, err := os.Stat(tusDataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &u, info.Size(), nil
+}
+
+func openTusData(id string) (*os.File, error) {
+	return os.OpenFile(tusDataPath(id), os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+func removeTusUpload(id string) {
+	_ = os.Remove(tusDataPath(id))
+	_ = os.Remove(tusInfoPath(id))
+}
+
+// completeTusUpload moves the finished data into uploadDir, applying the
+// upload's conflict policy, and records the final name so a HEAD after
+// completion still reports the full offset. On failure the data is back in
+// staging, so the final PATCH can be retried.
+func completeTusUpload(u *tusUpload) error {
+	policy, err := parseConflictPolicy(u.Metadata["conflict"])
+	if err != nil {
+		return err
+	}
+	path, skipped, err := moveIntoDir(tusDataPath(u.ID), uploadDir, u.Filename, policy)
+	if err != nil {
+		return err
+	}
+
+	u.Completed = true
+	u.StoredAs = filepath.Base(path)
+	if err := saveTusUpload(u); err != nil {
+		u.Completed, u.StoredAs = false, ""
+		if !skipped {
+			if restoreErr := moveFile(path, tusDataPath(u.ID)); restoreErr != nil {
+				return fmt.Errorf("%w (and restoring the upload failed: %v)", err, restoreErr)
+			}
+		}
+		return err
+	}
+	if skipped {
+		_ = os.Remove(tusDataPath(u.ID))
+	}
+	return nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs where the value may be omitted.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			meta[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("metadata %q is not valid base64", fields[0])
+			}
+			meta[fields[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("malformed Upload-Metadata")
+		}
+	}
+	return meta, nil
+}
+
+// gcStagedUploads deletes uploads whose data has not been touched for
+// uploadStagingTTL, including the bookkeeping for completed ones.
+func gcStagedUploads(now time.Time) (removed int) {
+	entries, err := os.ReadDir(uploadStagingDir)
+	if err != nil {
+		return 0
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validTusID(id) {
+			continue
+		}
+		// The data file's mtime reflects the last PATCH; completed uploads
+		// no longer have one, so fall back to the info file.
+		info, err := os.Stat(tusDataPath(id))
+		if err != nil {
+			info, err = entry.Info()
+			if err != nil {
+				continue
+			}
+		}
+		if now.Sub(info.ModTime()) > uploadStagingTTL {
+			if !lockTusUpload(id) {
+				continue
+			}
+			removeTusUpload(id)
+			unlockTusUpload(id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// runStagedUploadGC periodically garbage-collects abandoned uploads until
+// ctx is cancelled.
+func runStagedUploadGC(ctx context.Context) {
+	ticker := time.NewTicker(uploadStagingGCInterval)
+	defer ticker.Stop()
+	for {
+		if n := gcStagedUploads(time.Now()); n > 0 {
+			slog.Info("Removed abandoned uploads", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,58 +1,358 @@
 package main
 
 import (
-	"io"
+	"errors"
+	"fmt"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
-	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// handleUpload serves POST /upload. The form may carry several "file"
+// parts; optional "path" and "sha256" fields are matched to them by
+// position, so path[i] is the relative destination of file[i] (e.g.
+// "Album/IMG_0001.jpg"). Either every file has a path (and a sha256) or
+// none does. Each file succeeds or fails on its own.
 func handleUpload(w http.ResponseWriter, r *http.Request) {
+	// Reject over-quota requests up front, before the multipart parser
+	// spools anything to disk. Content-Length slightly overstates the total
+	// (multipart framing), which errs on the safe side. The per-file limit
+	// waits for storeUploadPart: a batch may hold several allowed files.
+	if r.ContentLength < 0 {
+		errorJSON(w, http.StatusLengthRequired, "Content-Length required")
+		return
+	}
+	client := uploadQuotaKey(r)
+	if qerr := checkUploadQuota(uploadDir, client, r.ContentLength); qerr != nil {
+		slog.Warn("Upload rejected by quota", "client", client, "code", qerr.Code, "bytes", r.ContentLength)
+		writeQuotaError(w, qerr)
+		return
+	}
+
+	// The server already stops at Content-Length; MaxBytesReader is the
+	// backstop that keeps the spooled form within what was checked.
+	r.Body = http.MaxBytesReader(w, r.Body, r.ContentLength)
 	// 32 MB in-memory threshold; larger files spill to OS temp automatically.
 	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			errorJSON(w, http.StatusRequestEntityTooLarge, "file exceeds maximum upload size")
+			return
+		}
 		errorJSON(w, http.StatusBadRequest, "failed to parse multipart form")
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
 		errorJSON(w, http.StatusBadRequest, "missing 'file' field")
 		return
 	}
-	defer file.Close()
+	paths := r.MultipartForm.Value["path"]
+	sums := r.MultipartForm.Value["sha256"]
+	// Matching by position only works if nothing is missing in between.
+	if (len(paths) != 0 && len(paths) != len(headers)) || (len(sums) != 0 && len(sums) != len(headers)) {
+		errorJSON(w, http.StatusBadRequest, "send one 'path' and 'sha256' field per file, or none")
+		return
+	}
 
-	dest, err := safePath(uploadDir, header.Filename)
+	policy, err := parseConflictPolicy(r.FormValue("conflict"))
 	if err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid filename")
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results := make([]uploadResult, len(headers))
+	var received []string
+	succeeded := 0
+	for i, header := range headers {
+		var relPath, wantSum string
+		var err error
+		if i < len(paths) {
+			relPath = paths[i]
+		}
+		if len(headers) == 1 {
+			// The checksum header only makes sense for a single file.
+			wantSum, err = expectedSHA256(r)
+		} else if i < len(sums) {
+			wantSum, err = parseSHA256(sums[i])
+		}
+		if err != nil {
+			results[i] = uploadResult{Filename: header.Filename, Path: relPath, Status: "error", Error: err.Error(), code: http.StatusBadRequest}
+			continue
+		}
+
+		results[i] = storeUploadPart(header, relPath, policy, wantSum, client)
+		switch results[i].Status {
+		case "success":
+			received = append(received, results[i].StoredAs)
+			succeeded++
+		case "skipped":
+			succeeded++
+		}
+	}
+	fileReceived(received...)
+
+	if len(headers) == 1 {
+		writeSingleUploadResult(w, results[0])
+		return
+	}
+
+	status := "success"
+	switch {
+	case succeeded == 0:
+		status = "error"
+	case succeeded < len(results):
+		status = "partial"
+	}
+	slog.Info("Batch upload finished", "files", len(results), "succeeded", succeeded)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": status,
+		"files":  results,
+	})
+}
+
+// storeUploadPart stores one multipart file under uploadDir, honouring an
+// optional relative path, and accounts it to client.
+func storeUploadPart(header *multipart.FileHeader, relPath string, policy conflictPolicy, wantSum, client string) uploadResult {
+	result := uploadResult{Filename: header.Filename, Path: relPath}
+	fail := func(code int, msg string) uploadResult {
+		result.Status, result.Error, result.code = "error", msg, code
+		return result
+	}
+
+	// The request-level check can't see individual sizes, and earlier
+	// parts of a batch may have used up the quota.
+	qerr := checkUploadFileSize(header.Size)
+	if qerr == nil {
+		qerr = checkUploadQuota(uploadDir, client, header.Size)
+	}
+	if qerr != nil {
+		slog.Warn("Upload rejected by quota", "client", client, "filename", header.Filename, "code", qerr.Code)
+		result.Code = qerr.Code
+		return fail(qerr.httpStatus, qerr.Message)
+	}
+
+	dir, name := uploadDir, header.Filename
+	if relPath != "" {
+		dest, err := safeRelPath(uploadDir, relPath)
+		if err != nil {
+			return fail(http.StatusBadRequest, "invalid path")
+		}
+		dir, name = filepath.Dir(dest), filepath.Base(dest)
+		if err := ensureSubdir(uploadDir, dir); err != nil {
+			slog.Error("Failed to create upload subdirectory", "dir", dir, "err", err)
+			return fail(http.StatusBadRequest, "invalid path")
+		}
+	}
+	if _, err := safePath(dir, name); err != nil {
+		return fail(http.StatusBadRequest, "invalid filename")
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return fail(http.StatusBadRequest, "could not read file part")
+	}
+	defer file.Close()
+
+	stored, err := storeFile(dir, name, file, policy, wantSum)
+	result.SHA256 = stored.SHA256
+	switch {
+	case errors.Is(err, errChecksumMismatch):
+		slog.Warn("Upload checksum mismatch", "filename", header.Filename, "want", wantSum, "got", stored.SHA256)
+		return fail(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, errFileExists):
+		return fail(http.StatusConflict, err.Error())
+	case err != nil:
+		slog.Error("Failed to write upload file", "filename", header.Filename, "err", err)
+		return fail(http.StatusInternalServerError, "failed to write file")
+	}
+
+	result.StoredAs, _ = filepath.Rel(uploadDir, stored.Path)
+	result.Size = stored.Size
+	dailyUploads.record(client, stored.Size)
+	if stored.Skipped {
+		slog.Info("Upload skipped; file exists", "filename", header.Filename, "dest", stored.Path)
+		result.Status = "skipped"
+		return result
+	}
+
+	slog.Info("File received from phone", "filename", header.Filename, "dest", stored.Path, "sha256", stored.SHA256)
+	result.Status = "success"
+	return result
+}
+
+// writeSingleUploadResult keeps the original one-file response shape, with
+// the failure mapped to its HTTP status.
+func writeSingleUploadResult(w http.ResponseWriter, res uploadResult) {
+	if res.Status == "error" {
+		body := map[string]string{"status": "error", "message": res.Error}
+		if res.Code != "" {
+			body["code"] = res.Code
+		}
+		if res.code == http.StatusUnprocessableEntity {
+			body["sha256"] = res.SHA256
+		}
+		writeJSON(w, res.code, body)
 		return
 	}
+	body := map[string]string{
+		"status":    res.Status,
+		"filename":  res.Filename,
+		"stored_as": res.StoredAs,
+	}
+	if res.Status == "success" {
+		body["sha256"] = res.SHA256
+	}
+	writeJSON(w, http.StatusOK, body)
+}
 
-	out, err := os.Create(dest)
+// handleRawUpload serves PUT /files/upload/{name}: the request body is the
+// file itself, streamed straight to uploadDir without multipart parsing, so
+// large videos are written to disk once. Conflict policy comes from
+// ?conflict= and an optional checksum from the X-Content-SHA256 header.
+func handleRawUpload(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, err := safePath(uploadDir, name); err != nil {
+		errorJSON(w, http.StatusBadRequest, "invalid filename")
+		return
+	}
+	if r.ContentLength < 0 {
+		errorJSON(w, http.StatusLengthRequired, "Content-Length required")
+		return
+	}
+	if r.ContentLength > maxRawUploadBytes {
+		errorJSON(w, http.StatusRequestEntityTooLarge, "file exceeds maximum upload size")
+		return
+	}
+	client := uploadQuotaKey(r)
+	qerr := checkUploadFileSize(r.ContentLength)
+	if qerr == nil {
+		qerr = checkUploadQuota(uploadDir, client, r.ContentLength)
+	}
+	if qerr != nil {
+		slog.Warn("Upload rejected by quota", "client", client, "filename", name, "code", qerr.Code)
+		writeQuotaError(w, qerr)
+		return
+	}
+	wantSum, err := parseSHA256(r.Header.Get(checksumHeader))
+	if err != nil {
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	policy, err := parseConflictPolicy(r.URL.Query().Get("conflict"))
 	if err != nil {
-		slog.Error("Failed to create upload file", "dest", dest, "err", err)
-		errorJSON(w, http.StatusInternalServerError, "could not create destination file")
+		errorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The server already stops at Content-Length; MaxBytesReader is the
+	// backstop that also bounds what a lying client can make us read.
+	body := http.MaxBytesReader(w, r.Body, maxRawUploadBytes)
+	start := time.Now()
+	stored, err := storeFile(uploadDir, name, body, policy, wantSum)
+	elapsed := time.Since(start)
+
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		errorJSON(w, http.StatusRequestEntityTooLarge, "file exceeds maximum upload size")
+		return
+	case errors.Is(err, errChecksumMismatch):
+		slog.Warn("Upload checksum mismatch", "filename", name, "want", wantSum, "got", stored.SHA256)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+			"status":  "error",
+			"message": err.Error(),
+			"sha256":  stored.SHA256,
+		})
+		return
+	case errors.Is(err, errFileExists):
+		errorJSON(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		// Includes bodies shorter than Content-Length (io.ErrUnexpectedEOF).
+		slog.Error("Failed to write raw upload", "filename", name, "err", err)
+		errorJSON(w, http.StatusBadRequest, "upload incomplete or failed to write file")
+		return
+	}
+
+	dailyUploads.record(client, stored.Size)
+	if stored.Skipped {
+		slog.Info("Upload skipped; file exists", "filename", name, "dest", stored.Path)
+		writeJSON(w, http.StatusOK, map[string]string{
+			"status":    "skipped",
+			"filename":  name,
+			"stored_as": stored.Name,
+		})
 		return
 	}
-	defer out.Close()
 
-	if _, err = io.Copy(out, file); err != nil {
-		slog.Error("Failed to write upload file", "dest", dest, "err", err)
-		errorJSON(w, http.StatusInternalServerError, "failed to write file")
+	mbps := 0.0
+	if secs := elapsed.Seconds(); secs > 0 {
+		mbps = float64(stored.Size) / (1 << 20) / secs
+	}
+	slog.Info("File received from phone",
+		"filename", name,
+		"dest", stored.Path,
+		"bytes", stored.Size,
+		"duration", elapsed.Round(time.Millisecond),
+		"mb_per_s", strconv.FormatFloat(mbps, 'f', 1, 64),
+		"sha256", stored.SHA256,
+	)
+	fileReceived(stored.Name)
+
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"status":    "success",
+		"filename":  name,
+		"stored_as": stored.Name,
+		"size":      stored.Size,
+		"sha256":    stored.SHA256,
+	})
+}
+
+// fileReceived runs the post-upload steps for files stored at rels inside
+// uploadDir: one desktop notification for the lot, and any matching upload
+// hooks. Neither holds up the upload response.
+func fileReceived(rels ...string) {
+	if len(rels) == 0 {
 		return
 	}
+	title, body := fileReceivedSummary(rels)
+	go notifyFileReceived(title, body)
+	for _, rel := range rels {
+		uploadHookRunner.enqueue(filepath.Join(uploadDir, rel))
+	}
+}
 
-	slog.Info("File received from phone", "filename", header.Filename, "dest", dest)
+// fileReceivedSummary words the notification for a finished upload,
+// listing the first few names of a batch.
+func fileReceivedSummary(rels []string) (title, body string) {
+	if len(rels) == 1 {
+		return "File received", truncate(rels[0], 200)
+	}
+	const listed = 3
+	names := make([]string, 0, listed)
+	for _, rel := range rels[:min(listed, len(rels))] {
+		names = append(names, filepath.Base(rel))
+	}
+	body = strings.Join(names, ", ")
+	if extra := len(rels) - len(names); extra > 0 {
+		body += fmt.Sprintf(" and %d more", extra)
+	}
+	return fmt.Sprintf("%d files received", len(rels)), truncate(body, 200)
+}
 
-	// Fire a desktop notification (mirrors handlePhoneNotification pattern).
+// notifyFileReceived fires a desktop notification for a completed upload
+// (mirrors handlePhoneNotification pattern). It is a variable so tests can
+// count notifications.
+var notifyFileReceived = func(title, body string) {
 	if notifySend, err := exec.LookPath("notify-send"); err == nil {
-		cmd := exec.Command(notifySend, "--app-name=Phone Sync",
-			"File received", truncate(header.Filename, 200))
+		cmd := exec.Command(notifySend, "--app-name=Phone Sync", title, body)
 		_ = cmd.Run()
 	}
-
-	writeJSON(w, http.StatusOK, map[string]string{
-		"status":   "success",
-		"filename": header.Filename,
-	})
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// conflictPolicy decides what happens when an upload's name is already
+// taken in the destination directory.
+type conflictPolicy string
+
+const (
+	conflictRename    conflictPolicy = "rename"    // store as "name (1).ext"
+	conflictOverwrite conflictPolicy = "overwrite" // replace the existing file
+	conflictSkip      conflictPolicy = "skip"      // keep the existing file, report success
+	conflictFail      conflictPolicy = "fail"      // keep the existing file, report 409
+)
+
+var (
+	errFileExists       = errors.New("file already exists")
+	errChecksumMismatch = errors.New("sha256 mismatch")
+)
+
+// parseConflictPolicy validates a client-supplied policy; empty selects
+// defaultConflictPolicy.
+func parseConflictPolicy(s string) (conflictPolicy, error) {
+	switch p := conflictPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return defaultConflictPolicy, nil
+	case conflictRename, conflictOverwrite, conflictSkip, conflictFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("conflict must be one of rename, overwrite, skip, fail")
+}
+
+// storedFile describes the outcome of storeFile.
+type storedFile struct {
+	Name    string // final name inside the destination directory
+	Path    string
+	Size    int64
+	SHA256  string
+	Skipped bool // conflictSkip left an existing file in place
+}
+
+// storeFile streams src into a temporary file in dir, verifies wantSum if
+// given, and then places it under name according to policy. The temporary
+// file is removed on every failure path, so partially written uploads never
+// appear under their real name.
+func storeFile(dir, name string, src io.Reader, policy conflictPolicy, wantSum string) (storedFile, error) {
+	dest, err := safePath(dir, name)
+	if err != nil {
+		return storedFile{}, err
+	}
+	// Cheap early exit; placeFile re-checks atomically.
+	if policy == conflictSkip || policy == conflictFail {
+		if _, err := os.Lstat(dest); err == nil {
+			if policy == conflictSkip {
+				return storedFile{Name: filepath.Base(dest), Path: dest, Skipped: true}, nil
+			}
+			return storedFile{}, errFileExists
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, ".partial-*")
+	if err != nil {
+		return storedFile{}, err
+	}
+	_ = tmp.Chmod(0o644)
+	defer os.Remove(tmp.Name()) // no-op once placed
+
+	// Hash while streaming so verification costs no extra read.
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	result := storedFile{Size: size, SHA256: hex.EncodeToString(hasher.Sum(nil))}
+	if wantSum != "" && result.SHA256 != wantSum {
+		return result, errChecksumMismatch
+	}
+
+	result.Path, result.Skipped, err = placeFile(tmp.Name(), dest, policy)
+	if err != nil {
+		return result, err
+	}
+	result.Name = filepath.Base(result.Path)
+	return result, nil
+}
+
+// placeFile moves tmp (which must be in dest's directory) to dest according
+// to policy and returns the path it ended up at.
+func placeFile(tmp, dest string, policy conflictPolicy) (path string, skipped bool, err error) {
+	switch policy {
+	case conflictOverwrite:
+		return dest, false, os.Rename(tmp, dest)
+	case conflictSkip:
+		if err := linkNoReplace(tmp, dest); errors.Is(err, os.ErrExist) {
+			return dest, true, os.Remove(tmp)
+		} else if err != nil {
+			return "", false, err
+		}
+		return dest, false, nil
+	case conflictFail:
+		if err := linkNoReplace(tmp, dest); errors.Is(err, os.ErrExist) {
+			return "", false, errFileExists
+		} else if err != nil {
+			return "", false, err
+		}
+		return dest, false, nil
+	}
+
+	// conflictRename
+	ext := filepath.Ext(dest)
+	stem := strings.TrimSuffix(dest, ext)
+	for i := 0; i <= maxRenameAttempts; i++ {
+		candidate := dest
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		err := linkNoReplace(tmp, candidate)
+		if err == nil {
+			return candidate, false, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", false, err
+		}
+	}
+	return "", false, fmt.Errorf("no free name for %s after %d attempts", filepath.Base(dest), maxRenameAttempts)
+}
+
+// moveIntoDir moves the file src into dir as name according to policy and
+// returns where it ended up. src is put back if placing it fails, and stays
+// where it is when conflictSkip finds the name taken.
+func moveIntoDir(src, dir, name string, policy conflictPolicy) (path string, skipped bool, err error) {
+	dest, err := safePath(dir, name)
+	if err != nil {
+		return "", false, err
+	}
+	if err := ensureDir(dir); err != nil {
+		return "", false, err
+	}
+	if policy == conflictSkip || policy == conflictFail {
+		if _, err := os.Lstat(dest); err == nil {
+			if policy == conflictSkip {
+				return dest, true, nil
+			}
+			return "", false, errFileExists
+		}
+		// Re-checked atomically by placeFile; a racing writer makes skip
+		// behave like fail rather than discard src.
+		policy = conflictFail
+	}
+
+	tmp, err := os.CreateTemp(dir, ".partial-*")
+	if err != nil {
+		return "", false, err
+	}
+	tmp.Close()
+	if err := moveFile(src, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return "", false, err
+	}
+	path, _, err = placeFile(tmp.Name(), dest, policy)
+	if err != nil {
+		if restoreErr := moveFile(tmp.Name(), src); restoreErr != nil {
+			return "", false, fmt.Errorf("%w (and restoring %s failed: %v)", err, src, restoreErr)
+		}
+		return "", false, err
+	}
+	return path, false, nil
+}
+
+// linkNoReplace moves tmp to dest, failing with os.ErrExist rather than
+// replacing an existing dest. A hard link gives the atomic no-clobber
+// check; filesystems without hard links fall back to check-then-rename.
+func linkNoReplace(tmp, dest string) error {
+	err := os.Link(tmp, dest)
+	if err == nil {
+		return os.Remove(tmp)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return os.ErrExist
+	}
+	if _, statErr := os.Lstat(dest); statErr == nil {
+		return os.ErrExist
+	}
+	return os.Rename(tmp, dest)
+}